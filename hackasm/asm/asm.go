@@ -0,0 +1,388 @@
+/*
+package asm is the encoder of the Hack assembler, as a package that
+other programs can use.
+
+The hackasm program reads a .asm file, where each line becomes an
+Instruction, which is checked as soon as it is parsed.  The VM
+translator makes its Instructions itself, and hands them straight to
+this package, without writing a file in between.  Mistakes are
+reported with their line number, instead of being turned into broken
+machine code.
+*/
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Kinds of instructions.
+const (
+	A = iota + 1 // @value or @symbol
+	C            // dest=comp;jump
+	L            // (label), which doesn't take up any space in the ROM.
+)
+
+// Instruction is a single line of assembly, split into its parts.
+// Line is where it came from, counting from 1.  Comment is the comment
+// at the end of the line, if there was one, so that the instruction can
+// be written back out the same way.
+type Instruction struct {
+	Kind    int
+	Symbol  string // the symbol of an A-instruction, or the name of a label.
+	Value   int    // the number of an A-instruction, when there's no symbol.
+	Dest    string
+	Comp    string
+	Jump    string
+	Line    int
+	Comment string
+}
+
+// Error is a mistake on a single line of the source.
+type Error struct {
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Computations maps the comp field of a C-instruction to its 7 bits,
+// including the "a" bit.
+var Computations = map[string]string{
+	"0":   "0101010",
+	"1":   "0111111",
+	"-1":  "0111010",
+	"D":   "0001100",
+	"A":   "0110000",
+	"M":   "1110000",
+	"!D":  "0001101",
+	"!A":  "0110001",
+	"!M":  "1110001",
+	"-D":  "0001111",
+	"-A":  "0110011",
+	"-M":  "1110011",
+	"D+1": "0011111",
+	"A+1": "0110111",
+	"M+1": "1110111",
+	"D-1": "0001110",
+	"A-1": "0110010",
+	"M-1": "1110010",
+	"D+A": "0000010",
+	"D+M": "1000010",
+	"D-A": "0010011",
+	"D-M": "1010011",
+	"A-D": "0000111",
+	"M-D": "1000111",
+	"D&A": "0000000",
+	"D&M": "1000000",
+	"D|A": "0010101",
+	"D|M": "1010101",
+}
+
+// Jumps maps the jump field of a C-instruction to its 3 bits.
+var Jumps = map[string]string{
+	"null": "000",
+	"JGT":  "001",
+	"JEQ":  "010",
+	"JGE":  "011",
+	"JLT":  "100",
+	"JNE":  "101",
+	"JLE":  "110",
+	"JMP":  "111",
+}
+
+// Predefined returns a new table with the symbols that every
+// program starts with.
+func Predefined() map[string]int {
+	symbols := map[string]int{
+		"SP":     0,
+		"LCL":    1,
+		"ARG":    2,
+		"THIS":   3,
+		"THAT":   4,
+		"SCREEN": 16384,
+		"KBD":    24576,
+	}
+	for i := 0; i < 16; i++ {
+		symbols["R"+strconv.Itoa(i)] = i
+	}
+	return symbols
+}
+
+// ParseLine splits a single line of assembly into an Instruction.
+// Spaces are ignored, and a comment is kept in the Comment field.
+// It returns false if there is no instruction on the line.
+func ParseLine(line string) (Instruction, bool, error) {
+	in, ok, err := parseLine(line)
+	if ok {
+		if i := strings.Index(line, "//"); i != -1 {
+			in.Comment = strings.TrimSpace(line[i+2:])
+		}
+	}
+	return in, ok, err
+}
+
+func parseLine(line string) (Instruction, bool, error) {
+	line = strings.SplitN(line, "//", 2)[0]
+	line = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, line)
+	if line == "" {
+		return Instruction{}, false, nil
+	}
+
+	switch line[0] {
+	case '@':
+		s := line[1:]
+		if s == "" {
+			return Instruction{}, false, fmt.Errorf("an A-instruction needs a value or a symbol.")
+		}
+		if s[0] >= '0' && s[0] <= '9' {
+			n, err := strconv.Atoi(s)
+			if err != nil || n > 32767 {
+				return Instruction{}, false, fmt.Errorf("invalid A-instruction: (%s), numbers go from 0 to 32767.", line)
+			}
+			return Instruction{Kind: A, Value: n}, true, nil
+		}
+		return Instruction{Kind: A, Symbol: s}, true, nil
+
+	case '(':
+		if !strings.HasSuffix(line, ")") || len(line) < 3 {
+			return Instruction{}, false, fmt.Errorf("invalid label: (%s)", line)
+		}
+		return Instruction{Kind: L, Symbol: line[1 : len(line)-1]}, true, nil
+	}
+
+	in := Instruction{Kind: C, Dest: "null", Jump: "null"}
+	if i := strings.Index(line, ";"); i != -1 {
+		in.Jump = line[i+1:]
+		line = line[:i]
+	}
+	if i := strings.Index(line, "="); i != -1 {
+		in.Dest = line[:i]
+		line = line[i+1:]
+	}
+	in.Comp = line
+	if _, err := Encode(in, nil); err != nil {
+		return Instruction{}, false, err
+	}
+	return in, true, nil
+}
+
+// Parse reads a whole .asm file.
+func Parse(r io.Reader) ([]Instruction, error) {
+	var out []Instruction
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		in, ok, err := ParseLine(scanner.Text())
+		if err != nil {
+			return nil, &Error{n, err}
+		}
+		if ok {
+			in.Line = n
+			out = append(out, in)
+		}
+	}
+	return out, scanner.Err()
+}
+
+// Encode turns a single A or C instruction into machine code.  The
+// symbols are needed to look up an A-instruction with a symbol.
+func Encode(in Instruction, symbols map[string]int) (uint16, error) {
+	switch in.Kind {
+	case A:
+		if in.Symbol == "" {
+			if in.Value < 0 || in.Value > 32767 {
+				return 0, fmt.Errorf("invalid A-instruction: (@%d), numbers go from 0 to 32767.", in.Value)
+			}
+			return uint16(in.Value), nil
+		}
+		n, ok := symbols[in.Symbol]
+		if !ok {
+			return 0, fmt.Errorf("unknown symbol: (%s)", in.Symbol)
+		}
+		return uint16(n), nil
+
+	case C:
+		comp, ok := Computations[in.Comp]
+		if !ok {
+			return 0, fmt.Errorf("invalid computation: (%s)", in.Comp)
+		}
+		jump, ok := Jumps[in.Jump]
+		if !ok {
+			return 0, fmt.Errorf("invalid jump: (%s)", in.Jump)
+		}
+		dest := 0
+		if in.Dest != "null" {
+			for _, r := range in.Dest {
+				bit := strings.IndexRune("MDA", r)
+				if bit < 0 || dest&(1<<uint(bit)) != 0 {
+					return 0, fmt.Errorf("invalid destination: (%s)", in.Dest)
+				}
+				dest |= 1 << uint(bit)
+			}
+		}
+		bits := "111" + comp + fmt.Sprintf("%03b", dest) + jump
+		n, _ := strconv.ParseUint(bits, 2, 16)
+		return uint16(n), nil
+	}
+	return 0, fmt.Errorf("labels don't have any machine code.")
+}
+
+// String writes the instruction the way it would look in a .asm file,
+// without any spaces or comments.
+func (in Instruction) String() string {
+	switch in.Kind {
+	case A:
+		if in.Symbol == "" {
+			return "@" + strconv.Itoa(in.Value)
+		}
+		return "@" + in.Symbol
+	case L:
+		return "(" + in.Symbol + ")"
+	}
+	s := in.Comp
+	if in.Dest != "null" {
+		s = in.Dest + "=" + s
+	}
+	if in.Jump != "null" {
+		s += ";" + in.Jump
+	}
+	return s
+}
+
+// Symbols makes the symbol table for a program.  Labels are given the
+// address of the next instruction, and any other new symbol is a
+// variable, starting at register 16.
+func Symbols(program []Instruction) (map[string]int, error) {
+	symbols := Predefined()
+	address := 0
+	for _, in := range program {
+		switch in.Kind {
+		case L:
+			if _, ok := symbols[in.Symbol]; ok {
+				return nil, &Error{in.Line, fmt.Errorf("the label (%s) is already defined.", in.Symbol)}
+			}
+			symbols[in.Symbol] = address
+		case A, C:
+			address++
+		}
+	}
+	variable := 16
+	for _, in := range program {
+		if in.Kind != A || in.Symbol == "" {
+			continue
+		}
+		if _, ok := symbols[in.Symbol]; !ok {
+			symbols[in.Symbol] = variable
+			variable++
+		}
+	}
+	return symbols, nil
+}
+
+// Assemble turns a whole program into machine code, one word for each
+// A and C instruction.
+func Assemble(program []Instruction) ([]uint16, error) {
+	symbols, err := Symbols(program)
+	if err != nil {
+		return nil, err
+	}
+	words := make([]uint16, 0, len(program))
+	for _, in := range program {
+		if in.Kind == L {
+			continue
+		}
+		word, err := Encode(in, symbols)
+		if err != nil {
+			return nil, &Error{in.Line, err}
+		}
+		words = append(words, word)
+	}
+	if len(words) > 32768 {
+		return nil, fmt.Errorf("the program needs %d words, but the ROM only has 32768.", len(words))
+	}
+	return words, nil
+}
+
+// WriteHack writes machine code in the .hack format, which is one
+// word per line, written as 16 ones and zeros.
+func WriteHack(w io.Writer, words []uint16) error {
+	bw := bufio.NewWriter(w)
+	for _, word := range words {
+		fmt.Fprintf(bw, "%016b\n", word)
+	}
+	return bw.Flush()
+}
+
+// RomAddresses returns the ROM address of the first instruction at, or
+// after, each line of the source.  There is one extra address at the
+// end, which is the size of the whole program.  lines is the number of
+// lines in the source.
+func RomAddresses(program []Instruction, lines int) []int {
+	addresses := make([]int, lines+1)
+	address := 0
+	line := 1
+	for _, in := range program {
+		if in.Kind == L {
+			continue
+		}
+		for ; line <= in.Line; line++ {
+			addresses[line-1] = address
+		}
+		address++
+	}
+	for ; line <= lines+1; line++ {
+		addresses[line-1] = address
+	}
+	return addresses
+}
+
+// ConvertSourceMap reads a source map written by the VM translator,
+// and writes a new one that uses ROM addresses instead of lines.
+//
+// Each line of the input is: first last file:line function,
+// where first and last are lines in the .asm file (counting from 1).
+// Each line of the output is the same, but first and last are the
+// range of ROM addresses.  Commands without any instructions are
+// left out.
+func ConvertSourceMap(r io.Reader, w io.Writer, addresses []int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "// hackasm source map: first last file:line function")
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "//") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid source map line: %s", line)
+		}
+		first, err1 := strconv.Atoi(fields[0])
+		last, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil || first < 1 || last < first || last >= len(addresses) {
+			return fmt.Errorf("invalid source map line: %s", line)
+		}
+		start := addresses[first-1]
+		end := addresses[last]
+		if end <= start {
+			continue
+		}
+		fmt.Fprintf(bw, "%d %d %s\n", start, end-1, fields[2])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,95 @@
+package asm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The machine code should be the same as the example that was
+// assembled by hand.
+func TestExample(t *testing.T) {
+	src, err := os.Open("../examples/ex1.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	want, err := ioutil.ReadFile("../examples/ex1.hack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words, err := Assemble(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(bytes.Buffer)
+	WriteHack(got, words)
+	if got.String() != string(want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	src := `
+@i     // variable at 16
+M=1
+(LOOP)
+@j     // variable at 17
+D=M
+@LOOP
+D; JGT
+@SCREEN
+`
+	program, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	words, err := Assemble(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint16{16, 0xefc8, 17, 0xfc10, 2, 0xe301, 16384}
+	if len(words) != len(want) {
+		t.Fatalf("got %d words, want %d", len(words), len(want))
+	}
+	for i := range want {
+		if words[i] != want[i] {
+			t.Errorf("word %d: got %016b, want %016b", i, words[i], want[i])
+		}
+	}
+	addresses := RomAddresses(program, 9)
+	if addresses[3] != 2 || addresses[8] != 6 || addresses[9] != 7 {
+		t.Errorf("wrong ROM addresses: %v", addresses)
+	}
+}
+
+// Mistakes should be reported with their line, instead of being
+// turned into machine code.
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		line int
+	}{
+		{"@1\nD=X", 2},
+		{"D;JMPP", 1},
+		{"\n\nMM=D", 3},
+		{"@99999", 1},
+		{"(A)\n(A)", 2},
+	}
+	for _, test := range tests {
+		program, err := Parse(strings.NewReader(test.src))
+		if err == nil {
+			_, err = Assemble(program)
+		}
+		e, ok := err.(*Error)
+		if !ok || e.Line != test.line {
+			t.Errorf("%q: got error %v, want an error on line %d", test.src, err, test.line)
+		}
+	}
+}
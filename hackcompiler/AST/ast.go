@@ -0,0 +1,220 @@
+/*
+package AST is the abstract syntax tree for the Jack programming language.
+
+The parser builds the tree, and everything else is a pass over it: the
+VM code generator, the XML printer, and any analyses.  Every node knows
+where it came from in the source file, by its Span.
+
+Passes can either implement the Visitor interface, where each node calls
+the method for its own type, or use Inspect to look at every node in
+the tree without caring about most of them.
+
+Types are kept as strings, the same way they are written in the source
+code: "int", "char", "boolean", "void", or the name of a class.
+*/
+package AST
+
+import "github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
+
+// Node is anything in the tree.
+type Node interface {
+	Span() Token.Span
+	Accept(v Visitor)
+}
+
+// Stmt is a statement, like let or while.
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+// Expr is an expression.  A term is an expression too.
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// Position is embedded in every node, to give it a Span.
+type Position struct {
+	Pos Token.Span
+}
+
+func (p Position) Span() Token.Span {
+	return p.Pos
+}
+
+// Ident is a name, along with where it was written.
+type Ident struct {
+	Position
+	Name string
+}
+
+// ---------------------------------------------------------------------
+// Declarations
+
+// ClassDecl = 'class' className '{' classVarDec* subroutineDec* '}'
+type ClassDecl struct {
+	Position
+	Name        string
+	Vars        []*ClassVarDecl
+	Subroutines []*SubroutineDecl
+}
+
+// ClassVarDecl = ('static' | 'field') type varName (',' varName)* ';'
+type ClassVarDecl struct {
+	Position
+	Kind  string // "static" or "field"
+	Type  string
+	Names []*Ident
+}
+
+// SubroutineDecl is a constructor, function, or method, along with
+// its parameters, local variables, and statements.
+type SubroutineDecl struct {
+	Position
+	Kind       string // "constructor", "function", or "method"
+	ReturnType string
+	Name       string
+	Params     []*Param
+	Locals     []*VarDecl
+	Body       []Stmt
+}
+
+// Param is one of the parameters of a subroutine.
+type Param struct {
+	Position
+	Type string
+	Name string
+}
+
+// VarDecl = 'var' type varName (',' varName)* ';'
+type VarDecl struct {
+	Position
+	Type  string
+	Names []*Ident
+}
+
+// ---------------------------------------------------------------------
+// Statements
+
+// LetStmt = 'let' varName ('[' expression ']')? '=' expression ';'
+// Index is nil when it isn't an array.
+type LetStmt struct {
+	Position
+	Name  *Ident
+	Index Expr
+	Value Expr
+}
+
+// IfStmt = 'if' '(' expression ')' '{' statements '}' ('else' '{' statements '}')?
+// HasElse is true if there was an else, even when it was empty.
+type IfStmt struct {
+	Position
+	Cond    Expr
+	Then    []Stmt
+	HasElse bool
+	Else    []Stmt
+}
+
+// WhileStmt = 'while' '(' expression ')' '{' statements '}'
+type WhileStmt struct {
+	Position
+	Cond Expr
+	Body []Stmt
+}
+
+// DoStmt = 'do' subroutineCall ';'
+type DoStmt struct {
+	Position
+	Call *CallExpr
+}
+
+// ReturnStmt = 'return' expression? ';'
+// Value is nil when nothing is returned.
+type ReturnStmt struct {
+	Position
+	Value Expr
+}
+
+// ---------------------------------------------------------------------
+// Expressions
+
+// IntLit is an integer constant.
+type IntLit struct {
+	Position
+	Value int
+}
+
+// StringLit is a string constant, without the quotation marks.
+type StringLit struct {
+	Position
+	Value string
+}
+
+// KeywordLit is one of: true, false, null, this.
+type KeywordLit struct {
+	Position
+	Value string
+}
+
+// VarExpr is a variable being used as a value.
+type VarExpr struct {
+	Position
+	Name string
+}
+
+// IndexExpr = varName '[' expression ']'
+type IndexExpr struct {
+	Position
+	Name  string
+	Index Expr
+}
+
+// CallExpr is a subroutine call.  Receiver is the name before the dot,
+// which can be a class name or a variable name.  It is empty when the
+// call doesn't have a dot, like foo().
+type CallExpr struct {
+	Position
+	Receiver string
+	Name     string
+	Args     []Expr
+}
+
+// UnaryExpr = ('-' | '~') term
+type UnaryExpr struct {
+	Position
+	Op string
+	X  Expr
+}
+
+// BinaryExpr is two expressions with an operator between them.  Jack
+// doesn't have operator precedence, so "a + b * c" is parsed as
+// "(a + b) * c", and X is the part on the left.
+type BinaryExpr struct {
+	Position
+	Op string
+	X  Expr
+	Y  Expr
+}
+
+// ParenExpr = '(' expression ')'
+type ParenExpr struct {
+	Position
+	X Expr
+}
+
+func (*LetStmt) stmtNode()    {}
+func (*IfStmt) stmtNode()     {}
+func (*WhileStmt) stmtNode()  {}
+func (*DoStmt) stmtNode()     {}
+func (*ReturnStmt) stmtNode() {}
+
+func (*IntLit) exprNode()     {}
+func (*StringLit) exprNode()  {}
+func (*KeywordLit) exprNode() {}
+func (*VarExpr) exprNode()    {}
+func (*IndexExpr) exprNode()  {}
+func (*CallExpr) exprNode()   {}
+func (*UnaryExpr) exprNode()  {}
+func (*BinaryExpr) exprNode() {}
+func (*ParenExpr) exprNode()  {}
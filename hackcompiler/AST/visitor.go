@@ -0,0 +1,108 @@
+package AST
+
+// Visitor has one method for each kind of node.  Calling Accept on a
+// node calls the matching method.  The visitor decides whether to go
+// into the children, and in what order, by calling Accept on them.
+type Visitor interface {
+	VisitClass(*ClassDecl)
+	VisitClassVar(*ClassVarDecl)
+	VisitSubroutine(*SubroutineDecl)
+	VisitVar(*VarDecl)
+
+	VisitLet(*LetStmt)
+	VisitIf(*IfStmt)
+	VisitWhile(*WhileStmt)
+	VisitDo(*DoStmt)
+	VisitReturn(*ReturnStmt)
+
+	VisitInt(*IntLit)
+	VisitString(*StringLit)
+	VisitKeyword(*KeywordLit)
+	VisitVarExpr(*VarExpr)
+	VisitIndex(*IndexExpr)
+	VisitCall(*CallExpr)
+	VisitUnary(*UnaryExpr)
+	VisitBinary(*BinaryExpr)
+	VisitParen(*ParenExpr)
+}
+
+func (n *ClassDecl) Accept(v Visitor)      { v.VisitClass(n) }
+func (n *ClassVarDecl) Accept(v Visitor)   { v.VisitClassVar(n) }
+func (n *SubroutineDecl) Accept(v Visitor) { v.VisitSubroutine(n) }
+func (n *VarDecl) Accept(v Visitor)        { v.VisitVar(n) }
+
+func (n *LetStmt) Accept(v Visitor)    { v.VisitLet(n) }
+func (n *IfStmt) Accept(v Visitor)     { v.VisitIf(n) }
+func (n *WhileStmt) Accept(v Visitor)  { v.VisitWhile(n) }
+func (n *DoStmt) Accept(v Visitor)     { v.VisitDo(n) }
+func (n *ReturnStmt) Accept(v Visitor) { v.VisitReturn(n) }
+
+func (n *IntLit) Accept(v Visitor)     { v.VisitInt(n) }
+func (n *StringLit) Accept(v Visitor)  { v.VisitString(n) }
+func (n *KeywordLit) Accept(v Visitor) { v.VisitKeyword(n) }
+func (n *VarExpr) Accept(v Visitor)    { v.VisitVarExpr(n) }
+func (n *IndexExpr) Accept(v Visitor)  { v.VisitIndex(n) }
+func (n *CallExpr) Accept(v Visitor)   { v.VisitCall(n) }
+func (n *UnaryExpr) Accept(v Visitor)  { v.VisitUnary(n) }
+func (n *BinaryExpr) Accept(v Visitor) { v.VisitBinary(n) }
+func (n *ParenExpr) Accept(v Visitor)  { v.VisitParen(n) }
+
+// Inspect calls f on every node in the tree, in the order they appear
+// in the source code.  If f returns false, the children of that node
+// are skipped.
+func Inspect(n Node, f func(Node) bool) {
+	if n == nil || !f(n) {
+		return
+	}
+	switch n := n.(type) {
+	case *ClassDecl:
+		for _, c := range n.Vars {
+			Inspect(c, f)
+		}
+		for _, c := range n.Subroutines {
+			Inspect(c, f)
+		}
+	case *SubroutineDecl:
+		for _, c := range n.Locals {
+			Inspect(c, f)
+		}
+		inspectStmts(n.Body, f)
+	case *LetStmt:
+		if n.Index != nil {
+			Inspect(n.Index, f)
+		}
+		Inspect(n.Value, f)
+	case *IfStmt:
+		Inspect(n.Cond, f)
+		inspectStmts(n.Then, f)
+		inspectStmts(n.Else, f)
+	case *WhileStmt:
+		Inspect(n.Cond, f)
+		inspectStmts(n.Body, f)
+	case *DoStmt:
+		Inspect(n.Call, f)
+	case *ReturnStmt:
+		if n.Value != nil {
+			Inspect(n.Value, f)
+		}
+	case *IndexExpr:
+		Inspect(n.Index, f)
+	case *CallExpr:
+		for _, c := range n.Args {
+			Inspect(c, f)
+		}
+	case *UnaryExpr:
+		Inspect(n.X, f)
+	case *BinaryExpr:
+		Inspect(n.X, f)
+		Inspect(n.Y, f)
+	case *ParenExpr:
+		Inspect(n.X, f)
+	}
+}
+
+func inspectStmts(list []Stmt, f func(Node) bool) {
+	for _, s := range list {
+		Inspect(s, f)
+	}
+}
@@ -0,0 +1,440 @@
+package CompilationEngine
+
+import (
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/AST"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/SymbolTable"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
+	"strconv"
+)
+
+// checker is the pass that finds the mistakes that parse just fine,
+// but would crash or misbehave at runtime, like assigning a String to
+// an int, or calling a subroutine that doesn't exist.
+//
+// Jack is a loose language, and plenty of working programs treat int,
+// char, and Array as the same thing, since they are all just 16 bit
+// numbers.  Those are only warnings.
+//
+// Types are strings, like in the syntax tree.  The empty string is a
+// type that isn't known, like the elements of an Array, and it is never
+// complained about.
+type checker struct {
+	reporter
+	reg   *Registry
+	class *Class
+	st    SymbolTable.SymbolTable
+	sub   *AST.SubroutineDecl
+
+	// typ is the type of the expression that was just visited.
+	typ string
+}
+
+// check runs the checker on a class.  The registry has everything that
+// the class can call, including itself.
+func check(filename string, c *AST.ClassDecl, reg *Registry) []Diagnostic {
+	k := &checker{
+		reporter: reporter{filename: filename},
+		reg:      reg,
+		st:       SymbolTable.NewSymbolTable(),
+	}
+	c.Accept(k)
+	return k.diags
+}
+
+// How well a value of one type fits where another type is expected.
+const (
+	compatible = iota
+	loose      // works, but is probably a mistake, so it is a warning.
+	incompatible
+)
+
+func isPrimitive(t string) bool {
+	return t == "int" || t == "char" || t == "boolean"
+}
+
+// compatibility of a value with the type src, being used as a dst.
+func compatibility(dst, src string) int {
+	switch {
+	case dst == "" || src == "" || dst == src:
+		return compatible
+	case src == "null":
+		if isPrimitive(dst) {
+			return loose
+		}
+		return compatible
+	case isPrimitive(dst) && isPrimitive(src):
+		return loose
+	case dst == "Array" && isPrimitive(src), src == "Array" && isPrimitive(dst):
+		if dst == "boolean" || src == "boolean" {
+			return incompatible
+		}
+		return loose
+	case dst == "Array" || src == "Array":
+		// Array is how Jack spells "a pointer to anything", so any
+		// object can go in and out of one.
+		return compatible
+	}
+	return incompatible
+}
+
+// fits reports an error or warning if the type src doesn't fit into
+// dst.  The message should say what is being done, like "assign char
+// to int variable x", and is prefixed with "cannot" for errors.
+func (k *checker) fits(span Token.Span, dst, src string, format string, a ...interface{}) {
+	switch compatibility(dst, src) {
+	case loose:
+		k.warnf(span, format, a...)
+	case incompatible:
+		k.errorf(span, "cannot "+format, a...)
+	}
+}
+
+// typeOf visits an expression and returns its type.  A call to a void
+// subroutine doesn't have a value, so it can't be in an expression.
+func (k *checker) typeOf(x AST.Expr) string {
+	k.typ = ""
+	x.Accept(k)
+	if k.typ == "void" {
+		call := x.(*AST.CallExpr)
+		k.errorf(x.Span(), "%s returns void, so it can't be used in an expression", callName(call))
+		return ""
+	}
+	return k.typ
+}
+
+func callName(call *AST.CallExpr) string {
+	if call.Receiver == "" {
+		return call.Name
+	}
+	return call.Receiver + "." + call.Name
+}
+
+func (k *checker) subName() string {
+	return k.class.Name + "." + k.sub.Name
+}
+
+// lookup returns the type of a variable, and reports an error if it
+// isn't defined, or if it is a field being used inside of a function.
+func (k *checker) lookup(name string, span Token.Span) (string, bool) {
+	if !k.st.Has(name) {
+		k.errorf(span, "undefined variable '%s'", name)
+		return "", false
+	}
+	if k.st.KindOf(name) == SymbolTable.FIELD && k.sub.Kind == "function" {
+		k.errorf(span, "field %s can't be used in function %s, because there is no object", name, k.subName())
+	}
+	return k.st.TypeOf(name), true
+}
+
+func (k *checker) VisitClass(c *AST.ClassDecl) {
+	k.class = k.reg.Class(c.Name)
+	if k.class == nil {
+		k.class = classOf(c)
+	}
+	for _, v := range c.Vars {
+		v.Accept(k)
+	}
+	for _, s := range c.Subroutines {
+		k.st.StartSubroutine()
+		s.Accept(k)
+	}
+}
+
+func (k *checker) VisitClassVar(v *AST.ClassVarDecl) {
+	kind := SymbolTable.StringToKind(v.Kind)
+	for _, name := range v.Names {
+		k.st.Define(name.Name, v.Type, kind)
+	}
+}
+
+func (k *checker) VisitSubroutine(s *AST.SubroutineDecl) {
+	k.sub = s
+	for _, p := range s.Params {
+		k.st.Define(p.Name, p.Type, SymbolTable.ARG)
+	}
+	for _, v := range s.Locals {
+		v.Accept(k)
+	}
+	k.statements(s.Body)
+	// without a return, the VM code would run right into whatever
+	// function comes next.  The error goes on the closing '}'.
+	if !returns(s.Body) {
+		end := Token.Span{Line: s.Pos.EndLine, Column: s.Pos.EndColumn}
+		k.errorf(end, "%s can reach the end without a return statement", k.subName())
+	}
+}
+
+// returns is true if the statements can't finish without returning:
+// they end with a return, an if where both branches return, or a
+// "while (true)" loop, which can only be left by returning.
+func returns(list []AST.Stmt) bool {
+	if len(list) == 0 {
+		return false
+	}
+	switch s := list[len(list)-1].(type) {
+	case *AST.ReturnStmt:
+		return true
+	case *AST.IfStmt:
+		return s.HasElse && returns(s.Then) && returns(s.Else)
+	case *AST.WhileStmt:
+		k, ok := s.Cond.(*AST.KeywordLit)
+		return ok && k.Value == "true"
+	}
+	return false
+}
+
+func (k *checker) VisitVar(v *AST.VarDecl) {
+	for _, name := range v.Names {
+		k.st.Define(name.Name, v.Type, SymbolTable.VAR)
+	}
+}
+
+func (k *checker) statements(list []AST.Stmt) {
+	for _, s := range list {
+		s.Accept(k)
+	}
+}
+
+func (k *checker) VisitLet(s *AST.LetStmt) {
+	name := s.Name.Name
+	t, ok := k.lookup(name, s.Name.Span())
+	if s.Index != nil {
+		if ok {
+			k.checkIndexable(name, t, s.Name.Span())
+		}
+		k.checkIndex(s.Index)
+		k.typeOf(s.Value) // the elements of an Array can be anything.
+		return
+	}
+	src := k.typeOf(s.Value)
+	if ok {
+		k.fits(s.Value.Span(), t, src, "assign %s to %s variable %s", src, t, name)
+	}
+}
+
+// checkIndexable makes sure that a variable can be used like an array.
+func (k *checker) checkIndexable(name, t string, span Token.Span) {
+	switch {
+	case t == "Array":
+	case isPrimitive(t):
+		k.warnf(span, "using %s variable %s like an Array", t, name)
+	default:
+		k.errorf(span, "cannot use %s variable %s like an Array", t, name)
+	}
+}
+
+func (k *checker) checkIndex(x AST.Expr) {
+	t := k.typeOf(x)
+	k.fits(x.Span(), "int", t, "use %s as an array index", t)
+}
+
+// conditions should be boolean, but "while (x)" works on any int.
+func (k *checker) checkCondition(x AST.Expr) {
+	t := k.typeOf(x)
+	k.fits(x.Span(), "boolean", t, "use %s as a condition", t)
+}
+
+func (k *checker) VisitIf(s *AST.IfStmt) {
+	k.checkCondition(s.Cond)
+	k.statements(s.Then)
+	k.statements(s.Else)
+}
+
+func (k *checker) VisitWhile(s *AST.WhileStmt) {
+	k.checkCondition(s.Cond)
+	k.statements(s.Body)
+}
+
+// do statements throw away the return value, so it can be void.
+func (k *checker) VisitDo(s *AST.DoStmt) {
+	s.Call.Accept(k)
+}
+
+func (k *checker) VisitReturn(s *AST.ReturnStmt) {
+	want := k.sub.ReturnType
+	switch {
+	case want == "void" && s.Value != nil:
+		k.typeOf(s.Value)
+		k.errorf(s.Value.Span(), "%s returns void, so it can't return a value", k.subName())
+	case want != "void" && s.Value == nil:
+		k.errorf(s.Span(), "%s must return a value of type %s", k.subName(), want)
+	case s.Value != nil:
+		t := k.typeOf(s.Value)
+		k.fits(s.Value.Span(), want, t, "return %s from %s, which returns %s", t, k.subName(), want)
+	}
+}
+
+func (k *checker) VisitInt(n *AST.IntLit) {
+	k.typ = "int"
+}
+
+func (k *checker) VisitString(n *AST.StringLit) {
+	k.typ = "String"
+}
+
+func (k *checker) VisitKeyword(n *AST.KeywordLit) {
+	switch n.Value {
+	case "true", "false":
+		k.typ = "boolean"
+	case "null":
+		k.typ = "null"
+	case "this":
+		k.typ = k.class.Name
+		if k.sub.Kind == "function" {
+			k.errorf(n.Span(), "this can't be used in function %s, because there is no object", k.subName())
+		}
+	}
+}
+
+func (k *checker) VisitVarExpr(n *AST.VarExpr) {
+	k.typ, _ = k.lookup(n.Name, n.Span())
+}
+
+func (k *checker) VisitIndex(n *AST.IndexExpr) {
+	if t, ok := k.lookup(n.Name, n.Span()); ok {
+		k.checkIndexable(n.Name, t, n.Span())
+	}
+	k.checkIndex(n.Index)
+	k.typ = ""
+}
+
+func (k *checker) VisitCall(n *AST.CallExpr) {
+	sig := k.resolve(n)
+	for i, arg := range n.Args {
+		t := k.typeOf(arg)
+		if sig != nil && i < len(sig.Params) {
+			want := sig.Params[i]
+			k.fits(arg.Span(), want, t, "pass %s as argument %d of %s.%s, which is %s", t, i+1, sig.Class, sig.Name, want)
+		}
+	}
+	if sig == nil {
+		k.typ = ""
+		return
+	}
+	if len(n.Args) != len(sig.Params) {
+		k.errorf(n.Span(), "%s.%s takes %s, but is called with %d", sig.Class, sig.Name, plural(len(sig.Params), "argument"), len(n.Args))
+	}
+	k.typ = sig.ReturnType
+}
+
+// resolve finds the subroutine that is being called, and makes sure
+// that it is being called the right way: methods on an object, and
+// functions and constructors on a class.  It returns nil when the
+// subroutine isn't known.
+func (k *checker) resolve(n *AST.CallExpr) *Subroutine {
+	// foo() is a call to a subroutine in this class.
+	if n.Receiver == "" {
+		sig := k.class.Subroutines[n.Name]
+		if sig == nil {
+			k.errorf(n.Span(), "class %s has no subroutine named %s", k.class.Name, n.Name)
+			return nil
+		}
+		if sig.Kind == "method" && k.sub.Kind == "function" {
+			k.errorf(n.Span(), "method %s can't be called from function %s, because there is no object", n.Name, k.subName())
+		}
+		return sig
+	}
+
+	// x.foo() is a method call, if x is a variable.
+	if k.st.Has(n.Receiver) {
+		t, _ := k.lookup(n.Receiver, n.Span())
+		if isPrimitive(t) {
+			k.errorf(n.Span(), "cannot call %s on %s, because %s is not an object", n.Name, n.Receiver, t)
+			return nil
+		}
+		class := k.reg.Class(t)
+		if class == nil {
+			return nil
+		}
+		sig := class.Subroutines[n.Name]
+		if sig == nil {
+			k.errorf(n.Span(), "class %s has no subroutine named %s", t, n.Name)
+			return nil
+		}
+		if sig.Kind != "method" {
+			k.errorf(n.Span(), "%s.%s is a %s, so it is called as %s.%s() and not on the variable %s", t, n.Name, sig.Kind, t, n.Name, n.Receiver)
+		}
+		return sig
+	}
+
+	// Otherwise, Foo.bar() is a call to a function or constructor.
+	class := k.reg.Class(n.Receiver)
+	if class == nil {
+		// When the whole program is being compiled, every class is
+		// known, so this is a typo or a missing file.
+		if k.reg.whole {
+			k.errorf(n.Span(), "%s is not a variable or a class", n.Receiver)
+		}
+		return nil
+	}
+	sig := class.Subroutines[n.Name]
+	if sig == nil {
+		k.errorf(n.Span(), "class %s has no subroutine named %s", n.Receiver, n.Name)
+		return nil
+	}
+	if sig.Kind == "method" {
+		k.errorf(n.Span(), "%s.%s is a method, so it needs an object to be called on", n.Receiver, n.Name)
+	}
+	return sig
+}
+
+func plural(n int, s string) string {
+	if n == 1 {
+		return "1 " + s
+	}
+	return strconv.Itoa(n) + " " + s + "s"
+}
+
+func (k *checker) VisitUnary(n *AST.UnaryExpr) {
+	t := k.typeOf(n.X)
+	k.checkOperand(n.Op, t, n.X.Span())
+	if n.Op == "-" {
+		k.typ = "int"
+		return
+	}
+	k.typ = t
+}
+
+func (k *checker) VisitBinary(n *AST.BinaryExpr) {
+	x := k.typeOf(n.X)
+	y := k.typeOf(n.Y)
+	switch n.Op {
+	case "=":
+		// anything can be compared, like "if (p = null)" or "if (c = 65)".
+		k.typ = "boolean"
+		return
+	case "<", ">":
+		k.typ = "boolean"
+	case "&", "|":
+		k.typ = "int"
+		if x == "boolean" && y == "boolean" {
+			k.typ = "boolean"
+		}
+	default:
+		k.typ = "int"
+	}
+	k.checkOperand(n.Op, x, n.X.Span())
+	k.checkOperand(n.Op, y, n.Y.Span())
+}
+
+// checkOperand checks a value that is used with an operator.  Objects
+// can't be used with any of the operators, except for Array, which is
+// used for pointer arithmetic.  The logical operators are also the
+// bitwise operators, so they work on numbers too.
+func (k *checker) checkOperand(op, t string, span Token.Span) {
+	switch {
+	case t == "" || t == "int" || t == "char":
+	case t == "boolean":
+		if op != "&" && op != "|" && op != "~" {
+			k.warnf(span, "using boolean with operator %s", op)
+		}
+	case t == "Array":
+		k.warnf(span, "using Array with operator %s", op)
+	default:
+		k.errorf(span, "cannot use %s with operator %s", t, op)
+	}
+}
+
+func (k *checker) VisitParen(n *AST.ParenExpr) {
+	k.typ = k.typeOf(n.X)
+}
@@ -0,0 +1,134 @@
+package CompilationEngine
+
+import (
+	"strings"
+	"testing"
+)
+
+const test_check_program = `class Main {
+  field int count;
+  static String name;
+
+  function void main() {
+    var int i;
+    var char c;
+    var Array a;
+    var Main m;
+    let i = "hello";
+    let c = i;
+    let a = i;
+    let a[i] = name;
+    let i = Output.printInt(1);
+    let count = 1;
+    do m.missing();
+    do Math.max(1);
+    do Main.run();
+    do run();
+    do Output.printString(i);
+    return;
+  }
+
+  method int run() {
+    if (count) {
+      return;
+    }
+    let count = -name;
+    return count;
+  }
+
+  function String label() {
+    return this;
+  }
+}
+`
+
+func TestCheck(t *testing.T) {
+	want := []string{
+		"Main.jack:10:13: cannot assign String to int variable i",
+		"Main.jack:11:13: warning: assign int to char variable c",
+		"Main.jack:12:13: warning: assign int to Array variable a",
+		"Main.jack:14:13: Output.printInt returns void, so it can't be used in an expression",
+		"Main.jack:15:9: field count can't be used in function Main.main, because there is no object",
+		"Main.jack:16:8: class Main has no subroutine named missing",
+		"Main.jack:17:8: Math.max takes 2 arguments, but is called with 1",
+		"Main.jack:18:8: Main.run is a method, so it needs an object to be called on",
+		"Main.jack:19:8: method run can't be called from function Main.main, because there is no object",
+		"Main.jack:20:27: cannot pass int as argument 1 of Output.printString, which is String",
+		"Main.jack:25:9: warning: use int as a condition",
+		"Main.jack:26:7: Main.run must return a value of type int",
+		"Main.jack:28:18: cannot use String with operator -",
+		"Main.jack:33:12: this can't be used in function Main.label, because there is no object",
+		"Main.jack:33:12: cannot return Main from Main.label, which returns String",
+	}
+	_, diags := Compile("Main.jack", strings.NewReader(test_check_program))
+	if len(diags) != len(want) {
+		t.Errorf("got %d diagnostics, expected %d", len(diags), len(want))
+	}
+	for i := 0; i < len(diags) && i < len(want); i++ {
+		if diags[i].String() != want[i] {
+			t.Errorf("got:(%s), expected:(%s)", diags[i], want[i])
+		}
+	}
+}
+
+// Warnings don't stop the program from being compiled.
+func TestCheckWarningsStillCompile(t *testing.T) {
+	src := `class Main {
+  function void main() {
+    var char c;
+    let c = 65;
+    do Output.printChar(c);
+    return;
+  }
+}`
+	code, diags := Compile("Main.jack", strings.NewReader(src))
+	if len(diags) != 1 || diags[0].Severity != WARNING {
+		t.Errorf("expected 1 warning, got: %v", diags)
+	}
+	if code == nil {
+		t.Error("warnings shouldn't stop the compiler")
+	}
+}
+
+// A subroutine that can get to its end without a return would run into
+// the next function in the VM code.
+func TestCheckMissingReturn(t *testing.T) {
+	src := `class Main {
+  function void main() {
+    do Output.println();
+  }
+  function int sign(int x) {
+    if (x < 0) {
+      return -1;
+    } else {
+      return 1;
+    }
+  }
+  function int half(int x) {
+    if (x > 0) {
+      return x / 2;
+    }
+  }
+  function void loop() {
+    while (true) {
+      do Output.println();
+    }
+  }
+}`
+	want := []string{
+		"Main.jack:4:3: Main.main can reach the end without a return statement",
+		"Main.jack:16:3: Main.half can reach the end without a return statement",
+	}
+	code, diags := Compile("Main.jack", strings.NewReader(src))
+	if code != nil {
+		t.Error("there should be no VM code when there are errors")
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("got %d errors, expected %d: %v", len(diags), len(want), diags)
+	}
+	for i := range want {
+		if diags[i].String() != want[i] {
+			t.Errorf("got:(%s), expected:(%s)", diags[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package CompilationEngine
+
+import (
+	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/AST"
+	"strings"
+	"sync"
+)
+
+// Subroutine is the signature of a subroutine, which is everything
+// that's needed to check a call to it.
+type Subroutine struct {
+	Class      string
+	Name       string
+	Kind       string // "constructor", "function", or "method"
+	ReturnType string
+	Params     []string // the types of the parameters.
+}
+
+// Class is what the other classes can see of a class.
+type Class struct {
+	Name        string
+	Subroutines map[string]*Subroutine
+}
+
+// classOf collects the signatures of the subroutines in the class.
+func classOf(c *AST.ClassDecl) *Class {
+	class := &Class{
+		Name:        c.Name,
+		Subroutines: make(map[string]*Subroutine),
+	}
+	for _, s := range c.Subroutines {
+		sig := &Subroutine{
+			Class:      c.Name,
+			Name:       s.Name,
+			Kind:       s.Kind,
+			ReturnType: s.ReturnType,
+		}
+		for _, p := range s.Params {
+			sig.Params = append(sig.Params, p.Type)
+		}
+		class.Subroutines[s.Name] = sig
+	}
+	return class
+}
+
+// The classes of the Jack OS, from the API in the nand2tetris book.
+// They are written in Jack, with empty bodies, so that the parser can
+// turn them into signatures.
+var os_api = []string{`
+class Math {
+	function void init() {}
+	function int abs(int x) {}
+	function int multiply(int x, int y) {}
+	function int divide(int x, int y) {}
+	function int min(int x, int y) {}
+	function int max(int x, int y) {}
+	function int sqrt(int x) {}
+}`, `
+class String {
+	constructor String new(int maxLength) {}
+	method void dispose() {}
+	method int length() {}
+	method char charAt(int j) {}
+	method void setCharAt(int j, char c) {}
+	method String appendChar(char c) {}
+	method void eraseLastChar() {}
+	method int intValue() {}
+	method void setInt(int j) {}
+	function char backSpace() {}
+	function char doubleQuote() {}
+	function char newLine() {}
+}`, `
+class Array {
+	function Array new(int size) {}
+	method void dispose() {}
+}`, `
+class Output {
+	function void init() {}
+	function void moveCursor(int i, int j) {}
+	function void printChar(char c) {}
+	function void printString(String s) {}
+	function void printInt(int i) {}
+	function void println() {}
+	function void backSpace() {}
+}`, `
+class Screen {
+	function void init() {}
+	function void clearScreen() {}
+	function void setColor(boolean b) {}
+	function void drawPixel(int x, int y) {}
+	function void drawLine(int x1, int y1, int x2, int y2) {}
+	function void drawRectangle(int x1, int y1, int x2, int y2) {}
+	function void drawCircle(int x, int y, int r) {}
+}`, `
+class Keyboard {
+	function void init() {}
+	function char keyPressed() {}
+	function char readChar() {}
+	function String readLine(String message) {}
+	function int readInt(String message) {}
+}`, `
+class Memory {
+	function void init() {}
+	function int peek(int address) {}
+	function void poke(int address, int value) {}
+	function Array alloc(int size) {}
+	function void deAlloc(Array o) {}
+}`, `
+class Sys {
+	function void init() {}
+	function void halt() {}
+	function void error(int errorCode) {}
+	function void wait(int duration) {}
+}`}
+
+var (
+	os_classes      map[string]*Class
+	os_classes_once sync.Once
+)
+
+// osClasses returns the classes of the Jack OS.  A new map is made
+// each time, so that the caller can add their own classes to it.  The
+// classes themselves are shared, and shouldn't be changed.
+func osClasses() map[string]*Class {
+	os_classes_once.Do(func() {
+		os_classes = make(map[string]*Class)
+		for _, src := range os_api {
+			c, diags := Parse("os", strings.NewReader(src))
+			if HasErrors(diags) {
+				panic(diags)
+			}
+			os_classes[c.Name] = classOf(c)
+		}
+	})
+	classes := make(map[string]*Class)
+	for name, c := range os_classes {
+		classes[name] = c
+	}
+	return classes
+}
+
+// Registry is every class that a program can call: the Jack OS, and
+// the classes of the program itself.  It is filled in by a first pass
+// over all of the .jack files, before anything is checked or compiled,
+// so that each class knows how to call the subroutines of the others.
+type Registry struct {
+	classes map[string]*Class
+
+	// whole is true when every class of the program has been added.
+	// Then a class that isn't in the registry doesn't exist, instead
+	// of just being in some other file.
+	whole bool
+}
+
+// NewRegistry returns a registry with only the Jack OS classes in it.
+func NewRegistry() *Registry {
+	return &Registry{classes: osClasses()}
+}
+
+// Add records the signatures of a class.  It is an error for two
+// classes in the program to have the same name.  A class with the same
+// name as one of the OS classes replaces it, since that is how the OS
+// itself is written in Jack.
+func (r *Registry) Add(c *AST.ClassDecl) error {
+	if old, ok := r.classes[c.Name]; ok && old != os_classes[c.Name] {
+		return fmt.Errorf("class %s is already defined", c.Name)
+	}
+	r.classes[c.Name] = classOf(c)
+	return nil
+}
+
+// Class returns the class with the given name, or nil if it isn't known.
+func (r *Registry) Class(name string) *Class {
+	return r.classes[name]
+}
+
+// Lookup returns the signature of class.name, or nil if it isn't known.
+func (r *Registry) Lookup(class, name string) *Subroutine {
+	c := r.classes[class]
+	if c == nil {
+		return nil
+	}
+	return c.Subroutines[name]
+}
@@ -0,0 +1,517 @@
+package CompilationEngine
+
+import (
+	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/AST"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/SymbolTable"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/vmWriter"
+	"io"
+)
+
+var kindToSeg = map[SymbolTable.Kind]vmWriter.Segment{
+	SymbolTable.ARG:    vmWriter.ARG,
+	SymbolTable.STATIC: vmWriter.STATIC,
+	SymbolTable.VAR:    vmWriter.LOCAL,
+	SymbolTable.FIELD:  vmWriter.THIS,
+}
+
+// codeGenerator is the pass that writes VM code for a class.  It also
+// fills in the symbol tables as it goes, since it needs them to find
+// the variables.  The registry is used to find out whether a call is
+// to a method, which needs an object passed along with it.
+type codeGenerator struct {
+	reporter
+	reg                 *Registry
+	st                  SymbolTable.SymbolTable
+	vm                  vmWriter.VMWriter
+	className           string
+	subroutineName      string
+	symbol_table_output string
+	label_counter       int
+	inside_method       bool
+	opt                 Options
+
+	// string_pool maps each string constant to the static variable that it
+	// is kept in, when PoolStrings is on.
+	string_pool map[string]int
+}
+
+func newCodeGenerator(w io.Writer, filename string, reg *Registry, opt Options) *codeGenerator {
+	return &codeGenerator{
+		reporter:    reporter{filename: filename},
+		reg:         reg,
+		opt:         opt,
+		string_pool: make(map[string]int),
+		st:          SymbolTable.NewSymbolTable(),
+		vm:          vmWriter.NewVMWriter(w, opt.NativeMath),
+	}
+}
+
+func (g *codeGenerator) VisitClass(c *AST.ClassDecl) {
+	g.className = c.Name
+	if len(c.Vars) > 0 {
+		for _, v := range c.Vars {
+			v.Accept(g)
+		}
+		g.symbol_table_output += fmt.Sprintln("Class Table:", g.className)
+		g.symbol_table_output += g.st.PrintClassTable()
+	}
+	for _, s := range c.Subroutines {
+		g.st.StartSubroutine()
+		s.Accept(g)
+		g.symbol_table_output += ("Subroutine Table:" + g.className + "." + g.subroutineName + "\n")
+		g.symbol_table_output += g.st.PrintSubroutineTable()
+	}
+}
+
+func (g *codeGenerator) VisitClassVar(v *AST.ClassVarDecl) {
+	kind := SymbolTable.StringToKind(v.Kind)
+	for _, name := range v.Names {
+		g.st.Define(name.Name, v.Type, kind)
+	}
+}
+
+func (g *codeGenerator) VisitSubroutine(s *AST.SubroutineDecl) {
+	g.subroutineName = s.Name
+	switch s.Kind {
+	case "constructor":
+		g.inside_method = true
+	case "method":
+		// the object takes up argument 0, so the real arguments
+		// start at 1.
+		g.st.Define("this", g.className, SymbolTable.ARG)
+		g.inside_method = true
+	}
+	defer func() {
+		g.inside_method = false // no longer inside a method/constructor
+	}()
+	for _, p := range s.Params {
+		g.st.Define(p.Name, p.Type, SymbolTable.ARG)
+	}
+	for _, v := range s.Locals {
+		v.Accept(g)
+	}
+	// must call WriteFunction() after the local variables have been
+	// defined, because the VM command needs to know how many local
+	// variables there are in the function.
+	fullname := g.className + "." + g.subroutineName
+	g.vm.WriteFunction(fullname, g.st.VarCount(SymbolTable.VAR))
+
+	// methods are given the object as argument 0, and the THIS
+	// segment has to point at it before any of the fields are used.
+	//
+	// constructors are special because they need to allocate memory.
+	// determine the sizeOf() by counting the number of fields,
+	// 1. push the size to the stack,
+	// 2. call Memory.alloc(size), which leave a pointer on the stack,
+	// 3. pop stack, changing THIS pointer to the new pointer.
+	switch s.Kind {
+	case "method":
+		g.vm.WritePush(vmWriter.ARG, 0)
+		g.vm.WritePop(vmWriter.POINTER, 0)
+	case "constructor":
+		size := g.st.VarCount(SymbolTable.FIELD)
+		g.vm.WritePush(vmWriter.CONST, size)
+		g.vm.WriteCall("Memory.alloc", 1)
+		g.vm.WritePop(vmWriter.POINTER, 0)
+	}
+	// continue on to compile the proccesses within the function.
+	g.statements(s.Body)
+}
+
+// Variable Declarations are added to the Symbol Table, at the scope of
+// Subroutine.
+func (g *codeGenerator) VisitVar(v *AST.VarDecl) {
+	for _, name := range v.Names {
+		g.st.Define(name.Name, v.Type, SymbolTable.VAR)
+	}
+}
+
+func (g *codeGenerator) statements(list []AST.Stmt) {
+	for _, s := range list {
+		s.Accept(g)
+	}
+}
+
+/*
+When assigning a new value to a position in an array, it is treated
+differently than when compiled as a term. We still need the address
+of the value, but instead of pushing that value, we are going to
+save that adresss until after we compile the NEW value.
+
+1. Push &arr[index] to the stack.
+2. Pop value into TEMP 1 (reserved for this purpose)
+3. Compile the expression, which leaves a value on the stack.
+4. Push TEMP1, which still contains &arr[index]
+5. Pop to POINTER 1, allowing us to follow the pointer
+6. Pop THIS 0, placing the expression into *arr[index]
+*/
+func (g *codeGenerator) VisitLet(s *AST.LetStmt) {
+	known := g.checkDefined(s.Name.Name, s.Name.Span())
+	if s.Index != nil {
+		g.pushArrayPointer(s.Name.Name, s.Index, known) // 1.
+		g.vm.WritePop(vmWriter.TEMP, 1)                 // 2.
+		s.Value.Accept(g)                               // 3.
+		g.vm.WritePush(vmWriter.TEMP, 1)                // 4.
+		g.vm.WritePop(vmWriter.POINTER, 1)              // 5.
+		g.vm.WritePop(vmWriter.THAT, 0)                 // 6.
+		return
+	}
+	s.Value.Accept(g)
+	if known {
+		g.vm.WritePop(kindToSeg[g.st.KindOf(s.Name.Name)], g.st.IndexOf(s.Name.Name))
+	}
+}
+
+func (g *codeGenerator) VisitIf(s *AST.IfStmt) {
+	prefix := "L_"
+	label1 := fmt.Sprint(prefix, "IF", g.label_counter)
+	label2 := fmt.Sprint(prefix, "ENDIF", g.label_counter)
+	g.label_counter++
+	s.Cond.Accept(g)
+	g.vm.WriteArithmetic(vmWriter.NOT)
+	g.vm.WriteIf(label1)
+	g.statements(s.Then)
+	g.vm.WriteGoto(label2)
+	g.vm.WriteLabel(label1)
+	g.statements(s.Else)
+	g.vm.WriteLabel(label2)
+}
+
+func (g *codeGenerator) VisitWhile(s *AST.WhileStmt) {
+	prefix := "L_"
+	label1 := fmt.Sprint(prefix, "WHILE", g.label_counter)
+	label2 := fmt.Sprint(prefix, "ENDWHILE", g.label_counter)
+	g.label_counter++
+	g.vm.WriteLabel(label1)
+	// "while (true)" loops forever, so there's nothing to test.
+	if v, ok := constant(s.Cond); !ok || !isTrue(v) || !g.opt.Optimize {
+		s.Cond.Accept(g)
+		g.vm.WriteArithmetic(vmWriter.NOT)
+		g.vm.WriteIf(label2)
+	}
+	g.statements(s.Body)
+	g.vm.WriteGoto(label1)
+	g.vm.WriteLabel(label2)
+}
+
+// do statements throw away whatever the subroutine returns.  Memory.poke
+// doesn't return anything when it is written inline, so there's
+// nothing to throw away.
+func (g *codeGenerator) VisitDo(s *AST.DoStmt) {
+	if g.isIntrinsic(s.Call, "poke", 2) {
+		g.poke(s.Call)
+		return
+	}
+	s.Call.Accept(g)
+	g.vm.WritePop(vmWriter.TEMP, 0)
+}
+
+// every subroutine returns a value, even the void ones.  They return
+// 0, which the caller throws away.
+func (g *codeGenerator) VisitReturn(s *AST.ReturnStmt) {
+	if s.Value != nil {
+		s.Value.Accept(g)
+	} else {
+		g.vm.WritePush(vmWriter.CONST, 0)
+	}
+	g.vm.WriteReturn()
+}
+
+// integers in the source code are never negative, but the optimizer
+// can make them negative when it folds constants.  The VM can only
+// push positive constants, so those are negated after being pushed.
+func (g *codeGenerator) VisitInt(n *AST.IntLit) {
+	switch {
+	case n.Value >= 0:
+		g.vm.WritePush(vmWriter.CONST, n.Value)
+	case n.Value == -32768:
+		g.vm.WritePush(vmWriter.CONST, 32767)
+		g.vm.WriteArithmetic(vmWriter.NOT)
+	default:
+		g.vm.WritePush(vmWriter.CONST, -n.Value)
+		g.vm.WriteArithmetic(vmWriter.NEG)
+	}
+}
+
+// With the PoolStrings option, each string constant is made into a
+// String object only once, the first time it is used, and is kept in a
+// static variable of the class after that.  Otherwise, a new String is
+// made every time that the constant is evaluated, which is what the
+// book's compiler does, and those Strings are never disposed of.
+//
+// It is off by default, because the String is shared: calling dispose
+// or setCharAt on one will change every use of the same constant in
+// that class.  Each distinct constant also uses up one of the 240
+// static variables that the whole program can have.
+func (g *codeGenerator) VisitString(n *AST.StringLit) {
+	if !g.opt.PoolStrings {
+		g.newString(n.Value)
+		return
+	}
+	// the static variables of the pool go after the ones that were
+	// declared in the class.
+	slot, ok := g.string_pool[n.Value]
+	if !ok {
+		slot = g.st.VarCount(SymbolTable.STATIC) + len(g.string_pool)
+		g.string_pool[n.Value] = slot
+	}
+	// static variables start at 0, so it is only built if the static
+	// variable doesn't have a pointer in it yet.
+	label := fmt.Sprint("L_STRING", g.label_counter)
+	g.label_counter++
+	g.vm.WritePush(vmWriter.STATIC, slot)
+	g.vm.WriteIf(label)
+	g.newString(n.Value)
+	g.vm.WritePop(vmWriter.STATIC, slot)
+	g.vm.WriteLabel(label)
+	g.vm.WritePush(vmWriter.STATIC, slot)
+}
+
+// create a new string, and append characters to it.
+// Leave a pointer to the string on top of the stack.
+// An example (
+//
+//	https://play.golang.org/p/MxQsrUSU6dD
+//
+// where a pointer to the array containing "hello world"
+// is pushed to the stack.
+func (g *codeGenerator) newString(str string) {
+	g.vm.WritePush(vmWriter.CONST, len(str))
+	g.vm.WriteCall("String.new", 1)
+	for _, c := range str {
+		g.vm.WritePush(vmWriter.CONST, int(c))
+		g.vm.WriteCall("String.appendChar", 2)
+	}
+}
+
+func (g *codeGenerator) VisitKeyword(n *AST.KeywordLit) {
+	switch n.Value {
+	case "true":
+		g.vm.WritePush(vmWriter.CONST, 1)
+		g.vm.WriteArithmetic(vmWriter.NEG)
+	case "null", "false":
+		g.vm.WritePush(vmWriter.CONST, 0)
+	case "this":
+		g.vm.WritePush(vmWriter.POINTER, 0)
+	}
+}
+
+func (g *codeGenerator) VisitVarExpr(n *AST.VarExpr) {
+	if g.checkDefined(n.Name, n.Span()) {
+		segment := kindToSeg[g.st.KindOf(n.Name)]
+		index := g.st.IndexOf(n.Name)
+		g.vm.WritePush(segment, index)
+	}
+}
+
+// To access the value in arr[index], we want to get a pointer to the
+// location of the value, and place it onto the stack.
+//
+// Now that &arr[index] is on the stack, we want to follow the pointer.
+// Save the pointer in 'POINTER 1', which corresponds to THAT', and
+// access it using 'THAT 0'.  We can use 0 because we already have the
+// exact address of the value we want.
+func (g *codeGenerator) VisitIndex(n *AST.IndexExpr) {
+	g.pushArrayPointer(n.Name, n.Index, g.checkDefined(n.Name, n.Span()))
+	g.vm.WritePop(vmWriter.POINTER, 1)
+	g.vm.WritePush(vmWriter.THAT, 0)
+}
+
+func (g *codeGenerator) VisitCall(n *AST.CallExpr) {
+	if g.isIntrinsic(n, "peek", 1) {
+		g.peek(n)
+		return
+	}
+	nArgs := 0
+	sName := n.Name
+	if n.Receiver == "" {
+		// a call with no explicit receiver, to a method of this class,
+		// implies that the current object is the receiver.  The
+		// pointer to current object is accesible via POINTER 0.
+		// Functions and constructors don't get an object.
+		if g.isMethod(g.className, n.Name) {
+			g.vm.WritePush(vmWriter.POINTER, 0)
+			nArgs++
+		}
+		// assume that the prefix is the current class name.
+		sName = g.className + "." + sName
+	} else {
+		// If the name before a "." is a known variable, and is in our
+		// symbol table, then it is being used as a reciever for a
+		// method call.  If this is the case, push it to the stack,
+		// because it will become argument 0 for the calling function.
+		// The name of the class is the TYPE of the variable.
+		//
+		// If we couldn't find the variable in the symbol table, then
+		// assume it was a className, and there is no receiver.
+		recName := n.Receiver
+		if g.st.Has(recName) {
+			segment := kindToSeg[g.st.KindOf(recName)]
+			index := g.st.IndexOf(recName)
+			g.vm.WritePush(segment, index)
+			recName = g.st.TypeOf(recName)
+			nArgs++
+		}
+		sName = recName + "." + sName
+	}
+	for _, arg := range n.Args {
+		arg.Accept(g)
+		nArgs++
+	}
+	g.vm.WriteCall(sName, nArgs)
+}
+
+func (g *codeGenerator) VisitUnary(n *AST.UnaryExpr) {
+	n.X.Accept(g)
+	switch n.Op {
+	case "-":
+		g.vm.WriteArithmetic(vmWriter.NEG)
+	case "~":
+		g.vm.WriteArithmetic(vmWriter.NOT)
+	}
+}
+
+func (g *codeGenerator) VisitBinary(n *AST.BinaryExpr) {
+	if n.Op == "+" && n.X == n.Y {
+		g.double(n.X)
+		return
+	}
+	switch n.Op {
+	case "<<":
+		n.X.Accept(g)
+		n.Y.Accept(g)
+		g.vm.WriteArithmetic(vmWriter.SHL)
+		return
+	case ">>":
+		g.divideByShifting(n.X, n.Y.(*AST.IntLit).Value)
+		return
+	}
+	n.X.Accept(g)
+	n.Y.Accept(g)
+	g.vm.WriteArithmetic(vmWriter.OpToCmd(n.Op))
+}
+
+func (g *codeGenerator) VisitParen(n *AST.ParenExpr) {
+	n.X.Accept(g)
+}
+
+// -----------------------------------------------------
+
+// MACRO for writing vm code.  Pushes a pointer to an indexed position
+// in an array.  Also compiles an expression within, so this function/Macro
+// is likely to be used recurisvely.
+func (g *codeGenerator) pushArrayPointer(varName string, index AST.Expr, known bool) {
+	// First, push the variable to the stack.
+	// This variable should contain a pointer to the
+	// beginning of the array we want to access.
+	if known {
+		segment := kindToSeg[g.st.KindOf(varName)]
+		symbolIndex := g.st.IndexOf(varName)
+		g.vm.WritePush(segment, symbolIndex)
+	}
+	// The expression in the brackets contains the [index] of the
+	// desired position, where 0 is the beginning of the array.
+	// This will write the neccessary vm code to compute this value and
+	// leave it on top of the stack.
+	index.Accept(g)
+	// At this point, there are 2 values sitting on top of the stack:
+	// (top - 1): the address of the beginning of the array.
+	// (top - 0): the index of the array.
+	// We can add the index to the address, giving us the address of
+	// the exact location in the array we want to access.
+	g.vm.WriteArithmetic(vmWriter.ADD)
+}
+
+// double adds a value to itself.  The optimizer does this instead of
+// multiplying by 2, with the same node on both sides of a "+".
+func (g *codeGenerator) double(x AST.Expr) {
+	g.pushTwice(x)
+	g.vm.WriteArithmetic(vmWriter.ADD)
+}
+
+// pushTwice pushes the value of x twice.  Simple values are pushed
+// twice, and anything else is only computed once, and then copied with
+// TEMP 2, which isn't used for anything else.
+func (g *codeGenerator) pushTwice(x AST.Expr) {
+	x.Accept(g)
+	switch x.(type) {
+	case *AST.VarExpr, *AST.IntLit, *AST.KeywordLit:
+		x.Accept(g)
+	default:
+		g.vm.WritePop(vmWriter.TEMP, 2)
+		g.vm.WritePush(vmWriter.TEMP, 2)
+		g.vm.WritePush(vmWriter.TEMP, 2)
+	}
+}
+
+// divideByShifting divides x by 2^k, for the ">>" expressions that the
+// optimizer makes with the NativeMath option.  "shr" rounds down, but
+// "/" rounds towards zero, so 2^k - 1 is added to negative numbers
+// before shifting them.  x >> 15 is -1 for negative numbers and 0 for
+// the others, which picks out the bits to add without jumping.
+func (g *codeGenerator) divideByShifting(x AST.Expr, k int) {
+	g.pushTwice(x)
+	g.vm.WritePush(vmWriter.CONST, 15)
+	g.vm.WriteArithmetic(vmWriter.SHR)
+	g.vm.WritePush(vmWriter.CONST, 1<<uint(k)-1)
+	g.vm.WriteArithmetic(vmWriter.AND)
+	g.vm.WriteArithmetic(vmWriter.ADD)
+	g.vm.WritePush(vmWriter.CONST, k)
+	g.vm.WriteArithmetic(vmWriter.SHR)
+}
+
+// isIntrinsic returns true if the call is Memory.name, with the right
+// number of arguments, and should be written inline.  A variable called
+// Memory would make it a method call instead.
+//
+// Memory.peek and Memory.poke are the same as reading and writing an
+// array that starts at address 0, so they only take a few VM commands,
+// compared to the whole call and return.  The NoIntrinsics option
+// turns this off, to get the same VM code as the book's compiler.
+func (g *codeGenerator) isIntrinsic(n *AST.CallExpr, name string, nArgs int) bool {
+	return !g.opt.NoIntrinsics && n.Receiver == "Memory" && !g.st.Has("Memory") &&
+		n.Name == name && len(n.Args) == nArgs
+}
+
+// Memory.peek(address) leaves the value at the address on the stack,
+// the same way that VisitIndex does.
+func (g *codeGenerator) peek(n *AST.CallExpr) {
+	n.Args[0].Accept(g)
+	g.vm.WritePop(vmWriter.POINTER, 1)
+	g.vm.WritePush(vmWriter.THAT, 0)
+}
+
+// Memory.poke(address, value) sets the value at the address.  Both of
+// the arguments are computed before THAT is changed, since the value
+// might use THAT too.  TEMP 0 holds onto the value while the address
+// is popped into POINTER 1.
+func (g *codeGenerator) poke(n *AST.CallExpr) {
+	n.Args[0].Accept(g)
+	n.Args[1].Accept(g)
+	g.vm.WritePop(vmWriter.TEMP, 0)
+	g.vm.WritePop(vmWriter.POINTER, 1)
+	g.vm.WritePush(vmWriter.TEMP, 0)
+	g.vm.WritePop(vmWriter.THAT, 0)
+}
+
+// isMethod returns true if class.name is a method.  If the subroutine
+// isn't in the registry, then it is guessed from where it is called:
+// inside of a constructor or method, it is assumed to be a method too.
+func (g *codeGenerator) isMethod(class, name string) bool {
+	if sig := g.reg.Lookup(class, name); sig != nil {
+		return sig.Kind == "method"
+	}
+	return g.inside_method
+}
+
+// checkDefined reports an error if the variable isn't in the symbol
+// table, instead of letting the symbol table panic.
+func (g *codeGenerator) checkDefined(name string, span Token.Span) bool {
+	if g.st.Has(name) {
+		return true
+	}
+	g.errorf(span, "undefined variable '%s'", name)
+	return false
+}
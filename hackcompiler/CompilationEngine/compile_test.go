@@ -0,0 +1,347 @@
+package CompilationEngine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func loadTestFiles(t *testing.T) map[string]string {
+	names, err := filepath.Glob("../tests/*/*.jack")
+	if err != nil || len(names) == 0 {
+		t.Fatal("can't find the test files", err)
+	}
+	files := make(map[string]string)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = string(b)
+	}
+	return files
+}
+
+// Compiling the same files many times at once, with different options,
+// should give the same VM code as compiling them one at a time.
+func TestCompileConcurrently(t *testing.T) {
+	files := loadTestFiles(t)
+	for name := range files {
+		// ExpressionLessSquare is only for testing the parser.  All of
+		// the expressions were replaced by names, so it doesn't type check.
+		if strings.Contains(name, "ExpressionLessSquare") {
+			delete(files, name)
+		}
+	}
+	options := []Options{{}, {Optimize: true, PoolStrings: true, NativeMath: true}}
+	want := make(map[string][][]byte)
+	for name, src := range files {
+		for _, opt := range options {
+			code, diags := CompileWithOptions(name, strings.NewReader(src), opt)
+			if HasErrors(diags) {
+				t.Fatalf("%s: %v", name, diags)
+			}
+			want[name] = append(want[name], code)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		for name, src := range files {
+			wg.Add(1)
+			go func(name, src string, o int) {
+				defer wg.Done()
+				code, _ := CompileWithOptions(name, strings.NewReader(src), options[o])
+				if !bytes.Equal(code, want[name][o]) {
+					t.Errorf("%s: the VM code changed when compiling at the same time", name)
+				}
+			}(name, src, i%len(options))
+		}
+	}
+	wg.Wait()
+}
+
+func TestCompileUnexpectedEnd(t *testing.T) {
+	code, diags := Compile("Main.jack", strings.NewReader("class Main { function void main() { return"))
+	if code != nil || !HasErrors(diags) {
+		t.Fatalf("expected an error, got: %v", diags)
+	}
+	if got := diags[0].String(); !strings.HasPrefix(got, "Main.jack:1:") {
+		t.Errorf("the error should name the file: %s", got)
+	}
+}
+
+// The parser should keep going after a syntax error, so that one run
+// reports all of them.
+func TestCompileSyntaxErrors(t *testing.T) {
+	src := `class Main {
+    function void main() {
+      var int a;
+      let a = 1
+      let a = a + ;
+      do Output.printInt(a;
+      let b = 3;
+      return;
+    }
+    method int foo( {
+      return 1;
+    }
+  }`
+	want := []string{
+		"Main.jack:5:7: expected ';' after expression, found 'let'",
+		"Main.jack:5:19: expected expression, found ';'",
+		"Main.jack:6:27: expected ')' after the arguments, found ';'",
+		"Main.jack:7:11: undefined variable 'b'",
+		"Main.jack:10:21: expected a type in parameter list, found '{'",
+	}
+	code, diags := Compile("Main.jack", strings.NewReader(src))
+	if code != nil {
+		t.Error("there should be no VM code when there are errors")
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("got %d errors, expected %d: %v", len(diags), len(want), diags)
+	}
+	for i := range want {
+		if diags[i].String() != want[i] {
+			t.Errorf("got:(%s), expected:(%s)", diags[i], want[i])
+		}
+	}
+}
+
+// Calls between the classes of a program are resolved with the
+// signatures from every file, so functions don't get an object pushed
+// for them, and calls with the wrong number of arguments are caught.
+func TestCompileProgram(t *testing.T) {
+	game := `class Game {
+  field int score;
+  constructor Game new() {
+    let score = start();
+    return this;
+  }
+  function int start() {
+    return 0;
+  }
+  method void run() {
+    do bump(score);
+    return;
+  }
+  method void bump(int n) {
+    let score = n + 1;
+    return;
+  }
+}`
+	main := `class Main {
+  function void main() {
+    var Game g;
+    let g = Game.new();
+    do g.run();
+    return;
+  }
+}`
+	code, diags := CompileProgram([]Source{
+		{"Game.jack", strings.NewReader(game)},
+		{"Main.jack", strings.NewReader(main)},
+	})
+	if len(diags) != 0 {
+		t.Fatal(diags)
+	}
+	vm := string(code[0])
+	if strings.Contains(vm, "push pointer 0\ncall Game.start") {
+		t.Error("a call to a function shouldn't pass the object:\n" + vm)
+	}
+	if !strings.Contains(vm, "push pointer 0\npush this 0\ncall Game.bump 2") {
+		t.Error("a call to a method should pass the object:\n" + vm)
+	}
+
+	bad := `class Main {
+  function void main() {
+    do Game.start(1);
+    do Gmae.start();
+    return;
+  }
+}`
+	want := []string{
+		"Main.jack:3:8: Game.start takes 0 arguments, but is called with 1",
+		"Main.jack:4:8: Gmae is not a variable or a class",
+		"Main.jack:1:1: class Game is already defined",
+	}
+	code, diags = CompileProgram([]Source{
+		{"Game.jack", strings.NewReader(game)},
+		{"Main.jack", strings.NewReader(bad)},
+		{"Main.jack", strings.NewReader("class Game {}")},
+	})
+	if code[0] == nil || code[1] != nil {
+		t.Error("only the files with errors should be missing their VM code")
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("got %d errors, expected %d: %v", len(diags), len(want), diags)
+	}
+	for i := range want {
+		if diags[i].String() != want[i] {
+			t.Errorf("got:(%s), expected:(%s)", diags[i], want[i])
+		}
+	}
+}
+
+// Constructors allocate the object whatever they are called, and every
+// subroutine ends with exactly one return.
+func TestCompileSubroutineKinds(t *testing.T) {
+	src := `class Point {
+  field int x, y;
+  constructor Point create(int ax) {
+    let x = ax;
+    return this;
+  }
+  method void clear() {
+    let x = 0;
+    return;
+  }
+}`
+	want := `function Point.create 0
+push constant 2
+call Memory.alloc 1
+pop pointer 0
+push argument 0
+pop this 0
+push pointer 0
+return
+function Point.clear 0
+push argument 0
+pop pointer 0
+push constant 0
+pop this 0
+push constant 0
+return
+`
+	code, diags := Compile("Point.jack", strings.NewReader(src))
+	if len(diags) != 0 {
+		t.Fatal(diags)
+	}
+	if string(code) != want {
+		t.Errorf("got:\n%s\nexpected:\n%s", code, want)
+	}
+}
+
+// With PoolStrings, each distinct string constant is built once into
+// its own static variable, after the ones that the class declared.
+func TestPoolStrings(t *testing.T) {
+	src := `class Main {
+  static int count;
+  function void main() {
+    do Output.printString("hi");
+    do Output.printString("");
+    do Output.printString("hi");
+    return;
+  }
+}`
+	want := `function Main.main 0
+push static 1
+if-goto L_STRING0
+push constant 2
+call String.new 1
+push constant 104
+call String.appendChar 2
+push constant 105
+call String.appendChar 2
+pop static 1
+label L_STRING0
+push static 1
+call Output.printString 1
+pop temp 0
+push static 2
+if-goto L_STRING1
+push constant 0
+call String.new 1
+pop static 2
+label L_STRING1
+push static 2
+call Output.printString 1
+pop temp 0
+push static 1
+if-goto L_STRING2
+push constant 2
+call String.new 1
+push constant 104
+call String.appendChar 2
+push constant 105
+call String.appendChar 2
+pop static 1
+label L_STRING2
+push static 1
+call Output.printString 1
+pop temp 0
+push constant 0
+return
+`
+	code, diags := CompileWithOptions("Main.jack", strings.NewReader(src), Options{PoolStrings: true})
+	if len(diags) != 0 {
+		t.Fatal(diags)
+	}
+	if string(code) != want {
+		t.Errorf("got:\n%s\nexpected:\n%s", code, want)
+	}
+}
+
+// Memory.peek and Memory.poke are written inline, unless NoIntrinsics
+// is set.
+func TestIntrinsics(t *testing.T) {
+	src := `class Main {
+  function void main() {
+    do Memory.poke(8000, Memory.peek(8001));
+    return;
+  }
+}`
+	inline := `function Main.main 0
+push constant 8000
+push constant 8001
+pop pointer 1
+push that 0
+pop temp 0
+pop pointer 1
+push temp 0
+pop that 0
+push constant 0
+return
+`
+	calls := `function Main.main 0
+push constant 8000
+push constant 8001
+call Memory.peek 1
+call Memory.poke 2
+pop temp 0
+push constant 0
+return
+`
+	code, diags := Compile("Main.jack", strings.NewReader(src))
+	if len(diags) != 0 {
+		t.Fatal(diags)
+	}
+	if string(code) != inline {
+		t.Errorf("got:\n%s\nexpected:\n%s", code, inline)
+	}
+
+	code, _ = CompileWithOptions("Main.jack", strings.NewReader(src), Options{NoIntrinsics: true})
+	if string(code) != calls {
+		t.Errorf("got:\n%s\nexpected:\n%s", code, calls)
+	}
+}
+
+// A class header that can't be parsed is still an error, and not a crash.
+func TestCompileBadHeader(t *testing.T) {
+	tests := map[string]string{
+		"class { }":        "Main.jack:1:7: expected class name after 'class', found '{'",
+		"2 class Main { }": "Main.jack:1:1: expected 'class' at the start of the file, found '2'",
+	}
+	for src, want := range tests {
+		code, diags := Compile("Main.jack", strings.NewReader(src))
+		if code != nil || len(diags) == 0 || diags[0].String() != want {
+			t.Errorf("%s: got:(%v), expected:(%s)", src, diags, want)
+		}
+		_, diags = CompileProgram([]Source{{"Main.jack", strings.NewReader(src)}})
+		if len(diags) == 0 || diags[0].String() != want {
+			t.Errorf("%s: got:(%v), expected:(%s)", src, diags, want)
+		}
+	}
+}
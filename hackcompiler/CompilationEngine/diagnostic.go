@@ -0,0 +1,104 @@
+package CompilationEngine
+
+import (
+	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
+	"sort"
+)
+
+type Severity int
+
+const (
+	ERROR Severity = iota
+	WARNING
+)
+
+// Diagnostic is a problem found while compiling a file.  Line and
+// Column count from 1, and are 0 when the position isn't known.
+type Diagnostic struct {
+	Filename string
+	Line     int
+	Column   int
+	Severity Severity
+	Message  string
+}
+
+// String formats the diagnostic like "Main.jack:12:9: message".
+// Warnings start with "warning: ".
+func (d Diagnostic) String() string {
+	msg := d.Message
+	if d.Severity == WARNING {
+		msg = "warning: " + msg
+	}
+	switch {
+	case d.Line > 0:
+		return fmt.Sprintf("%s:%d:%d: %s", d.Filename, d.Line, d.Column, msg)
+	case d.Filename != "":
+		return fmt.Sprintf("%s: %s", d.Filename, msg)
+	}
+	return msg
+}
+
+// HasErrors returns true if any of the diagnostics are errors.
+func HasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == ERROR {
+			return true
+		}
+	}
+	return false
+}
+
+// reporter collects the diagnostics for one file.  It is embedded in
+// the parser and in each of the passes.
+type reporter struct {
+	filename string
+	diags    []Diagnostic
+}
+
+func (r *reporter) report(span Token.Span, severity Severity, format string, a ...interface{}) {
+	r.diags = append(r.diags, Diagnostic{
+		Filename: r.filename,
+		Line:     span.Line,
+		Column:   span.Column,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, a...),
+	})
+}
+
+// errorf reports an error at the span.
+func (r *reporter) errorf(span Token.Span, format string, a ...interface{}) {
+	r.report(span, ERROR, format, a...)
+}
+
+// warnf reports a warning at the span.
+func (r *reporter) warnf(span Token.Span, format string, a ...interface{}) {
+	r.report(span, WARNING, format, a...)
+}
+
+// addScannerErrors adds the errors from the scanner to the diagnostics.
+func (e *engine) addScannerErrors() {
+	for _, err := range e.o.Errors() {
+		e.diags = append(e.diags, Diagnostic{
+			Filename: e.filename,
+			Line:     err.Line,
+			Column:   err.Column,
+			Severity: ERROR,
+			Message:  err.Message,
+		})
+	}
+	e.diags = sortDiagnostics(e.diags)
+}
+
+// sortDiagnostics puts the diagnostics in the order they appear in the
+// file.
+func sortDiagnostics(diags []Diagnostic) []Diagnostic {
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i], diags[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return diags
+}
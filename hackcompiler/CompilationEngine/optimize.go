@@ -0,0 +1,304 @@
+package CompilationEngine
+
+import (
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/AST"
+)
+
+// optimize is the pass that runs with the Optimize option.  It runs
+// after the checker, and rewrites the syntax tree of the class into
+// something that does the same thing with less VM code:
+//
+//   - expressions made of constants are computed by the compiler, and
+//     wrap around at 16 bits, the same way that the Hack computer does.
+//   - multiplying by a power of two becomes adding a value to itself,
+//     and multiplying or dividing by 1 does nothing at all.  With the
+//     NativeMath option, multiplying by 8 or more becomes a "<<"
+//     expression instead, which is written with the extended "shl"
+//     command.  Going into the shl routine costs about as much as
+//     three additions, but it is the same size for any power of two.
+//   - ~~x and -(-x) are just x.
+//   - if and while statements with a constant condition lose the
+//     branches that can never run, and "while (true)" doesn't test
+//     its condition.
+//
+// Dividing by other powers of two needs a shift to the right, which
+// the standard VM doesn't have, so it still calls Math.divide.  With
+// the NativeMath option, it becomes a ">>" expression instead, which
+// the code generator writes with the extended "shr" command.  "<<" and
+// ">>" aren't part of Jack, so they can only come from here.
+//
+// The other extended command, "mod", is never written by the compiler,
+// because Jack doesn't have an operator for it.  It is only for VM code
+// that is written by hand.
+func optimize(c *AST.ClassDecl, opt Options) {
+	o := optimizer{native_math: opt.NativeMath}
+	for _, s := range c.Subroutines {
+		s.Body = o.optimizeStatements(s.Body)
+	}
+}
+
+// optimizer has the options that change what the optimizer can use.
+// With native_math, the extended "shl" and "shr" commands can be
+// written.
+type optimizer struct {
+	native_math bool
+}
+
+// optimizeStatements returns the statements with their expressions
+// folded.  Statements that can never run are left out, which is why
+// it returns a new list.
+func (o optimizer) optimizeStatements(list []AST.Stmt) []AST.Stmt {
+	var out []AST.Stmt
+	for _, s := range list {
+		switch s := s.(type) {
+		case *AST.LetStmt:
+			if s.Index != nil {
+				s.Index = o.fold(s.Index)
+			}
+			s.Value = o.fold(s.Value)
+		case *AST.IfStmt:
+			s.Cond = o.fold(s.Cond)
+			s.Then = o.optimizeStatements(s.Then)
+			s.Else = o.optimizeStatements(s.Else)
+			if v, ok := constant(s.Cond); ok {
+				// only one of the branches can ever run, so it
+				// takes the place of the if statement.
+				if isTrue(v) {
+					out = append(out, s.Then...)
+				} else {
+					out = append(out, s.Else...)
+				}
+				continue
+			}
+		case *AST.WhileStmt:
+			s.Cond = o.fold(s.Cond)
+			s.Body = o.optimizeStatements(s.Body)
+			if v, ok := constant(s.Cond); ok && !isTrue(v) {
+				continue
+			}
+		case *AST.DoStmt:
+			o.foldArgs(s.Call)
+		case *AST.ReturnStmt:
+			if s.Value != nil {
+				s.Value = o.fold(s.Value)
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// isTrue returns true if a condition with the value v is taken.  The
+// compiled code only takes a branch when ~v is 0, so true is -1, and
+// every other number is false.
+func isTrue(v int) bool {
+	return v == -1
+}
+
+// constant returns the value of an expression, if it is a constant.
+func constant(x AST.Expr) (int, bool) {
+	switch n := x.(type) {
+	case *AST.IntLit:
+		return n.Value, true
+	case *AST.KeywordLit:
+		switch n.Value {
+		case "true":
+			return -1, true
+		case "false":
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// isBoolean returns true if the expression is true or false.
+func isBoolean(x AST.Expr) bool {
+	k, ok := x.(*AST.KeywordLit)
+	return ok && (k.Value == "true" || k.Value == "false")
+}
+
+// wrap cuts a number down to 16 bits, as a signed number.
+func wrap(v int) int {
+	return int(int16(v))
+}
+
+// literal makes a constant expression for the value.  Booleans are
+// kept as true and false, and everything else is an integer, which
+// can be negative after folding.
+func literal(pos AST.Position, v int, boolean bool) AST.Expr {
+	v = wrap(v)
+	switch {
+	case boolean && v == -1:
+		return &AST.KeywordLit{Position: pos, Value: "true"}
+	case boolean && v == 0:
+		return &AST.KeywordLit{Position: pos, Value: "false"}
+	}
+	return &AST.IntLit{Position: pos, Value: v}
+}
+
+// fold returns the expression with its constant parts computed.
+func (o optimizer) fold(x AST.Expr) AST.Expr {
+	switch n := x.(type) {
+	case *AST.ParenExpr:
+		// the tree already keeps track of the order.
+		return o.fold(n.X)
+	case *AST.IndexExpr:
+		n.Index = o.fold(n.Index)
+	case *AST.CallExpr:
+		o.foldArgs(n)
+	case *AST.UnaryExpr:
+		return o.foldUnary(n)
+	case *AST.BinaryExpr:
+		return o.foldBinary(n)
+	}
+	return x
+}
+
+func (o optimizer) foldArgs(call *AST.CallExpr) {
+	for i, arg := range call.Args {
+		call.Args[i] = o.fold(arg)
+	}
+}
+
+func (o optimizer) foldUnary(n *AST.UnaryExpr) AST.Expr {
+	n.X = o.fold(n.X)
+	if v, ok := constant(n.X); ok {
+		if n.Op == "-" {
+			return literal(n.Position, -v, false)
+		}
+		return literal(n.Position, ^v, isBoolean(n.X))
+	}
+	// doing the same thing twice undoes it.
+	if inner, ok := n.X.(*AST.UnaryExpr); ok && inner.Op == n.Op {
+		return inner.X
+	}
+	return n
+}
+
+func (o optimizer) foldBinary(n *AST.BinaryExpr) AST.Expr {
+	n.X, n.Y = o.fold(n.X), o.fold(n.Y)
+	a, aok := constant(n.X)
+	b, bok := constant(n.Y)
+	if aok && bok {
+		switch n.Op {
+		case "+":
+			return literal(n.Position, a+b, false)
+		case "-":
+			return literal(n.Position, a-b, false)
+		case "*":
+			return literal(n.Position, a*b, false)
+		case "/":
+			// dividing by zero is left for Math.divide to complain
+			// about when the program runs.
+			if b != 0 {
+				return literal(n.Position, a/b, false)
+			}
+		case "&":
+			return literal(n.Position, a&b, isBoolean(n.X) && isBoolean(n.Y))
+		case "|":
+			return literal(n.Position, a|b, isBoolean(n.X) && isBoolean(n.Y))
+		case "<":
+			return literal(n.Position, truth(a < b), true)
+		case ">":
+			return literal(n.Position, truth(a > b), true)
+		case "=":
+			return literal(n.Position, truth(a == b), true)
+		}
+	}
+	return o.reduce(n)
+}
+
+func truth(b bool) int {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+// reduce replaces an operator with a cheaper one, when one of the sides
+// is a constant that makes it easy.
+func (o optimizer) reduce(n *AST.BinaryExpr) AST.Expr {
+	switch n.Op {
+	case "*":
+		if k, ok := powerOfTwo(n.Y); ok {
+			return o.multiply(n.X, k, n.Position)
+		}
+		if k, ok := powerOfTwo(n.X); ok {
+			return o.multiply(n.Y, k, n.Position)
+		}
+		if (isZero(n.X) && pure(n.Y)) || (isZero(n.Y) && pure(n.X)) {
+			return literal(n.Position, 0, false)
+		}
+	case "/":
+		if v, ok := constant(n.Y); ok && v == 1 {
+			return n.X
+		}
+		if k, ok := powerOfTwo(n.Y); ok && o.native_math {
+			shift := &AST.IntLit{Position: n.Position, Value: k}
+			return &AST.BinaryExpr{Position: n.Position, Op: ">>", X: n.X, Y: shift}
+		}
+	case "+":
+		if isZero(n.X) {
+			return n.Y
+		}
+		if isZero(n.Y) {
+			return n.X
+		}
+	case "-":
+		if isZero(n.Y) {
+			return n.X
+		}
+	}
+	return n
+}
+
+func isZero(x AST.Expr) bool {
+	v, ok := constant(x)
+	return ok && v == 0
+}
+
+// powerOfTwo returns k, if the expression is the constant 2^k.
+func powerOfTwo(x AST.Expr) (int, bool) {
+	v, ok := constant(x)
+	if !ok || v <= 0 || v&(v-1) != 0 {
+		return 0, false
+	}
+	k := 0
+	for v > 1 {
+		v >>= 1
+		k++
+	}
+	return k, true
+}
+
+// multiply returns x * 2^k, with additions or with "<<".
+func (o optimizer) multiply(x AST.Expr, k int, pos AST.Position) AST.Expr {
+	if o.native_math && k >= 3 {
+		shift := &AST.IntLit{Position: pos, Value: k}
+		return &AST.BinaryExpr{Position: pos, Op: "<<", X: x, Y: shift}
+	}
+	return double(x, k, pos)
+}
+
+// double returns x * 2^k, as x added to itself k times.  Both sides of
+// each addition are the same node, which tells the code generator that
+// the value only has to be computed once.
+func double(x AST.Expr, k int, pos AST.Position) AST.Expr {
+	for i := 0; i < k; i++ {
+		x = &AST.BinaryExpr{Position: pos, Op: "+", X: x, Y: x}
+	}
+	return x
+}
+
+// pure returns true if the expression doesn't call anything, so it is
+// safe to leave it out.
+func pure(x AST.Expr) bool {
+	calls := false
+	AST.Inspect(x, func(n AST.Node) bool {
+		if _, ok := n.(*AST.CallExpr); ok {
+			calls = true
+		}
+		return !calls
+	})
+	return !calls
+}
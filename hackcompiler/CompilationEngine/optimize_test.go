@@ -0,0 +1,68 @@
+package CompilationEngine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{"let x = 2 * 3;", "push constant 6\npop local 0\n"},
+		{"let x = 1 - 3;", "push constant 2\nneg\npop local 0\n"},
+		{"let x = 32767 + 1;", "push constant 32767\nnot\npop local 0\n"},
+		{"let x = 200 * 200;", "push constant 25536\nneg\npop local 0\n"},
+		{"let x = 7 / 0;", "push constant 7\npush constant 0\ncall Math.divide 2\npop local 0\n"},
+		{"let x = y * 4;", "push local 1\npush local 1\nadd\npop temp 2\npush temp 2\npush temp 2\nadd\npop local 0\n"},
+		{"let x = 2 * (y + 1);", "push local 1\npush constant 1\nadd\npop temp 2\npush temp 2\npush temp 2\nadd\npop local 0\n"},
+		{"let x = y / 1;", "push local 1\npop local 0\n"},
+		{"let x = ~~y;", "push local 1\npop local 0\n"},
+		{"let b = ~(1 < 2);", "push constant 0\npop local 2\n"},
+		{"let b = true & false;", "push constant 0\npop local 2\n"},
+		{"if (false) { let x = 1; } else { let x = 2; }", "push constant 2\npop local 0\n"},
+		{"while (false) { let x = 1; }", ""},
+		{"while (true) { let x = 1; }", "label L_WHILE0\npush constant 1\npop local 0\ngoto L_WHILE0\nlabel L_ENDWHILE0\n"},
+	}
+	for _, test := range tests {
+		src := "class Main { function void main() { var int x, y; var boolean b; " + test.stmt + " return; } }"
+		code, diags := CompileWithOptions("Main.jack", strings.NewReader(src), Options{Optimize: true})
+		if HasErrors(diags) {
+			t.Errorf("%s: %v", test.stmt, diags)
+			continue
+		}
+		want := "function Main.main 3\n" + test.want + "push constant 0\nreturn\n"
+		if string(code) != want {
+			t.Errorf("%s\ngot:\n%s\nexpected:\n%s", test.stmt, code, want)
+		}
+	}
+}
+
+// With NativeMath, dividing by a power of two is done with "shr", which
+// needs 2^k - 1 added to negative numbers to round towards zero, and
+// multiplying by 8 or more is done with "shl".
+func TestOptimizeNativeMath(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{"let x = y / 4;", "push local 1\npush local 1\npush constant 15\nshr\npush constant 3\nand\nadd\npush constant 2\nshr\npop local 0\n"},
+		{"let x = (y + 1) / 2;", "push local 1\npush constant 1\nadd\npop temp 2\npush temp 2\npush temp 2\npush constant 15\nshr\npush constant 1\nand\nadd\npush constant 1\nshr\npop local 0\n"},
+		{"let x = y / 3;", "push local 1\npush constant 3\ndiv\npop local 0\n"},
+		{"let x = y * 4;", "push local 1\npush local 1\nadd\npop temp 2\npush temp 2\npush temp 2\nadd\npop local 0\n"},
+		{"let x = 16 * y;", "push local 1\npush constant 4\nshl\npop local 0\n"},
+	}
+	for _, test := range tests {
+		src := "class Main { function void main() { var int x, y; " + test.stmt + " return; } }"
+		code, diags := CompileWithOptions("Main.jack", strings.NewReader(src), Options{Optimize: true, NativeMath: true})
+		if HasErrors(diags) {
+			t.Errorf("%s: %v", test.stmt, diags)
+			continue
+		}
+		want := "function Main.main 2\n" + test.want + "push constant 0\nreturn\n"
+		if string(code) != want {
+			t.Errorf("%s\ngot:\n%s\nexpected:\n%s", test.stmt, code, want)
+		}
+	}
+}
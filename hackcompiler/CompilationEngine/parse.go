@@ -4,661 +4,597 @@ package CompilationEngine
 import (
 	"bytes"
 	"fmt"
-	"github.com/fractalbach/nandGo2tetris/hackcompiler/CompilationEngine/ParseTree"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/AST"
 	"github.com/fractalbach/nandGo2tetris/hackcompiler/JackGrammar"
 	"github.com/fractalbach/nandGo2tetris/hackcompiler/JackTokenizer"
-	"github.com/fractalbach/nandGo2tetris/hackcompiler/SymbolTable"
 	"github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
-	"github.com/fractalbach/nandGo2tetris/hackcompiler/vmWriter"
 	"io"
 	"strconv"
 )
 
-var (
-	st                  SymbolTable.SymbolTable
-	vm                  vmWriter.VMWriter
-	nLocals             int
-	expression_buf      []string
-	className           string
-	subroutineName      string
-	symbol_table_output string
-	label_counter       int = 0
-	isConstructor       bool
-	inside_method       bool
-	// void_functions          = make(map[string]bool)
-)
-
 type OPTION int
 
 const (
 	OP_SYM_TBL OPTION = 1 << iota
 	OP_XML
-	OP_CODE
 )
 
-var kindToSeg = map[SymbolTable.Kind]vmWriter.Segment{
-	SymbolTable.ARG:    vmWriter.ARG,
-	SymbolTable.STATIC: vmWriter.STATIC,
-	SymbolTable.VAR:    vmWriter.LOCAL,
-	SymbolTable.FIELD:  vmWriter.THIS,
+// Options are the choices about what VM code is written.  The zero
+// value is what the compiler does when it isn't given any flags.
+//
+// The options are passed along to each pass, instead of being kept in
+// the package, so that programs with different options can be compiled
+// at the same time.
+type Options struct {
+	// NativeMath writes the extended "mul" and "div" commands instead
+	// of calling Math.multiply and Math.divide.  Only hackvmslate can
+	// run them.
+	NativeMath bool
+
+	// Optimize runs the optimization pass, before the VM code is
+	// written.  See optimize for what it does.
+	Optimize bool
+
+	// PoolStrings makes each string constant only once, and keeps it
+	// in a static variable.  See VisitString for why it is off.
+	PoolStrings bool
+
+	// NoIntrinsics calls Memory.peek and Memory.poke like any other
+	// function, the same way as the book's compiler, instead of
+	// writing them inline.
+	NoIntrinsics bool
 }
 
+// engine is the parser.  It only builds the syntax tree, and everything
+// else is done by passes over the tree.  Nothing is shared between
+// engines, so many files can be parsed at the same time, each with
+// their own engine.
 type engine struct {
+	reporter
 	o JackTokenizer.TokenIterator
-	w io.Writer
-	t ParseTree.ParseTree
+
+	last        Token.Token // the token that was consumed most recently.
+	reached_eof bool
+	braces      int
 }
 
-func Run(w io.Writer, tokenizer JackTokenizer.TokenIterator, opt OPTION) {
-	e := engine{
-		o: tokenizer,
-		w: w,
-		t: ParseTree.NewParseTree("class"),
+func newEngine(tokenizer JackTokenizer.TokenIterator, filename string) *engine {
+	return &engine{
+		reporter: reporter{filename: filename},
+		o:        tokenizer,
+		last:     tokenizer.Current(),
 	}
-	buf := new(bytes.Buffer)
-	vm = vmWriter.NewVMWriter(buf)
-	st = SymbolTable.NewSymbolTable()
-	e.CompileClass()
+}
+
+// Run parses the class and writes one of the outputs.  It returns
+// the diagnostics, which are also where any syntax errors end up.  The
+// filename is only used in the diagnostics.  Use Compile for VM code.
+func Run(w io.Writer, tokenizer JackTokenizer.TokenIterator, filename string, opt OPTION) []Diagnostic {
+	return RunWithOptions(w, tokenizer, filename, opt, Options{})
+}
+
+// RunWithOptions is Run, with the same options that the VM code would
+// be compiled with.  The symbol tables are the ones that Compile uses,
+// so they are only written when there aren't any errors.
+func RunWithOptions(w io.Writer, tokenizer JackTokenizer.TokenIterator, filename string, opt OPTION, options Options) []Diagnostic {
+	e := newEngine(tokenizer, filename)
+	class := e.parseRecovered()
 	switch opt {
 	case OP_SYM_TBL:
-		fmt.Fprint(w, symbol_table_output)
+		reg := NewRegistry()
+		reg.Add(class)
+		g, diags := generate(new(bytes.Buffer), filename, class, e.diags, reg, options)
+		if g != nil {
+			fmt.Fprint(w, g.symbol_table_output)
+		}
+		return diags
 	case OP_XML:
-		fmt.Fprintln(w, e.t.Root())
-	case OP_CODE:
-		buf.WriteTo(w)
+		fmt.Fprintln(w, PrintXML(class))
+	}
+	return e.diags
+}
+
+// Parse builds the syntax tree for a single .jack file.  The filename
+// is only used in the diagnostics.  If there are syntax errors, the
+// tree is missing whatever couldn't be parsed.
+func Parse(filename string, src io.Reader) (*AST.ClassDecl, []Diagnostic) {
+	e := newEngine(JackTokenizer.Create(src), filename)
+	class := e.parseRecovered()
+	return class, e.diags
+}
+
+// Compile compiles a single .jack file into VM code.  The filename is
+// only used in the diagnostics.  If any of the diagnostics are errors,
+// there is no VM code.
+//
+// The only other classes that it knows about are the ones in the Jack
+// OS.  Calls to any other class are trusted to be right, so use
+// CompileProgram to compile all of the files of a program together.
+//
+// It doesn't use any package-level state, so it is safe to call from
+// many goroutines at once.
+func Compile(filename string, src io.Reader) (vm []byte, diags []Diagnostic) {
+	return CompileWithOptions(filename, src, Options{})
+}
+
+// CompileWithOptions is Compile, with options that change the VM code.
+func CompileWithOptions(filename string, src io.Reader, opt Options) (vm []byte, diags []Diagnostic) {
+	class, diags := Parse(filename, src)
+	reg := NewRegistry()
+	reg.Add(class)
+	return compileClass(filename, class, diags, reg, opt)
+}
+
+// Source is one of the .jack files of a program.
+type Source struct {
+	Filename string
+	Src      io.Reader
+}
+
+// CompileProgram compiles all of the .jack files of a program.  All of
+// the files are parsed first, and the signatures of their subroutines
+// are put into a registry, so that each class is compiled knowing
+// exactly what it can call in the other classes.
+//
+// The VM code is in the same order as the files, and is nil for each
+// file that had errors.  The diagnostics are for all of the files.
+func CompileProgram(files []Source) (vm [][]byte, diags []Diagnostic) {
+	return CompileProgramWithOptions(files, Options{})
+}
+
+// CompileProgramWithOptions is CompileProgram, with options that change
+// the VM code.
+func CompileProgramWithOptions(files []Source, opt Options) (vm [][]byte, diags []Diagnostic) {
+	classes := make([]*AST.ClassDecl, len(files))
+	parse_diags := make([][]Diagnostic, len(files))
+	reg := NewRegistry()
+	reg.whole = true
+	for i, f := range files {
+		classes[i], parse_diags[i] = Parse(f.Filename, f.Src)
+		if classes[i].Name == "" {
+			continue // it didn't even get as far as the name.
+		}
+		if err := reg.Add(classes[i]); err != nil {
+			r := reporter{filename: f.Filename}
+			r.errorf(classes[i].Span(), "%v", err)
+			parse_diags[i] = append(parse_diags[i], r.diags...)
+		}
+	}
+	vm = make([][]byte, len(files))
+	for i, f := range files {
+		code, d := compileClass(f.Filename, classes[i], parse_diags[i], reg, opt)
+		vm[i] = code
+		diags = append(diags, d...)
 	}
-	symbol_table_output = "" // clean up global variable
+	return vm, diags
 }
 
-func (e *engine) tag(s string) {
-	fmt.Fprintln(e, tag(s))
+// compileClass checks the class and then writes its VM code.  The
+// diagnostics that were found so far are passed in, so that the VM
+// code isn't written if there were errors.
+func compileClass(filename string, class *AST.ClassDecl, diags []Diagnostic, reg *Registry, opt Options) ([]byte, []Diagnostic) {
+	code := new(bytes.Buffer)
+	g, diags := generate(code, filename, class, diags, reg, opt)
+	if g == nil {
+		return nil, diags
+	}
+	return code.Bytes(), diags
+}
+
+// generate runs the passes over the class, and writes its VM code to
+// w.  It returns nil instead of the code generator if there were any
+// errors.
+func generate(w io.Writer, filename string, class *AST.ClassDecl, diags []Diagnostic, reg *Registry, opt Options) (*codeGenerator, []Diagnostic) {
+	// The checker still runs when there are syntax errors, on whatever
+	// could be parsed, so that one run finds as much as it can.
+	diags = sortDiagnostics(append(diags, check(filename, class, reg)...))
+	if HasErrors(diags) {
+		return nil, diags
+	}
+	if opt.Optimize {
+		optimize(class, opt)
+	}
+	g := newCodeGenerator(w, filename, reg, opt)
+	class.Accept(g)
+	diags = append(diags, g.diags...)
+	if HasErrors(diags) {
+		return nil, diags
+	}
+	return g, diags
 }
 
-func (e *engine) endtag(s string) {
-	fmt.Fprintln(e, endtag(s))
+// parseRecovered parses the class, and turns a panic into an error.
+// Syntax errors have already been reported by the time they panic.
+// The errors from the scanner are added at the end.  The class is
+// never nil, even when the header couldn't be parsed.
+func (e *engine) parseRecovered() (class *AST.ClassDecl) {
+	class = new(AST.ClassDecl)
+	defer e.addScannerErrors()
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if _, ok := r.(syntaxError); ok {
+			return
+		}
+		msg := fmt.Sprint(r)
+		if !e.o.HasMoreTokens() {
+			msg = "unexpected end of file"
+		}
+		e.errorf(e.o.Current().Span(), "%s", msg)
+	}()
+	e.parseClass(class)
+	return class
 }
 
-func (e *engine) println(a ...interface{}) {
-	fmt.Fprintln(e, a...)
+// advance moves to the next token, and returns the one that was current.
+func (e *engine) advance() Token.Token {
+	tok := e.o.Current()
+	switch {
+	case e.isSymbol("{"):
+		e.braces++
+	case e.isSymbol("}"):
+		e.braces--
+	}
+	e.last = tok
+	e.o.Advance()
+	return tok
 }
 
-func (e *engine) printCurrentToken() {
-	e.println(e.o.Current())
+// spanFrom returns the span from the start of the given token, to the
+// end of the token that was just consumed.
+func (e *engine) spanFrom(start Token.Token) AST.Position {
+	a, b := start.Span(), e.last.Span()
+	return AST.Position{Pos: Token.Span{
+		Line:      a.Line,
+		Column:    a.Column,
+		EndLine:   b.EndLine,
+		EndColumn: b.EndColumn,
+	}}
 }
 
-func (e *engine) Write(p []byte) (int, error) {
-	return e.w.Write(p)
+func (e *engine) ident(tok Token.Token) *AST.Ident {
+	return &AST.Ident{
+		Position: AST.Position{Pos: tok.Span()},
+		Name:     tok.Content(),
+	}
 }
 
-// CompileClass is the first function that is called by Run(), so it
-// creates and returns the Parse Tree.  All other compile methods are
-// called from CompileClass().
+// parseClass fills in the class as it goes, so that whatever was
+// parsed is still there if it gives up part way through.
 //
 // Class:  'class' className '{' classVarDec* subroutineDec* '}'
 //
-func (e *engine) CompileClass() {
-	e.CompileToken() // keyword 'class'
-	className = e.o.Current().Content()
-	e.CompileToken() // identifier className
-	e.CompileToken() // symbol {
+// A syntax error inside of a declaration skips ahead to the next
+// declaration, so that the rest of the class is still checked.
+func (e *engine) parseClass(c *AST.ClassDecl) {
+	start := e.o.Current()
+	defer func() {
+		c.Position = e.spanFrom(start)
+	}()
+	e.expectKeyword("class", "at the start of the file")
+	c.Name = e.expectIdentifier("class name", "after 'class'").Content()
+	e.expectSymbol("{", "after the class name")
 	// closure:  (classVarDec)*
-	if e.hasClassVarDec() {
-		for e.hasClassVarDec() == true {
-			e.CompileClassVarDec()
-		}
-		symbol_table_output += fmt.Sprintln("Class Table:", className)
-		symbol_table_output += st.PrintClassTable()
+	for e.hasClassVarDec() {
+		e.recoverDeclaration(func() {
+			c.Vars = append(c.Vars, e.parseClassVarDec())
+		})
 	}
 	// closure: (subroutineDec)*
-	for e.hasSubroutineDec() {
-		st.StartSubroutine()
-		e.CompileSubroutineDec()
-		vm.WriteReturn()
-		symbol_table_output += ("Subroutine Table:" + className + "." + subroutineName + "\n")
-		symbol_table_output += st.PrintSubroutineTable()
+	for {
+		if e.hasClassVarDec() {
+			e.errorf(e.o.Current().Span(), "class variables must be declared before the subroutines")
+			e.recoverDeclaration(func() {
+				c.Vars = append(c.Vars, e.parseClassVarDec())
+			})
+			continue
+		}
+		if !e.hasSubroutineDec() {
+			if e.isSymbol("}") || e.atEOF() {
+				break
+			}
+			e.recoverDeclaration(func() {
+				e.fail("expected a subroutine declaration, found %s", e.found())
+			})
+			continue
+		}
+		e.recoverDeclaration(func() {
+			c.Subroutines = append(c.Subroutines, e.parseSubroutineDec())
+		})
+	}
+	if !e.isSymbol("}") {
+		e.errorAt(e.o.Current(), "expected '}' at the end of class %s, found %s", c.Name, e.found())
+		return
+	}
+	e.advance() // symbol }
+	if !e.atEOF() {
+		e.errorAt(e.o.Current(), "expected end of file after class %s, found %s", c.Name, e.found())
 	}
-	e.CurrentToLeaf() // symbol }
 }
 
 // ClassVarDec = ('static' | 'field') type varName (',' varName)* ';'
-func (e *engine) CompileClassVarDec() {
-	e.t = e.t.Branch("classVarDec")
-	varKind := SymbolTable.StringToKind(e.o.Current().Content())
-	e.CompileToken() // ('static' | 'field')
-	varType := e.o.Current().Content()
-	e.CompileToken() // type
-	varName := e.o.Current().Content()
-	e.CompileToken() // varName
-	st.Define(varName, varType, varKind)
-	for e.o.Current().Content() == "," {
-		e.CompileToken()                     // ','
-		varName = e.o.Current().Content()    // saves the varName
-		e.CompileToken()                     // varName
-		st.Define(varName, varType, varKind) // adds to symbol table.
-	}
-	e.CompileToken() // ';'
-	e.t = e.t.Up()
+func (e *engine) parseClassVarDec() *AST.ClassVarDecl {
+	start := e.advance() // ('static' | 'field')
+	v := &AST.ClassVarDecl{Kind: start.Content()}
+	v.Type = e.expectType("in variable declaration")
+	v.Names = append(v.Names, e.ident(e.expectIdentifier("variable name", "after the type")))
+	for e.isSymbol(",") {
+		e.advance() // ','
+		v.Names = append(v.Names, e.ident(e.expectIdentifier("variable name", "after ','")))
+	}
+	e.expectSymbol(";", "after variable declaration")
+	v.Position = e.spanFrom(start)
+	return v
 }
 
 // Parameter List = ((type varName) (',' type varName)*)?
-func (e *engine) CompileParameterList() int {
-	n := 0
-	sName := ""
-	sType := ""
-	sKind := SymbolTable.ARG
-	e.t = e.t.Branch("parameterList")
-	for e.o.Current().Content() != ")" {
-		sType = e.o.Current().Content()
-		e.CompileToken() // type
-		sName = e.o.Current().Content()
-		e.CompileToken() // varName
-		st.Define(sName, sType, sKind)
-		n++
-		for e.o.Current().Content() == "," {
-			e.CompileToken() // ','
-			sType = e.o.Current().Content()
-			e.CompileToken() // type
-			sName = e.o.Current().Content()
-			e.CompileToken() // varName
-			st.Define(sName, sType, sKind)
-			n++
+func (e *engine) parseParameterList() []*AST.Param {
+	var list []*AST.Param
+	if e.isSymbol(")") {
+		return list
+	}
+	context := "in parameter list"
+	for {
+		start := e.o.Current()
+		p := &AST.Param{Type: e.expectType(context)}
+		p.Name = e.expectIdentifier("parameter name", "after the type").Content()
+		p.Position = e.spanFrom(start)
+		list = append(list, p)
+		if !e.isSymbol(",") {
+			return list
 		}
+		e.advance() // ','
+		context = "after ','"
 	}
-	e.t = e.t.Up()
-	return n
 }
 
-func (e *engine) CompileSubroutineDec() {
-	e.t = e.t.Branch("subroutineDec")
-	isConstructor = false
-	switch e.o.Current().Content() {
-	case "constructor":
-		isConstructor = true
-		inside_method = true
-	case "method":
-		st.Define("this", className, SymbolTable.ARG)
-		inside_method = true
-	}
-	e.CompileToken() // ('constructor' | 'function' | 'method')
-	e.CompileToken() // 'void' | type
-	subroutineName = e.o.Current().Content()
-	e.CompileToken() // subroutineName
-	e.CompileToken() // '('
-	e.CompileParameterList()
-	e.CompileToken() // ')'
-	e.CompileSubroutineBody()
-	e.t = e.t.Up()
-	isConstructor = false // clean up global variable.
-	inside_method = false // no longer inside a method/constructor
-}
-
-// subroutineBody = '{' varDec* statements '}'
-func (e *engine) CompileSubroutineBody() {
-	e.t = e.t.Branch("subroutineBody")
-	e.CompileToken() // '{'
-	for e.o.Current().Content() == "var" {
-		e.CompileVarDec()
-	}
-	// must call WriteFunction() after CompileVarDec() has been called,
-	// because the VM command needs to know how many local variables
-	// there are in the function.
-	fullname := className + "." + subroutineName
-	nLocals = st.VarCount(SymbolTable.VAR)
-	vm.WriteFunction(fullname, nLocals)
-
-	// check the current symbol table to see if we added a "this" to
-	// the subroutine.  If we have, then we must make sure to write
-	// "push argument 0".
-	if st.Has("this") && st.KindOf("this") == SymbolTable.ARG {
-		vm.WritePush(vmWriter.ARG, 0)
-		vm.WritePop(vmWriter.POINTER, 0)
-	}
-
-	// constructors are special because they need to allocate memory.
-	// determine the sizeOf() by counting the number of fields,
-	// 1. push the size to the stack,
-	// 2. call Memory.alloc(size), which leave a pointer on the stack,
-	// 3. pop stack, changing THIS pointer to the new pointer.
-	if subroutineName == "new" {
-		size := st.VarCount(SymbolTable.FIELD)
-		vm.WritePush(vmWriter.CONST, size)
-		vm.WriteCall("Memory.alloc", 1)
-		vm.WritePop(vmWriter.POINTER, 0)
-	}
-	// continue on to compile the proccesses within the function.
-	e.CompileStatements()
-	e.CompileToken() // '}'
-	e.t = e.t.Up()
-}
-
-// Compile Variable Declarations.  Adds Variables to the Symbol Table,
-// at the scope of Subroutine.
-func (e *engine) CompileVarDec() {
-	sName := ""
-	sType := ""
-	sKind := SymbolTable.VAR
-	e.t = e.t.Branch("varDec")
-	e.CompileToken() // 'var'
-	sType = e.o.Current().Content()
-	e.CompileToken() // type
-	sName = e.o.Current().Content()
-	e.CompileToken() // varName
-	st.Define(sName, sType, sKind)
-	for e.o.Current().Content() == "," {
-		e.CompileToken() // ','
-		sName = e.o.Current().Content()
-		e.CompileToken() // varName
-		st.Define(sName, sType, sKind)
-		nLocals++
-	}
-	e.CompileToken() // ';'
-	e.t = e.t.Up()
-}
-
-func (e *engine) CompileStatements() {
-	e.t = e.t.Branch("statements")
+// subroutineDec = ('constructor' | 'function' | 'method') ('void' | type)
+// subroutineName '(' parameterList ')' subroutineBody
+func (e *engine) parseSubroutineDec() *AST.SubroutineDecl {
+	start := e.advance() // ('constructor' | 'function' | 'method')
+	s := &AST.SubroutineDecl{Kind: start.Content()}
+	if e.isKeyword("void") {
+		s.ReturnType = e.advance().Content() // 'void'
+	} else {
+		s.ReturnType = e.expectType("as the return type")
+	}
+	s.Name = e.expectIdentifier("subroutine name", "after the return type").Content()
+	e.expectSymbol("(", "after the subroutine name")
+	s.Params = e.parseParameterList()
+	e.expectSymbol(")", "after the parameter list")
+
+	// subroutineBody = '{' varDec* statements '}'
+	e.expectSymbol("{", "before the subroutine body")
+	for e.isKeyword("var") {
+		s.Locals = append(s.Locals, e.parseVarDec())
+	}
+	s.Body = e.parseStatements()
+	e.expectSymbol("}", "at the end of the subroutine body")
+	s.Position = e.spanFrom(start)
+	return s
+}
+
+// VarDec = 'var' type varName (',' varName)* ';'
+func (e *engine) parseVarDec() *AST.VarDecl {
+	start := e.advance() // 'var'
+	v := &AST.VarDecl{Type: e.expectType("after 'var'")}
+	v.Names = append(v.Names, e.ident(e.expectIdentifier("variable name", "after the type")))
+	for e.isSymbol(",") {
+		e.advance() // ','
+		v.Names = append(v.Names, e.ident(e.expectIdentifier("variable name", "after ','")))
+	}
+	e.expectSymbol(";", "after variable declaration")
+	v.Position = e.spanFrom(start)
+	return v
+}
+
+// parseStatements parses statements until it finds something that
+// can't start a statement.  A syntax error inside of a statement skips
+// ahead to the start of the next one.
+func (e *engine) parseStatements() []AST.Stmt {
+	var list []AST.Stmt
 	for {
+		var parse func() AST.Stmt
 		switch e.o.Current().Content() {
 		case "let":
-			e.CompileLet()
+			parse = e.parseLet
 		case "if":
-			e.CompileIf()
+			parse = e.parseIf
 		case "while":
-			e.CompileWhile()
+			parse = e.parseWhile
 		case "do":
-			e.CompileDo()
+			parse = e.parseDo
 		case "return":
-			e.CompileReturn()
+			parse = e.parseReturn
 		default:
-			e.t = e.t.Up()
-			return
+			return list
 		}
+		e.recoverStatement(func() {
+			list = append(list, parse())
+		})
 	}
-	e.t = e.t.Up()
 }
 
-func (e *engine) CompileExpression() {
-	e.t = e.t.Branch("expression")
-	e.CompileTerm()
-	for e.isOperator() {
-		op := e.o.Current().Content()
-		e.CompileToken() // op
-		e.CompileTerm()
-		cmd := vmWriter.OpToCmd(op)
-		vm.WriteArithmetic(cmd)
-	}
-	e.t = e.t.Up()
-}
-
-func (e *engine) CompileLet() {
-	e.t = e.t.Branch("letStatement")
-	e.CompileToken() // 'let'
-	isArray := false
-	sName := e.o.Current().Content()
-	sKind := st.KindOf(sName)
-	sIndex := st.IndexOf(sName)
-	current_token := e.o.Current()
-	e.CompileToken() // varName
-	/*
-		When assigning a new value to a position in an array, it is treated
-		differently than when compiled as a term. We still need the address
-		of the value, but instead of pushing that value, we are going to
-		save that adresss until after we compile the NEW value.
-
-		1. Push &arr[index] to the stack.
-		2. Pop value into TEMP 1 (reserved for this purpose)
-		3. CompileExpression() leaves a value on the stack.
-		4. Push TEMP1, which still contains &arr[index]
-		5. Pop to POINTER 1, allowing us to follow the pointer
-		6. Pop THIS 0, placing the expression into *arr[index]
-	*/
-	if e.o.Current().Content() == "[" {
-		isArray = true
-		e.pushArrayPointer(current_token) // 1.
-		vm.WritePop(vmWriter.TEMP, 1)     // 2.
-	}
-	e.CompileToken()      // '='
-	e.CompileExpression() // <------------- 3.
-	e.CompileToken()      // ';'
-	if isArray {
-		vm.WritePush(vmWriter.TEMP, 1)   // 4.
-		vm.WritePop(vmWriter.POINTER, 1) // 5.
-		vm.WritePop(vmWriter.THAT, 0)    // 6.
-	} else {
-		vm.WritePop(kindToSeg[sKind], sIndex)
-	}
-	e.t = e.t.Up()
-}
-
-func (e *engine) CompileIf() {
-	prefix := "L_"
-	label1 := fmt.Sprint(prefix, "IF", label_counter)
-	label2 := fmt.Sprint(prefix, "ENDIF", label_counter)
-	// finished_first_else := false
-	label_counter++
-	e.t = e.t.Branch("ifStatement")
-	e.CompileToken() // 'if'
-	e.CompileToken() // '('
-	e.CompileExpression()
-	e.CompileToken() // ')'
-	vm.WriteArithmetic(vmWriter.NOT)
-	vm.WriteIf(label1)
-	e.CompileToken() // '{'
-	e.CompileStatements()
-	e.CompileToken() // '}'
-	vm.WriteGoto(label2)
-	vm.WriteLabel(label1)
-	for e.o.Current().Content() == "else" {
-		e.CompileToken() // 'else'
-		e.CompileToken() // '{'
-		e.CompileStatements()
-		e.CompileToken() // '}'
-		// finished_first_else = true
-	}
-	vm.WriteLabel(label2)
-	e.t = e.t.Up()
-}
-
-func (e *engine) CompileWhile() {
-	prefix := "L_"
-	label1 := fmt.Sprint(prefix, "WHILE", label_counter)
-	label2 := fmt.Sprint(prefix, "ENDWHILE", label_counter)
-	label_counter++
-	vm.WriteLabel(label1)
-	e.t = e.t.Branch("whileStatement")
-	e.CompileToken() // 'while'
-	e.CompileToken() // '('
-	e.CompileExpression()
-	e.CompileToken() // ')'
-	vm.WriteArithmetic(vmWriter.NOT)
-	vm.WriteIf(label2)
-	e.CompileToken() // '{'
-	e.CompileStatements()
-	e.CompileToken() // '}'
-	e.t = e.t.Up()
-	vm.WriteGoto(label1)
-	vm.WriteLabel(label2)
-}
-
-func (e *engine) CompileDo() {
-	e.t = e.t.Branch("doStatement")
-	e.CompileToken() // 'do'
-
-	// for subroutine calls, you need to do 1 char look-ahead.
-	current_token := e.o.Current()
-	e.o.Advance()
-	next_token := e.o.Current()
-
-	// do statements create function calls, so we want to save the name.
-	nArgs := 0
-	sName := current_token.Content()
-
-	// being inside a constructor or method, and having no explicit
-	// receiver, implies that the current object is the receiver.
-	// The pointer to current object is accesible via POINTER 0
-
-	// decide parsing method based on that next token.
-	switch next_token.Content() {
-	case "(": // subroutineCall
-		if inside_method {
-			vm.WritePush(vmWriter.POINTER, 0)
-			nArgs++
-		}
-		e.t.Leaf(current_token) // subroutineName
-		e.CompileToken()        // '('
-		nArgs += e.CompileExpressionList()
-		e.CompileToken() // ')'
-		// assume that the prefix is the current class name.
-		sName = fmt.Sprint(className, ".", sName)
-
-	case ".": //subroutineCall
-		// lookup the name of the receiver in the symbol table.
-		// If we can find it, then we know it's a variable which
-		// contains a reference to an object.  (now called a receiver).
-		// Push the receiver pointer onto the stack.  the pointer will
-		// become an argument for calling a method.
-		recName := current_token.Content()
-		if st.Has(recName) {
-			segment := kindToSeg[st.KindOf(recName)]
-			index := st.IndexOf(recName)
-			vm.WritePush(segment, index)
-			sName = st.TypeOf(recName)
-			nArgs++
-		}
-		// If we couldn't find the variable in the symbol table,
-		// then assume it was a className, and there is no receiver.
+// letStatement = 'let' varName ('[' expression ']')? '=' expression ';'
+func (e *engine) parseLet() AST.Stmt {
+	start := e.advance() // 'let'
+	s := new(AST.LetStmt)
+	s.Name = e.ident(e.expectIdentifier("variable name", "after 'let'"))
+	if e.isSymbol("[") {
+		e.advance() // '['
+		s.Index = e.parseExpression()
+		e.expectSymbol("]", "after the array index")
+	}
+	e.expectSymbol("=", "after the variable name")
+	s.Value = e.parseExpression()
+	e.expectSymbol(";", "after expression")
+	s.Position = e.spanFrom(start)
+	return s
+}
+
+// ifStatement = 'if' '(' expression ')' '{' statements '}' ('else' '{' statements '}')?
+func (e *engine) parseIf() AST.Stmt {
+	start := e.advance() // 'if'
+	s := new(AST.IfStmt)
+	e.expectSymbol("(", "after 'if'")
+	s.Cond = e.parseExpression()
+	e.expectSymbol(")", "after the condition")
+	e.expectSymbol("{", "after the condition")
+	s.Then = e.parseStatements()
+	e.expectSymbol("}", "at the end of the if statement")
+	if e.isKeyword("else") {
+		e.advance() // 'else'
+		s.HasElse = true
+		e.expectSymbol("{", "after 'else'")
+		s.Else = e.parseStatements()
+		e.expectSymbol("}", "at the end of the else statement")
+	}
+	s.Position = e.spanFrom(start)
+	return s
+}
 
-		e.t.Leaf(current_token) // className | varName
-		e.CompileToken()        // '.'
-		sName += ("." + e.o.Current().Content())
-		e.CompileToken() // subroutineName
-		e.CompileToken() // '('
-		nArgs += e.CompileExpressionList()
-		e.CompileToken() // ')'
+// whileStatement = 'while' '(' expression ')' '{' statements '}'
+func (e *engine) parseWhile() AST.Stmt {
+	start := e.advance() // 'while'
+	s := new(AST.WhileStmt)
+	e.expectSymbol("(", "after 'while'")
+	s.Cond = e.parseExpression()
+	e.expectSymbol(")", "after the condition")
+	e.expectSymbol("{", "after the condition")
+	s.Body = e.parseStatements()
+	e.expectSymbol("}", "at the end of the while statement")
+	s.Position = e.spanFrom(start)
+	return s
+}
 
-	default:
-		panic("wtf your do statement sucks!")
+// doStatement = 'do' subroutineCall ';'
+func (e *engine) parseDo() AST.Stmt {
+	start := e.advance() // 'do'
+	if e.o.Current().Kind() != JackGrammar.IDENTIFIER {
+		e.fail("expected subroutine call after 'do', found %s", e.found())
 	}
-	e.CompileToken() // ';'
-	e.t = e.t.Up()
-	vm.WriteCall(sName, nArgs)
-	vm.WritePop(vmWriter.TEMP, 0)
+	name := e.advance()
+	if !e.isSymbol("(") && !e.isSymbol(".") {
+		e.fail("expected '(' or '.' after %s in do statement, found %s", describe(name), e.found())
+	}
+	s := &AST.DoStmt{Call: e.parseCall(name)}
+	e.expectSymbol(";", "after do statement")
+	s.Position = e.spanFrom(start)
+	return s
 }
 
-func (e *engine) CompileReturn() {
-	e.t = e.t.Branch("returnStatement")
-	e.CompileToken() // 'return'
-	for e.o.Current().Content() != ";" {
-		e.CompileExpression()
+// returnStatement = 'return' expression? ';'
+func (e *engine) parseReturn() AST.Stmt {
+	start := e.advance() // 'return'
+	s := new(AST.ReturnStmt)
+	if e.startsTerm() {
+		s.Value = e.parseExpression()
 	}
-	e.CompileToken() // ';'
-	e.t = e.t.Up()
+	e.expectSymbol(";", "after return statement")
+	s.Position = e.spanFrom(start)
+	return s
 }
 
-func (e *engine) CompileTerm() {
-	e.t = e.t.Branch("term")
-	defer func() {
-		e.t = e.t.Up()
-	}()
-	// save the current token and advance. We need to do a single look-ahead.
-	current_token := e.o.Current()
-	e.o.Advance()
-	next_token := e.o.Current()
+// expression = term (op term)*
+// There is no operator precedence, so the operators are applied from
+// left to right.
+func (e *engine) parseExpression() AST.Expr {
+	start := e.o.Current()
+	x := e.parseTerm()
+	for e.isOperator() {
+		op := e.advance().Content()
+		y := e.parseTerm()
+		b := &AST.BinaryExpr{Op: op, X: x, Y: y}
+		b.Position = e.spanFrom(start)
+		x = b
+	}
+	return x
+}
+
+// term = integerConstant | stringConstant | keywordConstant | varName |
+// varName '[' expression ']' | subroutineCall | '(' expression ')' |
+// unaryOp term
+func (e *engine) parseTerm() AST.Expr {
+	tok := e.o.Current()
+	if !e.startsTerm() {
+		e.fail("expected expression, found %s", e.found())
+	}
+	e.advance()
 
-	// switch based on the first token's kind.
-	switch current_token.Kind() {
+	switch tok.Kind() {
 	case JackGrammar.STRING_CONST:
-		// create a new string, and append characters to it.
-		// Leave a pointer to the string on top of the stack.
-		// An example (
-		// 		https://play.golang.org/p/MxQsrUSU6dD
-		// where a pointer to the array containing "hello world"
-		// is pushed to the stack.
-		str := current_token.Content()
-		vm.WritePush(vmWriter.CONST, len(str))
-		vm.WriteCall("String.new", 1)
-		for _, c := range str {
-			vm.WritePush(vmWriter.CONST, int(c))
-			vm.WriteCall("String.appendChar", 2)
-		}
-		e.t.Leaf(current_token)
-		return
+		return &AST.StringLit{Position: e.spanFrom(tok), Value: tok.Content()}
 
 	case JackGrammar.INT_CONST:
-		e.t.Leaf(current_token)
-		val, _ := strconv.Atoi(current_token.Content())
-		vm.WritePush(vmWriter.CONST, val)
-		return
-
-	case JackGrammar.SYMBOL:
-		switch current_token.Content() {
-		case "(":
-			e.t.Leaf(current_token) // '('
-			e.CompileExpression()
-			e.CompileToken() // ')'
-			return
-		case "-":
-			e.t.Leaf(current_token) // unaryOp - arithmetic negation
-			e.CompileTerm()
-			vm.WriteArithmetic(vmWriter.NEG)
-			return
-		case "~":
-			e.t.Leaf(current_token) // unaryOp - boolean negation
-			e.CompileTerm()
-			vm.WriteArithmetic(vmWriter.NOT)
-			return
-		}
+		// the scanner has already complained about any that are too big.
+		val, _ := strconv.Atoi(tok.Content())
+		return &AST.IntLit{Position: e.spanFrom(tok), Value: val}
 
 	case JackGrammar.KEYWORD:
-		switch current_token.Content() {
-		case "true":
-			vm.WritePush(vmWriter.CONST, 1)
-			vm.WriteArithmetic(vmWriter.NEG)
-			e.t.Leaf(current_token) // keyword const
-			return
-		case "null", "false":
-			vm.WritePush(vmWriter.CONST, 0)
-		case "this":
-			e.t.Leaf(current_token) // keyword const
-			if st.Has("this") && st.KindOf("this") == SymbolTable.ARG {
-				vm.WritePush(vmWriter.ARG, 0)
-				return
-			}
-			vm.WritePush(vmWriter.POINTER, 0)
-			return
-		}
-
-	case JackGrammar.IDENTIFIER:
-		switch next_token.Content() {
-		case "[":
-			// To access the value in arr[index], we want to get a pointer
-			// to the location of the value, and place it onto the stack.
-			e.pushArrayPointer(current_token)
-			// Now that &arr[index] is on the stack, we want to follow the
-			// pointer.  Save the pointer in 'POINTER 1', which corresponds
-			// to THAT', and access it using 'THAT 0'.  We can use 0 because
-			// we already have the exact address of the value we want.
-			vm.WritePop(vmWriter.POINTER, 1)
-			vm.WritePush(vmWriter.THAT, 0)
-			return
-
-		case "(": // subroutineCall
-			nArgs := 0
-			if inside_method {
-				vm.WritePush(vmWriter.POINTER, 0)
-				nArgs++
-			}
-			sName := current_token.Content()
-			e.t.Leaf(current_token) // subroutineName
-			e.CompileToken()        // '('
-			nArgs += e.CompileExpressionList()
-			e.CompileToken() // ')'
-			vm.WriteCall((className + "." + sName), nArgs)
-			return
-		case ".": //subroutineCall
-			nArgs := 0
-			sName1 := current_token.Content()
-			// If the name before a "." is a known variable, and is
-			// in our symbol table, then it is being used as a reciever
-			// for a method call.  If this is the case, push it to the
-			// stack, because  it will become argument 0 for the calling
-			// function.
-			if st.Has(sName1) {
-				segment := kindToSeg[st.KindOf(sName1)]
-				index := st.IndexOf(sName1)
-				vm.WritePush(segment, index)
-				// additionally, we need to extract the name of the class
-				// from the variable.  It's the TYPE.
-				sName1 = st.TypeOf(sName1)
-				nArgs++
-			}
-			e.t.Leaf(current_token) // className | varName
-			e.CompileToken()        // '.'
-			sName2 := e.o.Current().Content()
-			e.CompileToken() // subroutineName
-			e.CompileToken() // '('
-			nArgs += e.CompileExpressionList()
-			e.CompileToken() // ')'
-			vm.WriteCall((sName1 + "." + sName2), nArgs)
-			return
+		return &AST.KeywordLit{Position: e.spanFrom(tok), Value: tok.Content()}
 
-		default:
-			varName := current_token.Content()
-			segment := kindToSeg[st.KindOf(varName)]
-			index := st.IndexOf(varName)
-			vm.WritePush(segment, index)
-			e.t.Leaf(current_token) // varName
-			return
+	case JackGrammar.SYMBOL:
+		if tok.Content() == "(" {
+			x := e.parseExpression()
+			e.expectSymbol(")", "after expression")
+			return &AST.ParenExpr{Position: e.spanFrom(tok), X: x}
 		}
+		// unaryOp: '-' is arithmetic negation, '~' is boolean negation.
+		x := e.parseTerm()
+		return &AST.UnaryExpr{Position: e.spanFrom(tok), Op: tok.Content(), X: x}
 	}
-}
 
-func (e *engine) CompileExpressionList() int {
-	n := 0
-	e.t = e.t.Branch("expressionList")
-	if e.o.Current().Content() == ")" {
-		e.t = e.t.Up()
-		return n
-	}
-	e.CompileExpression()
-	n++
-	for e.o.Current().Content() == "," {
-		e.CompileToken() // ','
-		e.CompileExpression()
-		n++
+	// Identifiers need a single look-ahead, to tell the difference
+	// between a variable, an array, and a subroutine call.
+	switch {
+	case e.isSymbol("["):
+		e.advance() // '['
+		index := e.parseExpression()
+		e.expectSymbol("]", "after the array index")
+		return &AST.IndexExpr{Position: e.spanFrom(tok), Name: tok.Content(), Index: index}
+	case e.isSymbol("("), e.isSymbol("."):
+		return e.parseCall(tok)
 	}
-	e.t = e.t.Up()
-	return n
+	return &AST.VarExpr{Position: e.spanFrom(tok), Name: tok.Content()}
 }
 
-// -----------------------------------------------------
-
-// MACRO for writing vm code.  Pushes a pointer to an indexed position
-// in an array.  Also compiles an expression within, so this function/Macro
-// is likely to be used recurisvely.
-func (e *engine) pushArrayPointer(current_token Token.Token) {
-	// First, push the variable to the stack.
-	// This variable should contain a pointer to the
-	// beginning of the array we want to access.
-	e.t.Leaf(current_token) // varName
-	varName := current_token.Content()
-	segment := kindToSeg[st.KindOf(varName)]
-	symbolIndex := st.IndexOf(varName)
-	vm.WritePush(segment, symbolIndex)
-	// The expression in the brackets contains the [index] of the
-	// desired position, where 0 is the beginning of the array.
-	// CompileExpression will write the neccessary vm code to compute
-	// this value and leave it on top of the stack.
-	e.CompileToken()      // '['
-	e.CompileExpression() // exp
-	e.CompileToken()      // ']'
-	// At this point, there are 2 values sitting on top of the stack:
-	// (top - 1): the address of the beginning of the array.
-	// (top - 0): the index of the array.
-	// We can add the index to the address, giving us the address of
-	// the exact location in the array we want to access.
-	vm.WriteArithmetic(vmWriter.ADD)
-	return
-}
-
-// -----------------------------------------------------
-
-func (e *engine) CurrentToLeaf() {
-	e.t.Leaf(e.o.Current())
-}
-
-func (e *engine) CompileToken() {
-	e.t.Leaf(e.o.Current())
-	e.o.Advance()
+// subroutineCall = subroutineName '(' expressionList ')' |
+// (className | varName) '.' subroutineName '(' expressionList ')'
+//
+// The first name has already been consumed.
+func (e *engine) parseCall(name Token.Token) *AST.CallExpr {
+	call := &AST.CallExpr{Name: name.Content()}
+	if e.isSymbol(".") {
+		e.advance() // '.'
+		call.Receiver = name.Content()
+		call.Name = e.expectIdentifier("subroutine name", "after '.'").Content()
+		e.expectSymbol("(", "after the subroutine name")
+	} else {
+		e.advance() // '('
+	}
+	call.Args = e.parseExpressionList()
+	e.expectSymbol(")", "after the arguments")
+	call.Position = e.spanFrom(name)
+	return call
 }
 
-func tag(s string) string {
-	return fmt.Sprintf("<%s>", s)
+// expressionList = (expression (',' expression)*)?
+func (e *engine) parseExpressionList() []AST.Expr {
+	var list []AST.Expr
+	if e.isSymbol(")") {
+		return list
+	}
+	list = append(list, e.parseExpression())
+	for e.isSymbol(",") {
+		e.advance() // ','
+		list = append(list, e.parseExpression())
+	}
+	return list
 }
 
-func endtag(s string) string {
-	return fmt.Sprintf("</%s>", s)
-}
+// -----------------------------------------------------
 
 func (e *engine) hasClassVarDec() bool {
 	c := e.o.Current().Content()
@@ -0,0 +1,203 @@
+package CompilationEngine
+
+import (
+	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/JackGrammar"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
+)
+
+// syntaxError is what the parser panics with after it has reported a
+// syntax error.  It is recovered at the nearest statement or
+// declaration, which skips ahead to somewhere it can start over.
+type syntaxError struct{}
+
+// errorAt reports an error at the given token.  Only the first error at
+// the end of the file is reported, since everything after it would just
+// be complaining about the same missing code.
+//
+// Tokens that the scanner already complained about are skipped too.
+func (e *engine) errorAt(tok Token.Token, format string, a ...interface{}) {
+	switch tok.Kind() {
+	case JackGrammar.INVALID:
+		return
+	case JackGrammar.EOF:
+		if e.reached_eof {
+			return
+		}
+		e.reached_eof = true
+	}
+	e.errorf(tok.Span(), format, a...)
+}
+
+// fail reports a syntax error at the current token, and stops parsing
+// whatever is being parsed right now.
+func (e *engine) fail(format string, a ...interface{}) {
+	e.errorAt(e.o.Current(), format, a...)
+	panic(syntaxError{})
+}
+
+// describe returns the token the way it should appear in an error,
+// like 'let', or "end of file".
+func describe(tok Token.Token) string {
+	switch tok.Kind() {
+	case JackGrammar.EOF:
+		return "end of file"
+	case JackGrammar.STRING_CONST:
+		return fmt.Sprintf("%q", tok.Content())
+	}
+	return fmt.Sprintf("'%s'", tok.Content())
+}
+
+// found describes the current token.
+func (e *engine) found() string {
+	return describe(e.o.Current())
+}
+
+func (e *engine) atEOF() bool {
+	return e.o.Current().Kind() == JackGrammar.EOF
+}
+
+func (e *engine) isSymbol(s string) bool {
+	c := e.o.Current()
+	return c.Kind() == JackGrammar.SYMBOL && c.Content() == s
+}
+
+func (e *engine) isKeyword(s string) bool {
+	c := e.o.Current()
+	return c.Kind() == JackGrammar.KEYWORD && c.Content() == s
+}
+
+// expectSymbol consumes the symbol, or fails with an error like:
+// expected ';' after expression, found 'let'
+func (e *engine) expectSymbol(s, context string) Token.Token {
+	if !e.isSymbol(s) {
+		e.fail("expected '%s' %s, found %s", s, context, e.found())
+	}
+	return e.advance()
+}
+
+func (e *engine) expectKeyword(s, context string) Token.Token {
+	if !e.isKeyword(s) {
+		e.fail("expected '%s' %s, found %s", s, context, e.found())
+	}
+	return e.advance()
+}
+
+// expectIdentifier consumes an identifier and returns it.  The "what"
+// is the kind of name it should be, like "variable name".
+func (e *engine) expectIdentifier(what, context string) Token.Token {
+	if e.o.Current().Kind() != JackGrammar.IDENTIFIER {
+		e.fail("expected %s %s, found %s", what, context, e.found())
+	}
+	return e.advance()
+}
+
+// expectType consumes a type and returns it.
+// type = 'int' | 'char' | 'boolean' | className
+func (e *engine) expectType(context string) string {
+	c := e.o.Current()
+	switch {
+	case c.Kind() == JackGrammar.IDENTIFIER:
+	case c.Kind() == JackGrammar.KEYWORD && (c.Content() == "int" || c.Content() == "char" || c.Content() == "boolean"):
+	default:
+		e.fail("expected a type %s, found %s", context, e.found())
+	}
+	e.advance()
+	return c.Content()
+}
+
+// startsTerm returns true if the current token can be the beginning of
+// a term.
+func (e *engine) startsTerm() bool {
+	c := e.o.Current()
+	switch c.Kind() {
+	case JackGrammar.INT_CONST, JackGrammar.STRING_CONST, JackGrammar.IDENTIFIER:
+		return true
+	case JackGrammar.KEYWORD:
+		switch c.Content() {
+		case "true", "false", "null", "this":
+			return true
+		}
+	case JackGrammar.SYMBOL:
+		switch c.Content() {
+		case "(", "-", "~":
+			return true
+		}
+	}
+	return false
+}
+
+// recoverStatement compiles a statement.  If there is a syntax error,
+// it skips to the end of the statement, or to the next thing that
+// looks like the start of a statement or declaration.
+func (e *engine) recoverStatement(compile func()) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if _, ok := r.(syntaxError); !ok {
+			panic(r)
+		}
+		for !e.atEOF() {
+			c := e.o.Current().Content()
+			if e.isSymbol(";") {
+				e.o.Advance()
+				return
+			}
+			if e.isSymbol("}") {
+				return
+			}
+			if e.o.Current().Kind() == JackGrammar.KEYWORD {
+				switch c {
+				case "let", "if", "while", "do", "return", "var",
+					"static", "field", "constructor", "function", "method":
+					return
+				}
+			}
+			e.o.Advance()
+		}
+	}()
+	compile()
+}
+
+// recoverDeclaration compiles a class variable or subroutine
+// declaration.  If there is a syntax error, it skips to the next
+// declaration, or to the '}' that closes the class.  Braces are counted
+// so that the skipping doesn't stop inside of a subroutine body.
+func (e *engine) recoverDeclaration(compile func()) {
+	start := e.o.Current()
+	braces := e.braces
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if _, ok := r.(syntaxError); !ok {
+			panic(r)
+		}
+		depth := e.braces - braces
+		skip := func() {
+			switch {
+			case e.isSymbol("{"):
+				depth++
+			case e.isSymbol("}"):
+				depth--
+			}
+			e.o.Advance()
+		}
+		if e.o.Current() == start {
+			skip() // always skip at least one token.
+		}
+		for !e.atEOF() {
+			if depth <= 0 && (e.hasClassVarDec() || e.hasSubroutineDec()) {
+				return
+			}
+			if depth <= 0 && e.isSymbol("}") {
+				return
+			}
+			skip()
+		}
+	}()
+	compile()
+}
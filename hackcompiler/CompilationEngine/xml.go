@@ -0,0 +1,273 @@
+package CompilationEngine
+
+import (
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/AST"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/CompilationEngine/ParseTree"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/JackGrammar"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
+	"strconv"
+)
+
+// xmlPrinter is the pass that turns the syntax tree back into the XML
+// parse tree from the nand2tetris book.  The tokens that the syntax tree
+// doesn't keep, like the semicolons, are put back in where the grammar
+// says they go.
+type xmlPrinter struct {
+	t ParseTree.ParseTree
+}
+
+// PrintXML returns the parse tree of the class as XML.
+func PrintXML(c *AST.ClassDecl) ParseTree.ParseTree {
+	p := &xmlPrinter{t: ParseTree.NewParseTree("class")}
+	c.Accept(p)
+	return p.t.Root()
+}
+
+func (p *xmlPrinter) leaf(kind, content string) {
+	p.t.Leaf(Token.NewToken(kind, content))
+}
+
+func (p *xmlPrinter) keyword(s string)    { p.leaf(JackGrammar.KEYWORD, s) }
+func (p *xmlPrinter) symbol(s string)     { p.leaf(JackGrammar.SYMBOL, s) }
+func (p *xmlPrinter) identifier(s string) { p.leaf(JackGrammar.IDENTIFIER, s) }
+
+// typeName writes a type, which is a keyword for the built in types,
+// and the class name for everything else.
+func (p *xmlPrinter) typeName(s string) {
+	switch s {
+	case "int", "char", "boolean", "void":
+		p.keyword(s)
+	default:
+		p.identifier(s)
+	}
+}
+
+func (p *xmlPrinter) branch(name string, f func()) {
+	p.t = p.t.Branch(name)
+	f()
+	p.t = p.t.Up()
+}
+
+func (p *xmlPrinter) names(list []*AST.Ident) {
+	for i, name := range list {
+		if i > 0 {
+			p.symbol(",")
+		}
+		p.identifier(name.Name)
+	}
+}
+
+func (p *xmlPrinter) VisitClass(c *AST.ClassDecl) {
+	p.keyword("class")
+	p.identifier(c.Name)
+	p.symbol("{")
+	for _, v := range c.Vars {
+		v.Accept(p)
+	}
+	for _, s := range c.Subroutines {
+		s.Accept(p)
+	}
+	p.symbol("}")
+}
+
+func (p *xmlPrinter) VisitClassVar(v *AST.ClassVarDecl) {
+	p.branch("classVarDec", func() {
+		p.keyword(v.Kind)
+		p.typeName(v.Type)
+		p.names(v.Names)
+		p.symbol(";")
+	})
+}
+
+func (p *xmlPrinter) VisitSubroutine(s *AST.SubroutineDecl) {
+	p.branch("subroutineDec", func() {
+		p.keyword(s.Kind)
+		p.typeName(s.ReturnType)
+		p.identifier(s.Name)
+		p.symbol("(")
+		p.branch("parameterList", func() {
+			for i, param := range s.Params {
+				if i > 0 {
+					p.symbol(",")
+				}
+				p.typeName(param.Type)
+				p.identifier(param.Name)
+			}
+		})
+		p.symbol(")")
+		p.branch("subroutineBody", func() {
+			p.symbol("{")
+			for _, v := range s.Locals {
+				v.Accept(p)
+			}
+			p.statements(s.Body)
+			p.symbol("}")
+		})
+	})
+}
+
+func (p *xmlPrinter) VisitVar(v *AST.VarDecl) {
+	p.branch("varDec", func() {
+		p.keyword("var")
+		p.typeName(v.Type)
+		p.names(v.Names)
+		p.symbol(";")
+	})
+}
+
+func (p *xmlPrinter) statements(list []AST.Stmt) {
+	p.branch("statements", func() {
+		for _, s := range list {
+			s.Accept(p)
+		}
+	})
+}
+
+func (p *xmlPrinter) VisitLet(s *AST.LetStmt) {
+	p.branch("letStatement", func() {
+		p.keyword("let")
+		p.identifier(s.Name.Name)
+		if s.Index != nil {
+			p.symbol("[")
+			p.expression(s.Index)
+			p.symbol("]")
+		}
+		p.symbol("=")
+		p.expression(s.Value)
+		p.symbol(";")
+	})
+}
+
+func (p *xmlPrinter) VisitIf(s *AST.IfStmt) {
+	p.branch("ifStatement", func() {
+		p.keyword("if")
+		p.symbol("(")
+		p.expression(s.Cond)
+		p.symbol(")")
+		p.symbol("{")
+		p.statements(s.Then)
+		p.symbol("}")
+		if s.HasElse {
+			p.keyword("else")
+			p.symbol("{")
+			p.statements(s.Else)
+			p.symbol("}")
+		}
+	})
+}
+
+func (p *xmlPrinter) VisitWhile(s *AST.WhileStmt) {
+	p.branch("whileStatement", func() {
+		p.keyword("while")
+		p.symbol("(")
+		p.expression(s.Cond)
+		p.symbol(")")
+		p.symbol("{")
+		p.statements(s.Body)
+		p.symbol("}")
+	})
+}
+
+func (p *xmlPrinter) VisitDo(s *AST.DoStmt) {
+	p.branch("doStatement", func() {
+		p.keyword("do")
+		p.call(s.Call)
+		p.symbol(";")
+	})
+}
+
+func (p *xmlPrinter) VisitReturn(s *AST.ReturnStmt) {
+	p.branch("returnStatement", func() {
+		p.keyword("return")
+		if s.Value != nil {
+			p.expression(s.Value)
+		}
+		p.symbol(";")
+	})
+}
+
+// expression writes an <expression>.  Binary expressions are written
+// as a flat list of terms with operators in between, the same way that
+// they are written in the source code.
+func (p *xmlPrinter) expression(x AST.Expr) {
+	p.branch("expression", func() {
+		x.Accept(p)
+	})
+}
+
+// VisitBinary is only called from inside of an <expression>, so it
+// writes the left side, which might be more binary expressions, and
+// then the operator and the term on the right.
+func (p *xmlPrinter) VisitBinary(n *AST.BinaryExpr) {
+	n.X.Accept(p)
+	p.symbol(n.Op)
+	n.Y.Accept(p)
+}
+
+// term writes a <term> around whatever f writes.
+func (p *xmlPrinter) term(f func()) {
+	p.branch("term", f)
+}
+
+func (p *xmlPrinter) VisitInt(n *AST.IntLit) {
+	p.term(func() { p.leaf(JackGrammar.INT_CONST, strconv.Itoa(n.Value)) })
+}
+
+func (p *xmlPrinter) VisitString(n *AST.StringLit) {
+	p.term(func() { p.leaf(JackGrammar.STRING_CONST, n.Value) })
+}
+
+func (p *xmlPrinter) VisitKeyword(n *AST.KeywordLit) {
+	p.term(func() { p.keyword(n.Value) })
+}
+
+func (p *xmlPrinter) VisitVarExpr(n *AST.VarExpr) {
+	p.term(func() { p.identifier(n.Name) })
+}
+
+func (p *xmlPrinter) VisitIndex(n *AST.IndexExpr) {
+	p.term(func() {
+		p.identifier(n.Name)
+		p.symbol("[")
+		p.expression(n.Index)
+		p.symbol("]")
+	})
+}
+
+func (p *xmlPrinter) VisitCall(n *AST.CallExpr) {
+	p.term(func() { p.call(n) })
+}
+
+// call writes a subroutineCall, which doesn't have a tag of its own.
+func (p *xmlPrinter) call(n *AST.CallExpr) {
+	if n.Receiver != "" {
+		p.identifier(n.Receiver)
+		p.symbol(".")
+	}
+	p.identifier(n.Name)
+	p.symbol("(")
+	p.branch("expressionList", func() {
+		for i, arg := range n.Args {
+			if i > 0 {
+				p.symbol(",")
+			}
+			p.expression(arg)
+		}
+	})
+	p.symbol(")")
+}
+
+func (p *xmlPrinter) VisitUnary(n *AST.UnaryExpr) {
+	p.term(func() {
+		p.symbol(n.Op)
+		n.X.Accept(p)
+	})
+}
+
+func (p *xmlPrinter) VisitParen(n *AST.ParenExpr) {
+	p.term(func() {
+		p.symbol("(")
+		p.expression(n.X)
+		p.symbol(")")
+	})
+}
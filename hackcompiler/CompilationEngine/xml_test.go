@@ -0,0 +1,61 @@
+package CompilationEngine
+
+import (
+	"bytes"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/JackTokenizer"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The XML printer should give the same parse trees as the ones in the
+// expected folders, which come from the nand2tetris book.
+func TestPrintXML(t *testing.T) {
+	for name, src := range loadTestFiles(t) {
+		expected := filepath.Join(filepath.Dir(name), "expected", strings.TrimSuffix(filepath.Base(name), ".jack")+".xml")
+		b, err := ioutil.ReadFile(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		class, diags := Parse(name, strings.NewReader(src))
+		if HasErrors(diags) {
+			t.Fatalf("%s: %v", name, diags)
+		}
+		want := strings.Split(strings.TrimSpace(strings.Replace(string(b), "\r", "", -1)), "\n")
+		got := strings.Split(strings.TrimSpace(PrintXML(class).String()), "\n")
+		if len(got) != len(want) {
+			t.Errorf("%s: got %d lines, expected %d", name, len(got), len(want))
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s:%d: got:(%s), expected:(%s)", name, i+1, got[i], want[i])
+				break
+			}
+		}
+	}
+}
+
+// The diagnostics from Run should name the file, the same as Compile.
+func TestRunDiagnosticsHaveFilename(t *testing.T) {
+	src := "class Main {\n  function void main() {\n    return\n  }\n}"
+	for _, opt := range []OPTION{OP_XML, OP_SYM_TBL} {
+		diags := Run(new(bytes.Buffer), JackTokenizer.Create(strings.NewReader(src)), "Main.jack", opt)
+		want := "Main.jack:4:3: expected ';' after return statement, found '}'"
+		if len(diags) == 0 || diags[0].String() != want {
+			t.Errorf("got:(%v), expected:(%s)", diags, want)
+		}
+	}
+}
+
+// The symbol tables go through the same passes as Compile, so a class
+// that Compile rejects doesn't get any symbol tables.
+func TestRunSymbolTablesAreChecked(t *testing.T) {
+	src := "class Main {\n  function void main() {\n    var String s;\n    let s = 1;\n    return;\n  }\n}"
+	w := new(bytes.Buffer)
+	diags := RunWithOptions(w, JackTokenizer.Create(strings.NewReader(src)), "Main.jack", OP_SYM_TBL, Options{Optimize: true})
+	if !HasErrors(diags) || w.Len() != 0 {
+		t.Errorf("got:(%v) and %q, expected an error and no output", diags, w.String())
+	}
+}
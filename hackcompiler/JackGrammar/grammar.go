@@ -25,7 +25,8 @@ Extra Constants
 
 Additional constants that are not included in the Jack Grammar
 have been added to this package for usage by the tokenizer and parser.
-Specifically, those are UNKNOWN, INVALID, and TERMINAL.
+Specifically, those are UNKNOWN, INVALID, TERMINAL, and EOF.  EOF is the
+kind of token the parser sees after the last real token.
 
 Normally, all the constants here would be enumerated, but for
 the sake of simplicity of this project, they are treated as constant strings.
@@ -43,6 +44,7 @@ const (
 	UNKNOWN      = "?"
 	INVALID      = "!INVALID!"
 	TERMINAL     = "terminal"
+	EOF          = "EOF"
 )
 
 // The symbols are single character "runes".
@@ -1,26 +1,40 @@
 package JackTokenizer
 
 import (
+	"fmt"
 	"github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
 	"io"
-	"io/ioutil"
 )
 
 // TokenIterator advances through each of the tokens in the source file,
-// after it has been initialized.  Should use the command "NewTokenIterator"
+// after it has been initialized.  Should use the command "Create"
 // to initialize the token iterator.
+//
+// After the last token, Current returns a token with the kind
+// JackGrammar.EOF.  Problems found while scanning, like an unterminated
+// string, are collected in Errors.
 type TokenIterator interface {
 	HasMoreTokens() bool
 	Advance()
 	Current() Token.Token
+	Errors() []Error
 }
 
-// NewTokenIterator takes a reader (which should contain the source code), and returns
+// Error is a problem found by the scanner.
+type Error struct {
+	Line, Column int
+	Message      string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+// Create takes a reader (which should contain the source code), and returns
 // an interface that allows the user to advance through the tokens in the source code.
+// The source is read a little at a time, as the tokens are needed.
 func Create(r io.Reader) TokenIterator {
-	b, err := ioutil.ReadAll(r)
-	if err != nil {
-		panic(err)
-	}
-	return createTokenIteratorFromString(string(b))
+	ti := &tokenIterator{s: newScanner(r)}
+	ti.Advance()
+	return ti
 }
@@ -1,39 +1,34 @@
 package JackTokenizer
 
-import "github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
-
-// import "fmt"
+import (
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/JackGrammar"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
+)
 
+// tokenIterator only keeps the current token, and asks the scanner for
+// the next one when it advances.
 type tokenIterator struct {
-	token_list          []Token.Token
-	current_token_index int
-}
-
-func createTokenIteratorFromString(s string) *tokenIterator {
-	ti := new(tokenIterator)
-	ti.token_list = tokenize(s)
-	// fmt.Println("Total number of tokens:", len(ti.token_list))
-	return ti
+	s       *scanner
+	current Token.Token
 }
 
 func (ti *tokenIterator) Advance() {
-	if ti.HasMoreTokens() {
-		ti.current_token_index++
+	if ti.current != nil && ti.current.Kind() == JackGrammar.EOF {
 		return
 	}
-	// panic("Tried to Advance to the next token, but the Token Iterator has already reached it's last token.")
+	ti.current = ti.s.Scan()
 }
 
+// Current returns the current token.  After the last token, it returns
+// an EOF token instead, so the parser can report what it was expecting.
 func (ti *tokenIterator) Current() Token.Token {
-	return ti.token_list[ti.current_token_index]
+	return ti.current
 }
 
 func (ti *tokenIterator) HasMoreTokens() bool {
-	if len(ti.token_list) <= 0 {
-		return false
-	}
-	if ti.current_token_index < len(ti.token_list) {
-		return true
-	}
-	return false
+	return ti.current.Kind() != JackGrammar.EOF
+}
+
+func (ti *tokenIterator) Errors() []Error {
+	return ti.s.errs
 }
@@ -0,0 +1,256 @@
+package JackTokenizer
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/JackGrammar"
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/Token"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The largest integer constant allowed in Jack.
+const max_int = 32767
+
+// eof is returned by next() and peek() when there is nothing left to read.
+const eof = -1
+
+// scanner reads runes from the source code and groups them into tokens.
+// It keeps track of the line and column of each rune, so that every
+// token knows where it came from.
+//
+// Whitespace of any kind separates tokens.  Comments are skipped.
+// When something is wrong, like a string that is never closed, the
+// scanner records an error and keeps going, so that the parser can
+// still report its own errors.
+type scanner struct {
+	r    *bufio.Reader
+	errs []Error
+
+	// position of the next rune that next() will return.
+	line, column int
+
+	// one rune of look-ahead.
+	peeked    rune
+	hasPeeked bool
+}
+
+func newScanner(r io.Reader) *scanner {
+	return &scanner{
+		r:      bufio.NewReader(r),
+		line:   1,
+		column: 1,
+	}
+}
+
+func (s *scanner) errorf(line, column int, format string, a ...interface{}) {
+	s.errs = append(s.errs, Error{
+		Line:    line,
+		Column:  column,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// peek returns the next rune without moving past it.
+func (s *scanner) peek() rune {
+	if s.hasPeeked {
+		return s.peeked
+	}
+	r, _, err := s.r.ReadRune()
+	if err != nil {
+		if err != io.EOF {
+			s.errorf(s.line, s.column, "%v", err)
+		}
+		r = eof
+	}
+	s.peeked = r
+	s.hasPeeked = true
+	return r
+}
+
+// next returns the next rune and moves past it.
+func (s *scanner) next() rune {
+	r := s.peek()
+	if r == eof {
+		return eof
+	}
+	s.hasPeeked = false
+	if r == '\n' {
+		s.line++
+		s.column = 1
+	} else {
+		s.column++
+	}
+	return r
+}
+
+// Scan returns the next token.  At the end of the source code, it
+// returns a token with the kind JackGrammar.EOF.
+func (s *scanner) Scan() Token.Token {
+	if !s.skipSpaceAndComments() {
+		return s.token(JackGrammar.EOF, "", s.line, s.column)
+	}
+	line, column := s.line, s.column
+	r := s.peek()
+	switch {
+	case r == '"':
+		return s.scanString()
+	case isSymbol(r):
+		s.next()
+		return s.token(JackGrammar.SYMBOL, string(r), line, column)
+	case isWordRune(r):
+		return s.scanWord()
+	}
+	s.next()
+	s.errorf(line, column, "unexpected character %q", r)
+	return s.token(JackGrammar.INVALID, string(r), line, column)
+}
+
+// token creates a token that started at line and column, and ended on
+// the rune just before the current position.
+func (s *scanner) token(kind, content string, line, column int) Token.Token {
+	end_line, end_column := s.line, s.column-1
+	if kind == JackGrammar.EOF {
+		end_line, end_column = line, column
+	}
+	return Token.NewTokenAt(kind, content, Token.Span{
+		Line:      line,
+		Column:    column,
+		EndLine:   end_line,
+		EndColumn: end_column,
+	})
+}
+
+// skipSpaceAndComments moves past anything that isn't a token.  Returns
+// false when the end of the file has been reached.
+func (s *scanner) skipSpaceAndComments() bool {
+	for {
+		r := s.peek()
+		switch {
+		case r == eof:
+			return false
+		case unicode.IsSpace(r):
+			s.next()
+		case r == '/':
+			// Look one byte past the '/', to see if it starts a comment.
+			b, _ := s.r.Peek(1)
+			if len(b) == 0 || (b[0] != '/' && b[0] != '*') {
+				return true // it's the division symbol.
+			}
+			line, column := s.line, s.column
+			s.next()
+			if s.next() == '/' {
+				for r := s.next(); r != '\n' && r != eof; r = s.next() {
+				}
+				continue
+			}
+			s.skipBlockComment(line, column)
+		default:
+			return true
+		}
+	}
+}
+
+// skipBlockComment moves past the end of a /* comment */.
+func (s *scanner) skipBlockComment(line, column int) {
+	for {
+		switch s.next() {
+		case eof:
+			s.errorf(line, column, "comment is never closed")
+			return
+		case '*':
+			if s.peek() == '/' {
+				s.next()
+				return
+			}
+		}
+	}
+}
+
+// scanString scans a string constant.  Strings can't have newlines in
+// them, so a string that reaches the end of the line was never closed.
+// The quotation marks are not part of the content.
+func (s *scanner) scanString() Token.Token {
+	line, column := s.line, s.column
+	s.next() // opening "
+	var b strings.Builder
+	for {
+		r := s.peek()
+		if r == '\n' || r == eof {
+			s.errorf(line, column, "string is never closed")
+			break
+		}
+		s.next()
+		if r == '"' {
+			break
+		}
+		b.WriteRune(r)
+	}
+	return s.token(JackGrammar.STRING_CONST, b.String(), line, column)
+}
+
+// scanWord scans a keyword, identifier, or integer constant.
+func (s *scanner) scanWord() Token.Token {
+	line, column := s.line, s.column
+	var b strings.Builder
+	for isWordRune(s.peek()) {
+		b.WriteRune(s.next())
+	}
+	word := b.String()
+	if isKeyword(word) {
+		return s.token(JackGrammar.KEYWORD, word, line, column)
+	}
+	if !isDigit(rune(word[0])) {
+		return s.token(JackGrammar.IDENTIFIER, word, line, column)
+	}
+	n, err := strconv.Atoi(word)
+	switch {
+	case err != nil && isDigits(word):
+		s.errorf(line, column, "integer constant %s is too large, it must be between 0 and %d", word, max_int)
+	case err != nil:
+		s.errorf(line, column, "identifier %s can't start with a digit", word)
+		return s.token(JackGrammar.INVALID, word, line, column)
+	case n > max_int:
+		s.errorf(line, column, "integer constant %s is too large, it must be between 0 and %d", word, max_int)
+	}
+	return s.token(JackGrammar.INT_CONST, word, line, column)
+}
+
+func isSymbol(r rune) bool {
+	for _, sym := range JackGrammar.LIST_OF_SYMBOLS {
+		if r == sym {
+			return true
+		}
+	}
+	return false
+}
+
+func isKeyword(s string) bool {
+	for _, keyword := range JackGrammar.LIST_OF_KEYWORDS {
+		if s == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// isWordRune returns true for runes that can be in an identifier,
+// keyword, or integer.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if !isDigit(r) {
+			return false
+		}
+	}
+	return true
+}
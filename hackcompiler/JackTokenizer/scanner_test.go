@@ -0,0 +1,71 @@
+package JackTokenizer
+
+import (
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/JackGrammar"
+	"strings"
+	"testing"
+)
+
+func TestScanner(t *testing.T) {
+	src := "let\tx=1;\r\nreturn\nx / y; // comment\n/* more\n comment */ \"a b\""
+	want := []struct {
+		kind, content string
+		line, column  int
+	}{
+		{JackGrammar.KEYWORD, "let", 1, 1},
+		{JackGrammar.IDENTIFIER, "x", 1, 5},
+		{JackGrammar.SYMBOL, "=", 1, 6},
+		{JackGrammar.INT_CONST, "1", 1, 7},
+		{JackGrammar.SYMBOL, ";", 1, 8},
+		{JackGrammar.KEYWORD, "return", 2, 1},
+		{JackGrammar.IDENTIFIER, "x", 3, 1},
+		{JackGrammar.SYMBOL, "/", 3, 3},
+		{JackGrammar.IDENTIFIER, "y", 3, 5},
+		{JackGrammar.SYMBOL, ";", 3, 6},
+		{JackGrammar.STRING_CONST, "a b", 5, 13},
+		{JackGrammar.EOF, "", 5, 18},
+	}
+	ti := Create(strings.NewReader(src))
+	for i, w := range want {
+		tok := ti.Current()
+		span := tok.Span()
+		if tok.Kind() != w.kind || tok.Content() != w.content || span.Line != w.line || span.Column != w.column {
+			t.Errorf("token %d: got %s %q at %d:%d, expected %s %q at %d:%d",
+				i, tok.Kind(), tok.Content(), span.Line, span.Column,
+				w.kind, w.content, w.line, w.column)
+		}
+		ti.Advance()
+	}
+	if errs := ti.Errors(); len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestScannerErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"let s = \"abc\nreturn;", "1:9: string is never closed"},
+		{"x /* abc", "1:3: comment is never closed"},
+		{"let x = 32768;", "1:9: integer constant 32768 is too large, it must be between 0 and 32767"},
+		{"let 2x = 1;", "1:5: identifier 2x can't start with a digit"},
+		{"let x = #;", "1:9: unexpected character '#'"},
+	}
+	for _, test := range tests {
+		ti := Create(strings.NewReader(test.src))
+		for ti.HasMoreTokens() {
+			ti.Advance()
+		}
+		errs := ti.Errors()
+		if len(errs) != 1 || errs[0].Error() != test.err {
+			t.Errorf("%q: got %v, expected %s", test.src, errs, test.err)
+		}
+	}
+	ti := Create(strings.NewReader("let x = 32767;"))
+	for ti.HasMoreTokens() {
+		ti.Advance()
+	}
+	if errs := ti.Errors(); len(errs) > 0 {
+		t.Errorf("32767 should be allowed: %v", errs)
+	}
+}
@@ -13,13 +13,25 @@ var xml_symbol_replacements_table = map[string]string{
 
 // Token has a kind and content, the different kinds are
 // keyword, symbol, identifier, int_const, string_const"
+// The Span says where the token came from in the source file.
 type Token interface {
 	Kind() string
 	Content() string
+	Span() Span
+}
+
+// Span is the position of a token in the source file.  Lines and columns
+// count from 1, and columns count runes, so a tab is 1 column.  The end
+// is the position of the last rune in the token.  A zero Span means the
+// position isn't known.
+type Span struct {
+	Line, Column       int
+	EndLine, EndColumn int
 }
 
 type token struct {
 	kind, content string
+	span          Span
 }
 
 func NewToken(kind, content string) Token {
@@ -29,6 +41,15 @@ func NewToken(kind, content string) Token {
 	}
 }
 
+// NewTokenAt creates a token that knows where it is in the source file.
+func NewTokenAt(kind, content string, span Span) Token {
+	return &token{
+		kind:    kind,
+		content: content,
+		span:    span,
+	}
+}
+
 func (t *token) Kind() string {
 	return t.kind
 }
@@ -37,6 +58,10 @@ func (t *token) Content() string {
 	return t.content
 }
 
+func (t *token) Span() Span {
+	return t.span
+}
+
 // Default string representation for the Token is XML.
 // Any symbols literals will be replaced with their XML equivalent.
 func (t *token) String() string {
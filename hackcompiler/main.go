@@ -16,7 +16,7 @@ import (
 const help_message = `
 Compiles Jack code into Hack Programs for Nand2Tetris.
 
-USAGE:         hackcompiler (<filename>|-wd) [option]
+USAGE:         hackcompiler (<filename>|-wd) [options]
 
 FILENAME FLAG:
 -wd            Uses all .jack files from the working directory.
@@ -26,6 +26,22 @@ OPTIONS:
 -p, --parse    print the parse tree as XML.
 -x, --xml      print tokens as XML, split by line.
 -s, --symbol   print symbol tables generated by parser.
+-n, --native   compile to VM code, using the extended "mul" and
+               "div" commands instead of calling Math.multiply
+               and Math.divide.  Only hackvmslate can run them.
+-O, --optimize compile to VM code, computing constant expressions
+               ahead of time, multiplying by powers of two with
+               additions, and leaving out branches that never run.
+               With -n, dividing by a power of two uses "shr",
+               and multiplying by 8 or more uses "shl".
+-P, --pool     compile to VM code, making each string constant only
+               once, and keeping it in a static variable.  Calling
+               dispose() on one of those strings breaks the others.
+-I, --no-intrinsics
+               compile to VM code, calling Memory.peek and
+               Memory.poke like any other function, the same way
+               as the book's compiler.  By default, they are
+               written inline, like array accesses.
 
 HOW TO USE:
 If no options are given, the default behavior is to compile
@@ -33,6 +49,12 @@ the source program to VM code, and print the VM code to stdout.
 Use "-wd" in place of the filename argument to iterate
 through each file in the working directory to use as input.
 Each input file creates one output file of the same name.
+When compiling VM code with "-wd", all of the files are compiled
+together, so that calls between the classes can be checked.
+
+Mistakes in the program are printed to stderr, with the file, line,
+and column.  Errors stop the compiler.  Warnings are for things that
+work, but are probably mistakes, like assigning a char to an int.
 `
 
 type Mode int
@@ -48,19 +70,60 @@ const (
 
 var using_wd bool = false
 
-func ParseAndCompile(w io.Writer, r io.Reader) {
-	tokenizer := JackTokenizer.Create(r)
-	CompilationEngine.Run(w, tokenizer, CompilationEngine.OP_CODE)
+// compile_options are set by the options given on the command line.
+var compile_options CompilationEngine.Options
+
+// ParseAndCompile compiles the source code into VM code.  Any problems
+// are printed to stderr, and errors stop the program.
+func ParseAndCompile(w io.Writer, r io.Reader, filename string) {
+	code, diags := CompilationEngine.CompileWithOptions(filepath.Base(filename), r, compile_options)
+	printDiagnostics(diags)
+	if CompilationEngine.HasErrors(diags) {
+		failrar("Could not compile", filename)
+	}
+	w.Write(code)
 }
 
-func DebugParse(w io.Writer, r io.Reader) {
+// CompileProject compiles all of the files together, so that calls
+// between the classes can be checked, and writes one .vm file for each
+// .jack file.  Nothing is written if there are any errors.
+func CompileProject(file_list []string) {
+	var files []CompilationEngine.Source
+	for _, filename := range file_list {
+		log.Println("In: ", filename)
+		input_file := OpenFile(filename)
+		defer input_file.Close()
+		files = append(files, CompilationEngine.Source{
+			Filename: filepath.Base(filename),
+			Src:      bufio.NewReader(input_file),
+		})
+	}
+	code, diags := CompilationEngine.CompileProgramWithOptions(files, compile_options)
+	printDiagnostics(diags)
+	if CompilationEngine.HasErrors(diags) {
+		failrar("Could not compile the project")
+	}
+	for i, filename := range file_list {
+		w := MakeFile(filename, ".vm")
+		w.Write(code[i])
+		w.Flush()
+	}
+}
+
+func printDiagnostics(diags []CompilationEngine.Diagnostic) {
+	for _, d := range diags {
+		fmt.Fprintln(os.Stderr, d)
+	}
+}
+
+func DebugParse(w io.Writer, r io.Reader, filename string) {
 	tokenizer := JackTokenizer.Create(r)
-	CompilationEngine.Run(w, tokenizer, CompilationEngine.OP_XML)
+	printDiagnostics(CompilationEngine.Run(w, tokenizer, filepath.Base(filename), CompilationEngine.OP_XML))
 }
 
-func ParseSymbolTables(w io.Writer, r io.Reader) {
+func ParseSymbolTables(w io.Writer, r io.Reader, filename string) {
 	tokenizer := JackTokenizer.Create(r)
-	CompilationEngine.Run(w, tokenizer, CompilationEngine.OP_SYM_TBL)
+	printDiagnostics(CompilationEngine.RunWithOptions(w, tokenizer, filepath.Base(filename), CompilationEngine.OP_SYM_TBL, compile_options))
 }
 
 func DebugTokens(r io.Reader) {
@@ -88,17 +151,21 @@ func HelpfulExit() {
 	os.Exit(1)
 }
 
-func ReadFullFile(filename string) io.Reader {
-	input_file_bytes, err := ioutil.ReadFile(filename)
+// OpenFile opens a source file.  The scanner reads it a little at a
+// time, so the whole file is never loaded into memory.
+func OpenFile(filename string) *os.File {
+	input_file, err := os.Open(filename)
 	if err != nil {
 		failrar(err)
 	}
-	return strings.NewReader(string(input_file_bytes))
+	return input_file
 }
 
 func handle(filename string, mode Mode) {
 	w := bufio.NewWriter(os.Stdout)
-	r := bufio.NewReader(ReadFullFile(filename))
+	input_file := OpenFile(filename)
+	defer input_file.Close()
+	r := bufio.NewReader(input_file)
 	switch mode {
 	case mode_tokens_debug:
 		DebugTokens(r)
@@ -114,17 +181,17 @@ func handle(filename string, mode Mode) {
 		if using_wd {
 			w = MakeFile(filename, ".xml")
 		}
-		DebugParse(w, r)
+		DebugParse(w, r, filename)
 		w.Flush()
 
 	case mode_symbol_table:
-		ParseSymbolTables(os.Stdout, r)
+		ParseSymbolTables(os.Stdout, r, filename)
 
 	case mode_vm_code:
 		if using_wd {
 			w = MakeFile(filename, ".vm")
 		}
-		ParseAndCompile(w, r)
+		ParseAndCompile(w, r, filename)
 		w.Flush()
 
 	default:
@@ -176,6 +243,10 @@ func MakeFile(input_filename, output_suffix string) *bufio.Writer {
 
 func MultiFile(mode Mode) {
 	file_list := GetJackFilesFromWorkingDir()
+	if mode == mode_vm_code {
+		CompileProject(file_list)
+		return
+	}
 	for _, filename := range file_list {
 		log.Println("In: ", filename)
 		handle(filename, mode)
@@ -190,31 +261,42 @@ func main() {
 	case "-h", "--help":
 		HelpfulExit()
 	}
-	if len(os.Args) > 3 {
-		fmt.Fprintln(os.Stderr, "Too many arguments.")
-		HelpfulExit()
-	}
-
-	option := ""
-	mode := mode_default
-	if len(os.Args) == 3 {
-		option = os.Args[2]
-	}
 
-	switch option {
-	case "-t", "--token":
-		mode = mode_tokens_debug
-	case "-x", "--xml":
-		mode = mode_tokens_xml
-	case "-p", "--parse":
-		mode = mode_parse_debug
-	case "-s", "--symbol":
-		mode = mode_symbol_table
-	case "":
-		mode = mode_vm_code
-	default:
-		fmt.Fprintln(os.Stderr, "Unknown option argument given.")
-		HelpfulExit()
+	// The options that change how VM code is compiled can be used
+	// together, like "-n -O", but only one kind of output can be
+	// chosen at a time.
+	mode := mode_vm_code
+	for _, option := range os.Args[2:] {
+		output := mode_default
+		switch option {
+		case "-t", "--token":
+			output = mode_tokens_debug
+		case "-x", "--xml":
+			output = mode_tokens_xml
+		case "-p", "--parse":
+			output = mode_parse_debug
+		case "-s", "--symbol":
+			output = mode_symbol_table
+		case "-n", "--native":
+			compile_options.NativeMath = true
+		case "-O", "--optimize":
+			compile_options.Optimize = true
+		case "-P", "--pool":
+			compile_options.PoolStrings = true
+		case "-I", "--no-intrinsics":
+			compile_options.NoIntrinsics = true
+		default:
+			fmt.Fprintln(os.Stderr, "Unknown option argument given:", option)
+			HelpfulExit()
+		}
+		if output == mode_default {
+			continue
+		}
+		if mode != mode_vm_code {
+			fmt.Fprintln(os.Stderr, "Only one of -t, -x, -p, and -s can be used at a time.")
+			HelpfulExit()
+		}
+		mode = output
 	}
 
 	switch os.Args[1] {
@@ -32,6 +32,8 @@ const (
 	NOT
 	MULT
 	DIV
+	SHL
+	SHR
 )
 
 var SegmentString = map[Segment]string{
@@ -59,6 +61,16 @@ var CommandString = map[Command]string{
 	DIV:  `call Math.divide 2`,
 }
 
+// NativeCommandString replaces CommandString when using native math.
+// The shifts only exist as extended commands, so they can only be
+// written when using native math.
+var NativeCommandString = map[Command]string{
+	MULT: "mul",
+	DIV:  "div",
+	SHL:  "shl",
+	SHR:  "shr",
+}
+
 var mapSymbolToCmd = map[string]Command{
 	"+": ADD,
 	"-": SUB,
@@ -85,14 +97,21 @@ type VMWriter interface {
 	WriteReturn()
 }
 
-func NewVMWriter(w io.Writer) VMWriter {
+// NewVMWriter returns a VMWriter that writes to w.  If native_math is
+// true, it writes the extended "mul" and "div" commands instead of
+// calling Math.multiply and Math.divide.  They are much faster, but
+// only hackvmslate understands them.  The VM Emulator from the course
+// does not.
+func NewVMWriter(w io.Writer, native_math bool) VMWriter {
 	return &vmWriter{
-		w: w,
+		w:           w,
+		native_math: native_math,
 	}
 }
 
 type vmWriter struct {
-	w io.Writer
+	w           io.Writer
+	native_math bool
 }
 
 func (vw *vmWriter) WritePush(seg Segment, n int) {
@@ -102,6 +121,10 @@ func (vw *vmWriter) WritePop(seg Segment, n int) {
 	fmt.Fprintln(vw.w, "pop", SegmentString[seg], n)
 }
 func (vw *vmWriter) WriteArithmetic(cmd Command) {
+	if s, ok := NativeCommandString[cmd]; ok && vw.native_math {
+		fmt.Fprintln(vw.w, s)
+		return
+	}
 	fmt.Fprintln(vw.w, CommandString[cmd])
 }
 func (vw *vmWriter) WriteLabel(label string) {
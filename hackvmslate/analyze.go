@@ -0,0 +1,299 @@
+// Call Graph Analysis
+//
+// "hackvmslate analyze" reads the .vm files, but instead of translating
+// them, it builds a graph of which functions call which.  The graph can
+// be exported as DOT (for graphviz) or JSON.
+//
+// The analysis also finds the worst case depth of the stack.  The stack
+// starts at 256, and the heap starts at 2048, so a program that pushes
+// more than 1792 words will silently overwrite the heap.
+//
+// The depth of a function is the most words it can put on the stack,
+// counting its locals, its working stack, and everything pushed by the
+// functions it calls (including their 5-word frames).  Recursive
+// functions have no limit, so their depth is unbounded.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	stack_base    = 256  // where the bootstrap code starts the stack.
+	heap_base     = 2048 // the first register of the heap.
+	frame_size    = 5    // return address, LCL, ARG, THIS, THAT.
+	unbounded     = -1   // the depth of a recursive function.
+	not_evaluated = -2
+)
+
+// FunctionInfo is a single node in the call graph.
+type FunctionInfo struct {
+	Name      string   `json:"name"`
+	File      string   `json:"file"`
+	Line      int      `json:"line"`
+	Locals    int      `json:"locals"`
+	Calls     []string `json:"calls"`
+	Recursive bool     `json:"recursive"`
+	Balanced  bool     `json:"balanced"`
+	Depth     int      `json:"depth"`
+}
+
+// CallGraph holds each function of a program, in their original order.
+type CallGraph struct {
+	Functions []*FunctionInfo `json:"functions"`
+	Undefined []string        `json:"undefined"`
+	Cycles    [][]string      `json:"cycles"`
+	MaxSP     int             `json:"max_sp"`
+
+	bodies map[string]Program
+	lookup map[string]*FunctionInfo
+}
+
+// Analyze builds the call graph of a program, finds the recursive
+// functions, and works out the depth of the stack for each function.
+func Analyze(p Program) *CallGraph {
+	g := &CallGraph{
+		bodies: make(map[string]Program),
+		lookup: make(map[string]*FunctionInfo),
+		MaxSP:  unbounded,
+	}
+	for _, body := range splitFunctions(p) {
+		if body[0].Kind != C_FUNCTION {
+			continue
+		}
+		f := &FunctionInfo{
+			Name:   body[0].Arg1,
+			File:   body[0].File,
+			Line:   body[0].Line,
+			Locals: body[0].Arg2,
+			Depth:  not_evaluated,
+		}
+		seen := make(map[string]bool)
+		for _, cmd := range body {
+			if cmd.Kind == C_CALL && !seen[cmd.Arg1] {
+				seen[cmd.Arg1] = true
+				f.Calls = append(f.Calls, cmd.Arg1)
+			}
+		}
+		g.Functions = append(g.Functions, f)
+		g.bodies[f.Name] = body
+		g.lookup[f.Name] = f
+	}
+
+	// Calls to functions that don't exist.
+	undefined := make(map[string]bool)
+	for _, f := range g.Functions {
+		for _, name := range f.Calls {
+			if _, ok := g.lookup[name]; !ok && !undefined[name] {
+				undefined[name] = true
+				g.Undefined = append(g.Undefined, name)
+			}
+		}
+	}
+
+	g.findCycles()
+	for _, f := range g.Functions {
+		g.depth(f)
+	}
+	if f, ok := g.lookup[entry_function]; ok && f.Depth != unbounded {
+		g.MaxSP = stack_base + frame_size + f.Depth
+	}
+	return g
+}
+
+// findCycles uses Tarjan's algorithm to find the strongly connected
+// parts of the graph.  Each function in a cycle, or that calls itself,
+// is recursive.
+func (g *CallGraph) findCycles() {
+	index := make(map[string]int)
+	low := make(map[string]int)
+	on_stack := make(map[string]bool)
+	var stack []string
+	counter := 0
+
+	var connect func(name string)
+	connect = func(name string) {
+		index[name] = counter
+		low[name] = counter
+		counter++
+		stack = append(stack, name)
+		on_stack[name] = true
+		for _, next := range g.lookup[name].Calls {
+			if _, ok := g.lookup[next]; !ok {
+				continue
+			}
+			if _, visited := index[next]; !visited {
+				connect(next)
+				if low[next] < low[name] {
+					low[name] = low[next]
+				}
+			} else if on_stack[next] && index[next] < low[name] {
+				low[name] = index[next]
+			}
+		}
+		if low[name] != index[name] {
+			return
+		}
+		var cycle []string
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			on_stack[top] = false
+			cycle = append(cycle, top)
+			if top == name {
+				break
+			}
+		}
+		if len(cycle) > 1 || g.calls(name, name) {
+			sort.Strings(cycle)
+			for _, member := range cycle {
+				g.lookup[member].Recursive = true
+			}
+			g.Cycles = append(g.Cycles, cycle)
+		}
+	}
+	for _, f := range g.Functions {
+		if _, visited := index[f.Name]; !visited {
+			connect(f.Name)
+		}
+	}
+}
+
+// calls returns true if the function "from" directly calls "to".
+func (g *CallGraph) calls(from, to string) bool {
+	for _, name := range g.lookup[from].Calls {
+		if name == to {
+			return true
+		}
+	}
+	return false
+}
+
+// depth works out the most words the function can put on the stack.
+// Calls to undefined functions are counted as just the frame.
+func (g *CallGraph) depth(f *FunctionInfo) int {
+	if f.Depth != not_evaluated {
+		return f.Depth
+	}
+	if f.Recursive {
+		f.Depth = unbounded
+		return f.Depth
+	}
+	peak := 0
+	bounded := true
+	f.Balanced = walkStack(g.bodies[f.Name], func(cmd *Command, depth int) {
+		if depth > peak {
+			peak = depth
+		}
+		if cmd.Kind != C_CALL {
+			return
+		}
+		callee_depth := 0
+		if callee, ok := g.lookup[cmd.Arg1]; ok {
+			callee_depth = g.depth(callee)
+		}
+		if callee_depth == unbounded {
+			bounded = false
+			return
+		}
+		if depth+frame_size+callee_depth > peak {
+			peak = depth + frame_size + callee_depth
+		}
+	})
+	f.Depth = unbounded
+	if bounded {
+		f.Depth = f.Locals + peak
+	}
+	return f.Depth
+}
+
+// PrintReport writes a summary of the analysis for people to read.
+func (g *CallGraph) PrintReport(w io.Writer) {
+	n := 0
+	for _, f := range g.Functions {
+		n += len(f.Calls)
+	}
+	fmt.Fprintf(w, "Call Graph: %d functions, %d calls between them.\n", len(g.Functions), n)
+
+	if len(g.Undefined) > 0 {
+		fmt.Fprintln(w, "\nUndefined functions:")
+		for _, name := range g.Undefined {
+			fmt.Fprintln(w, "  "+name)
+		}
+	}
+
+	if len(g.Cycles) > 0 {
+		fmt.Fprintln(w, "\nRecursive functions:")
+		for _, cycle := range g.Cycles {
+			fmt.Fprintln(w, " ", cycle)
+		}
+	}
+
+	fmt.Fprintln(w, "\nStack depth of each function (locals, working stack, and calls):")
+	for _, f := range g.Functions {
+		depth := fmt.Sprint(f.Depth)
+		if f.Depth == unbounded {
+			depth = "unbounded"
+		}
+		note := ""
+		if !f.Balanced && !f.Recursive {
+			note = "  (stack is not balanced, depth is a guess)"
+		}
+		fmt.Fprintf(w, "  %-30s %9s%s\n", f.Name, depth, note)
+	}
+
+	fmt.Fprintln(w)
+	if _, ok := g.lookup[entry_function]; !ok {
+		fmt.Fprintln(w, "There is no Sys.init, so the depth of the whole program is unknown.")
+		return
+	}
+	if g.MaxSP == unbounded {
+		fmt.Fprintln(w, "WARNING: Sys.init can reach a recursive function, so the stack has no limit.")
+		return
+	}
+	fmt.Fprintf(w, "Worst case: the stack pointer reaches %d (the heap starts at %d).\n", g.MaxSP, heap_base)
+	if g.MaxSP > heap_base {
+		fmt.Fprintln(w, "WARNING: the stack can overflow into the heap!")
+	}
+}
+
+// WriteDOT writes the call graph in the DOT language, which can be
+// drawn using graphviz.  Recursive functions are colored red.
+func (g *CallGraph) WriteDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph calls {")
+	fmt.Fprintln(w, "  node [shape=box];")
+	for _, f := range g.Functions {
+		label := fmt.Sprintf(`%s\ndepth %d`, f.Name, f.Depth)
+		if f.Depth == unbounded {
+			label = f.Name + `\nrecursive`
+		}
+		color := ""
+		if f.Recursive {
+			color = ", color=red"
+		}
+		fmt.Fprintf(w, "  \"%s\" [label=\"%s\"%s];\n", f.Name, label, color)
+	}
+	for _, name := range g.Undefined {
+		fmt.Fprintf(w, "  \"%s\" [style=dashed];\n", name)
+	}
+	for _, f := range g.Functions {
+		for _, name := range f.Calls {
+			fmt.Fprintf(w, "  \"%s\" -> \"%s\";\n", f.Name, name)
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// WriteJSON writes the whole call graph as JSON.
+func (g *CallGraph) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
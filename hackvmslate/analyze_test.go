@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	src := `
+function Sys.init 0
+	push constant 1
+	call Main.big 1
+	call Main.even 1
+	return
+function Main.big 2000
+	push constant 0
+	return
+function Main.even 0
+	push argument 0
+	call Main.odd 1
+	return
+function Main.odd 0
+	push argument 0
+	call Main.even 1
+	return
+`
+	p, err := LoadProgram(strings.NewReader(src), "Test.vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := Analyze(p)
+	if got := g.lookup["main.big"].Depth; got != 2001 {
+		t.Errorf("main.big depth: got:(%d), expected:(2001)", got)
+	}
+	if len(g.Cycles) != 1 || len(g.Cycles[0]) != 2 {
+		t.Errorf("cycles: got:(%v), expected one cycle of main.even and main.odd", g.Cycles)
+	}
+	if g.MaxSP != unbounded {
+		t.Errorf("max sp: got:(%d), expected unbounded", g.MaxSP)
+	}
+
+	// Without the recursion, the stack overflows into the heap.
+	p, err = LoadProgram(strings.NewReader(strings.Replace(src, "call Main.even 1", "pop temp 0", 1)), "Test.vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g = Analyze(p)
+	if want := stack_base + frame_size + 1 + frame_size + 2001; g.MaxSP != want {
+		t.Errorf("max sp: got:(%d), expected:(%d)", g.MaxSP, want)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/bytecode"
+	"io"
+)
+
+// Each kind of command, and its kind in package bytecode.
+var bytecode_kinds = map[int]int{
+	C_ARITHMETIC: bytecode.ARITHMETIC,
+	C_PUSH:       bytecode.PUSH,
+	C_POP:        bytecode.POP,
+	C_LABEL:      bytecode.LABEL,
+	C_GOTO:       bytecode.GOTO,
+	C_IF:         bytecode.IF,
+	C_IF_NOT:     bytecode.IF_NOT,
+	C_FUNCTION:   bytecode.FUNCTION,
+	C_CALL:       bytecode.CALL,
+	C_RETURN:     bytecode.RETURN,
+}
+
+// WriteBytecode writes the whole program as bytecode.  The file and
+// line of each command are kept, so a program loaded from bytecode
+// still has a useful source map.
+func WriteBytecode(w io.Writer, p Program) error {
+	cmds := make([]bytecode.Command, len(p))
+	for i, cmd := range p {
+		cmds[i] = bytecode.Command{
+			Kind: bytecode_kinds[cmd.Kind],
+			Arg1: cmd.Arg1,
+			Arg2: cmd.Arg2,
+			File: cmd.File,
+			Line: cmd.Line,
+		}
+	}
+	return bytecode.Encode(w, cmds)
+}
+
+// LoadBytecode reads a program that was written by WriteBytecode.
+func LoadBytecode(r io.Reader) (Program, error) {
+	cmds, err := bytecode.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	kinds := make(map[int]int)
+	for k, v := range bytecode_kinds {
+		kinds[v] = k
+	}
+	p := make(Program, len(cmds))
+	for i, cmd := range cmds {
+		p[i] = &Command{
+			Kind: kinds[cmd.Kind],
+			Arg1: cmd.Arg1,
+			Arg2: cmd.Arg2,
+			File: cmd.File,
+			Line: cmd.Line,
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,358 @@
+/*
+package bytecode reads and writes VM programs in a compact binary form.
+
+Parsing the text of a large program, like a game together with the
+whole OS, means splitting every line into fields every time.  The
+bytecode is already split up, so it can be loaded much faster, and
+it is about a third of the size.
+
+Format
+
+All numbers are unsigned varints (see encoding/binary), except where
+it says otherwise.  A file is:
+
+	"HVMB"         4 bytes, to recognize the file.
+	version        1 byte, which is currently 1.
+	strings        the number of strings, then each string as its
+	               length followed by its bytes.  Function names,
+	               labels, and file names are all in this table, and
+	               are written everywhere else as their index.
+	commands       the number of commands, then each command.
+
+Each command starts with a single byte opcode, which is followed by
+its operands, and then the change in its line number since the last
+command, as a signed varint.
+
+	0x01 - 0x0e    arithmetic: add sub neg eq gt lt and or not
+	               mul div mod shl shr.  No operands.
+	0x20 - 0x27    push, plus the segment: constant local argument
+	               this that pointer temp static.  Operand: index.
+	0x30 - 0x37    pop, plus the segment.  Operand: index.
+	0x40           label.  Operand: name.
+	0x41           goto.  Operand: name.
+	0x42           if-goto.  Operand: name.
+	0x43           if-not-goto.  Operand: name.
+	0x50           function.  Operands: name, number of locals.
+	0x51           call.  Operands: name, number of arguments.
+	0x52           return.
+	0x60           file.  Operand: name.  Not a command, but every
+	               command after it came from that file.
+*/
+package bytecode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	magic   = "HVMB"
+	version = 1
+)
+
+// Kinds of commands.
+const (
+	ARITHMETIC = iota + 1
+	PUSH
+	POP
+	LABEL
+	GOTO
+	IF
+	IF_NOT
+	FUNCTION
+	CALL
+	RETURN
+)
+
+// Opcodes.
+const (
+	op_arithmetic = 0x00 // + 1 + index in arithmetic
+	op_push       = 0x20 // + index in segments
+	op_pop        = 0x30 // + index in segments
+	op_label      = 0x40
+	op_goto       = 0x41
+	op_if         = 0x42
+	op_if_not     = 0x43
+	op_function   = 0x50
+	op_call       = 0x51
+	op_return     = 0x52
+	op_file       = 0x60
+)
+
+var arithmetic = []string{
+	"add", "sub", "neg", "eq", "gt", "lt", "and", "or", "not",
+	"mul", "div", "mod", "shl", "shr",
+}
+
+var segments = []string{
+	"constant", "local", "argument", "this", "that", "pointer", "temp", "static",
+}
+
+// Command is a single VM command.  Arg1 is the arithmetic command,
+// the segment, or the name, and Arg2 is the number, just like in the
+// text of the VM code.
+type Command struct {
+	Kind int
+	Arg1 string
+	Arg2 int
+	File string
+	Line int
+}
+
+// ErrNotBytecode is returned by Decode when the file doesn't start
+// with the right bytes.
+var ErrNotBytecode = errors.New("not a bytecode file")
+
+// IsBytecode checks the first bytes of a file.
+func IsBytecode(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(magic))
+}
+
+func indexOf(list []string, s string) int {
+	for i, x := range list {
+		if x == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// encoder builds the string table and the commands at the same time,
+// since the table has to be written first.
+type encoder struct {
+	strings []string
+	index   map[string]int
+	code    []byte
+}
+
+func (e *encoder) number(n int) {
+	e.code = binary.AppendUvarint(e.code, uint64(n))
+}
+
+func (e *encoder) str(s string) {
+	i, ok := e.index[s]
+	if !ok {
+		i = len(e.strings)
+		e.index[s] = i
+		e.strings = append(e.strings, s)
+	}
+	e.number(i)
+}
+
+// Encode writes the commands as bytecode.
+func Encode(w io.Writer, cmds []Command) error {
+	e := &encoder{index: make(map[string]int)}
+	file := ""
+	line := 0
+	count := 0
+	for _, cmd := range cmds {
+		if cmd.File != file {
+			file = cmd.File
+			e.code = append(e.code, op_file)
+			e.str(file)
+		}
+		switch cmd.Kind {
+		case ARITHMETIC:
+			i := indexOf(arithmetic, cmd.Arg1)
+			if i < 0 {
+				return fmt.Errorf("%s:%d: unknown arithmetic command: (%v)", cmd.File, cmd.Line, cmd.Arg1)
+			}
+			e.code = append(e.code, byte(op_arithmetic+1+i))
+		case PUSH, POP:
+			i := indexOf(segments, cmd.Arg1)
+			if i < 0 || cmd.Arg2 < 0 {
+				return fmt.Errorf("%s:%d: bad push or pop: (%v %v)", cmd.File, cmd.Line, cmd.Arg1, cmd.Arg2)
+			}
+			op := op_push
+			if cmd.Kind == POP {
+				op = op_pop
+			}
+			e.code = append(e.code, byte(op+i))
+			e.number(cmd.Arg2)
+		case LABEL, GOTO, IF, IF_NOT:
+			e.code = append(e.code, map[int]byte{
+				LABEL: op_label, GOTO: op_goto, IF: op_if, IF_NOT: op_if_not,
+			}[cmd.Kind])
+			e.str(cmd.Arg1)
+		case FUNCTION, CALL:
+			if cmd.Arg2 < 0 {
+				return fmt.Errorf("%s:%d: negative number: (%v)", cmd.File, cmd.Line, cmd.Arg2)
+			}
+			op := op_function
+			if cmd.Kind == CALL {
+				op = op_call
+			}
+			e.code = append(e.code, byte(op))
+			e.str(cmd.Arg1)
+			e.number(cmd.Arg2)
+		case RETURN:
+			e.code = append(e.code, op_return)
+		default:
+			return fmt.Errorf("%s:%d: unknown kind of command: (%v)", cmd.File, cmd.Line, cmd.Kind)
+		}
+		e.code = binary.AppendVarint(e.code, int64(cmd.Line-line))
+		line = cmd.Line
+		count++
+	}
+
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	buf = append(buf, magic...)
+	buf = append(buf, version)
+	buf = binary.AppendUvarint(buf, uint64(len(e.strings)))
+	for _, s := range e.strings {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(count))
+	bw.Write(buf)
+	bw.Write(e.code)
+	return bw.Flush()
+}
+
+// decoder reads from a byte slice, and remembers the first error.
+type decoder struct {
+	b       []byte
+	strings []string
+	err     error
+}
+
+func (d *decoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("bytecode: "+format, a...)
+	}
+}
+
+func (d *decoder) number() int {
+	n, size := binary.Uvarint(d.b)
+	if size <= 0 || n > 1<<31 {
+		d.fail("bad number")
+		d.b = nil
+		return 0
+	}
+	d.b = d.b[size:]
+	return int(n)
+}
+
+func (d *decoder) signed() int {
+	n, size := binary.Varint(d.b)
+	if size <= 0 {
+		d.fail("bad number")
+		d.b = nil
+		return 0
+	}
+	d.b = d.b[size:]
+	return int(n)
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail("unexpected end of file")
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *decoder) str() string {
+	i := d.number()
+	if i >= len(d.strings) {
+		d.fail("string %d is not in the table", i)
+		return ""
+	}
+	return d.strings[i]
+}
+
+// Decode reads a whole bytecode file.
+func Decode(r io.Reader) ([]Command, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !IsBytecode(b) {
+		return nil, ErrNotBytecode
+	}
+	d := &decoder{b: b[len(magic):]}
+	if v := d.byte(); v != version {
+		return nil, fmt.Errorf("bytecode: version %d is not supported", v)
+	}
+
+	n := d.number()
+	for i := 0; i < n && d.err == nil; i++ {
+		size := d.number()
+		if size > len(d.b) {
+			d.fail("unexpected end of file")
+			break
+		}
+		d.strings = append(d.strings, string(d.b[:size]))
+		d.b = d.b[size:]
+	}
+
+	// Every command takes at least 2 bytes, which keeps a bad count
+	// from using up all of the memory.
+	n = d.number()
+	if n > len(d.b)/2 {
+		return nil, fmt.Errorf("bytecode: there can't be %d commands in %d bytes", n, len(d.b))
+	}
+	cmds := make([]Command, 0, n)
+	file := ""
+	line := 0
+	for len(cmds) < n && d.err == nil {
+		op := d.byte()
+		if op == op_file {
+			file = d.str()
+			continue
+		}
+		cmd := Command{File: file}
+		switch {
+		case op > op_arithmetic && op <= op_arithmetic+byte(len(arithmetic)):
+			cmd.Kind = ARITHMETIC
+			cmd.Arg1 = arithmetic[op-op_arithmetic-1]
+		case op >= op_push && op < op_push+byte(len(segments)):
+			cmd.Kind = PUSH
+			cmd.Arg1 = segments[op-op_push]
+			cmd.Arg2 = d.number()
+		case op >= op_pop && op < op_pop+byte(len(segments)):
+			cmd.Kind = POP
+			cmd.Arg1 = segments[op-op_pop]
+			cmd.Arg2 = d.number()
+		case op == op_label:
+			cmd.Kind = LABEL
+			cmd.Arg1 = d.str()
+		case op == op_goto:
+			cmd.Kind = GOTO
+			cmd.Arg1 = d.str()
+		case op == op_if:
+			cmd.Kind = IF
+			cmd.Arg1 = d.str()
+		case op == op_if_not:
+			cmd.Kind = IF_NOT
+			cmd.Arg1 = d.str()
+		case op == op_function:
+			cmd.Kind = FUNCTION
+			cmd.Arg1 = d.str()
+			cmd.Arg2 = d.number()
+		case op == op_call:
+			cmd.Kind = CALL
+			cmd.Arg1 = d.str()
+			cmd.Arg2 = d.number()
+		case op == op_return:
+			cmd.Kind = RETURN
+		default:
+			d.fail("unknown opcode 0x%02x", op)
+		}
+		line += d.signed()
+		cmd.Line = line
+		cmds = append(cmds, cmd)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return cmds, nil
+}
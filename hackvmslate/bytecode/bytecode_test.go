@@ -0,0 +1,43 @@
+package bytecode
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	cmds := []Command{
+		{FUNCTION, "sys.init", 0, "Sys.vm", 1},
+		{PUSH, "constant", 32767, "Sys.vm", 2},
+		{PUSH, "static", 3, "Sys.vm", 3},
+		{ARITHMETIC, "shr", 0, "Sys.vm", 4},
+		{CALL, "main.main", 1, "Sys.vm", 5},
+		{POP, "temp", 0, "Sys.vm", 5},
+		{LABEL, "halt", 0, "Sys.vm", 9},
+		{IF_NOT, "halt", 0, "Sys.vm", 10},
+		{GOTO, "halt", 0, "Sys.vm", 11},
+		{FUNCTION, "main.main", 2, "Main.vm", 1},
+		{IF, "halt", 0, "Main.vm", 2},
+		{RETURN, "", 0, "Main.vm", 1},
+	}
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, cmds); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, cmds) {
+		t.Errorf("got:\n%v\nexpected:\n%v", got, cmds)
+	}
+
+	// Every shorter file is broken, and must give an error.
+	b := buf.Bytes()
+	for i := 0; i < len(b); i++ {
+		if _, err := Decode(bytes.NewReader(b[:i])); err == nil {
+			t.Errorf("no error when cut off after %d bytes", i)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Top of Stack Caching
+//
+// Most of the VM commands pop a value into the D register, and then
+// push their result back onto the stack.  Very often, the next command
+// immediately pops that same value back into D.
+//
+// When the cache option is on, the codewriter keeps track of whether the top
+// of the stack is currently in the D register (cw.tos_in_d), instead of
+// in memory.  The Stack Pointer does not count the cached value.  Commands
+// that can use D directly skip the store and reload in between them.
+//
+// Whenever control can jump somewhere else (labels, jumps, calls,
+// functions, and returns), the cached value is flushed back onto
+// the stack first.  That way, every jump starts with nothing in D.
+//
+package main
+
+import (
+	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/control"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/pointer"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/stack"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/static"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/temp"
+)
+
+// translateCached is used in place of Translate when in cache mode.
+func (cw *codeWriter) translateCached(cmd *Command) ([]asm.Instruction, error) {
+	switch cmd.Kind {
+
+	case C_ARITHMETIC:
+		return cw.writeArithmeticCached(cmd.Arg1), nil
+
+	case C_PUSH:
+		load, err := cw.loadCached(cmd)
+		if err != nil {
+			return nil, err
+		}
+		c := code.Join(cw.flush(), cw.writePushGuard(), load)
+		cw.tos_in_d = true
+		return c, nil
+
+	case C_POP:
+		if !cw.tos_in_d {
+			return cw.WritePushPop(cmd)
+		}
+		cw.tos_in_d = false
+		return cw.storeCached(cmd)
+
+	case C_IF, C_IF_NOT:
+		if !cw.tos_in_d {
+			return cw.WriteProgramControl(cmd)
+		}
+		cw.tos_in_d = false
+		label := cw.current_function + "$" + cmd.Arg1
+		if cmd.Kind == C_IF {
+			return control.WriteIfD(label), nil
+		}
+		return control.WriteIfNotD(label), nil
+	}
+
+	// Everything else is a jump, or a place that can be jumped to.
+	flush := cw.flush()
+	x, err := cw.WriteProgramControl(cmd)
+	return code.Join(flush, x), err
+}
+
+// flush pushes the cached value in D onto the stack, if there is one.
+func (cw *codeWriter) flush() []asm.Instruction {
+	if !cw.tos_in_d {
+		return nil
+	}
+	cw.tos_in_d = false
+	return stack.PUSHD
+}
+
+// popCached returns the assembly that puts y into D.  It is empty when
+// y is already there.
+func (cw *codeWriter) popCached() []asm.Instruction {
+	if cw.tos_in_d {
+		return nil
+	}
+	return stack.POPD
+}
+
+// writeArithmeticCached is the same as WriteArithmetic, except that the
+// result is left in the D register.
+func (cw *codeWriter) writeArithmeticCached(command string) []asm.Instruction {
+	if cw.compact {
+		switch command {
+		case "eq", "gt", "lt":
+			return code.Join(cw.flush(), cw.WriteArithmetic(command))
+		}
+	}
+	switch command {
+	case "mul", "div", "mod", "shl", "shr":
+		return code.Join(cw.flush(), cw.WriteArithmetic(command))
+	}
+	s := cw.popCached()
+	cw.tos_in_d = true
+	switch command {
+	case "add":
+		return code.Join(s, stack.ADD_D)
+	case "sub":
+		return code.Join(s, stack.SUB_D)
+	case "and":
+		return code.Join(s, stack.AND_D)
+	case "or":
+		return code.Join(s, stack.OR_D)
+	case "not":
+		return code.Join(s, stack.NOT_D)
+	case "neg":
+		return code.Join(s, stack.NEG_D)
+	case "eq":
+		return code.Join(s, stack.JEQ_D(cw.location()))
+	case "gt":
+		return code.Join(s, stack.JGT_D(cw.location()))
+	case "lt":
+		return code.Join(s, stack.JLT_D(cw.location()))
+	}
+	panic("ERROR: INVALID ARITHMETIC COMMAND GIVEN.")
+}
+
+// loadCached returns the assembly that copies the value of a push
+// command into D.
+func (cw *codeWriter) loadCached(cmd *Command) ([]asm.Instruction, error) {
+	if cmd.Arg1 == "constant" {
+		return s_constant_load.Fill(cmd.Arg2), nil
+	}
+	switch segment_map[cmd.Arg1] {
+	case "TMP":
+		return temp.Load(cmd.Arg2), nil
+	case "pointer":
+		return pointer.Load(cmd.Arg2), nil
+	case "static":
+		return static.Load(cw.filename, cmd.Arg2), nil
+	case "LCL", "ARG", "THIS", "THAT":
+		return pointer.LoadThrough(segment_map[cmd.Arg1], cmd.Arg2), nil
+	}
+	return nil, fmt.Errorf("Push: Unknown first argument: (%v)", cmd.Arg1)
+}
+
+// storeCached returns the assembly that copies D into the place
+// named by a pop command.
+func (cw *codeWriter) storeCached(cmd *Command) ([]asm.Instruction, error) {
+	switch segment_map[cmd.Arg1] {
+	case "TMP":
+		return temp.Store(cmd.Arg2), nil
+	case "pointer":
+		return pointer.Store(cmd.Arg2), nil
+	case "static":
+		return static.Store(cw.filename, cmd.Arg2), nil
+	case "LCL", "ARG", "THIS", "THAT":
+		return pointer.StoreThrough(segment_map[cmd.Arg1], cmd.Arg2), nil
+	}
+	return nil, fmt.Errorf("Pop: Unknown first argument: (%v)", cmd.Arg1)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/fractalbach/nandGo2tetris/hackcompiler/CompilationEngine"
+)
+
+// A small program with recursion, loops, and every kind of segment.
+// Each result is saved in a static variable so it can be checked.
+const test_program = `
+function Sys.init 0
+	push constant 10
+	call Main.fib 1
+	pop static 0         // fib(10) = 55
+	push constant 100
+	call Main.sum 1
+	pop static 1         // 1 + 2 + ... + 100 = 5050
+	push constant 7
+	push constant 3
+	sub
+	push constant 2
+	gt
+	pop static 2         // (7 - 3) > 2 = true
+	push constant 3000
+	pop pointer 1
+	push constant 5
+	pop that 0
+	push constant 6
+	pop that 9
+	push that 0
+	push that 9
+	add
+	neg
+	pop static 3         // -(5 + 6) = -11
+	push constant 5
+	pop temp 3
+	push temp 3
+	push temp 3
+	eq
+	not
+	pop static 4         // ~(5 = 5) = false
+label halt
+	goto halt
+
+function Main.fib 0
+	push argument 0
+	push constant 2
+	lt
+	if-goto base
+	push argument 0
+	push constant 1
+	sub
+	call Main.fib 1
+	push argument 0
+	push constant 2
+	sub
+	call Main.fib 1
+	add
+	return
+label base
+	push argument 0
+	return
+
+function Main.sum 8
+label loop
+	push local 7
+	push argument 0
+	lt
+	not
+	if-goto done
+	push local 7
+	push constant 1
+	add
+	pop local 7
+	push local 0
+	push local 7
+	add
+	pop local 0
+	goto loop
+label done
+	push local 0
+	return
+`
+
+var test_program_results = []int16{55, 5050, -1, -11, 0}
+
+// Every mode should give the same results.  The number of cycles that
+// each mode took is logged, so that they can be compared with "go test -v".
+func TestModes(t *testing.T) {
+	modes := append(test_modes,
+		testMode{name: "optimize", passes: "all"},
+		testMode{name: "optimize+cache", cfg: config{cache: true}, passes: "all"},
+		testMode{name: "inline", inline: 20},
+		testMode{name: "inline+optimize", passes: "all", inline: 20},
+	)
+	runModes(t, test_program, modes, 1000000, func(mode testMode, a *Assembly, c *cpu) {
+		c.checkStatics(t, mode.name, "Test.vm", test_program_results)
+		t.Logf("%-15s %6d words of ROM, %7d cycles", mode.name, CountInstructions(a.Code), c.cycles)
+	})
+}
+
+// loadSquare compiles the Square game from the compiler's tests, along
+// with the stub OS in testdata, which is just enough of the OS to run
+// it.  The OS is compiled with the optimizer, so that Sys.halt becomes
+// a jump to itself, and the cpu can tell that the game is over.
+func loadSquare(t *testing.T) Program {
+	names, err := filepath.Glob("../hackcompiler/tests/Square/*.jack")
+	if err != nil || len(names) == 0 {
+		t.Fatal("can't find Square", err)
+	}
+	os_names, _ := filepath.Glob("testdata/StubOS/*.jack")
+	var sources []CompilationEngine.Source
+	for _, name := range append(names, os_names...) {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, CompilationEngine.Source{Filename: name, Src: bytes.NewReader(b)})
+	}
+	vm, diags := CompilationEngine.CompileProgramWithOptions(sources, CompilationEngine.Options{Optimize: true})
+	if CompilationEngine.HasErrors(diags) {
+		t.Fatal(diags)
+	}
+	var p Program
+	for i, code := range vm {
+		name := filepath.Base(sources[i].Filename)
+		f, err := LoadProgram(bytes.NewReader(code), name[:len(name)-len(".jack")]+".vm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p = append(p, f...)
+	}
+	return p
+}
+
+// Square plays back the same keys in every mode, so each mode should
+// leave the same picture on the screen.
+func TestSquare(t *testing.T) {
+	modes := []testMode{
+		{name: "normal"},
+		{name: "cache", cfg: config{cache: true}},
+		{name: "optimize+cache", cfg: config{cache: true}, passes: "all"},
+	}
+	var screen []int16
+	for _, mode := range modes {
+		a := translateProgram(t, loadSquare(t), mode)
+		c := newCPU(t, a)
+		c.run(t, 100000000)
+		if calls := c.static(t, "Keyboard.vm", 0); calls < 152 {
+			t.Fatalf("%s: the game stopped before q was pressed, after %d keys", mode.name, calls)
+		}
+		if screen == nil {
+			screen = append(screen, c.ram[16384:24576]...)
+			drawn := 0
+			for _, word := range screen {
+				if word != 0 {
+					drawn++
+				}
+			}
+			if drawn == 0 || screen[0] != 0 {
+				t.Errorf("%s: the square isn't on the screen where it moved to", mode.name)
+			}
+		}
+		for i, word := range c.ram[16384:24576] {
+			if word != screen[i] {
+				t.Errorf("%s: the screen is different at %d", mode.name, 16384+i)
+				break
+			}
+		}
+		t.Logf("%-15s %6d words of ROM, %9d cycles", mode.name, CountInstructions(a.Code), c.cycles)
+	}
+}
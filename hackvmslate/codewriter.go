@@ -2,8 +2,13 @@ package main
 
 import (
 	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
 	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/control"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/extended"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/guard"
 	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/pointer"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/shared"
 	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/stack"
 	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/static"
 	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/temp"
@@ -22,25 +27,82 @@ var segment_map = map[string]string{
 	"static":   "static",
 }
 
-// Counters is used internally for branching within the assembly code itself.
-// They are used sparingly, and are always called when wrapped around
-// a next(&counter) function.
 const (
 	default_current_function = "NullFunction"
-)
 
-var (
-	location_counter = 0
-	static_counter   = 0
-	return_counter   = 0
-	current_function = default_current_function
+	// bootstrap_namespace names the labels written by the bootstrap
+	// code.  It can't be the name of a file, since those end in .vm.
+	bootstrap_namespace = "bootstrap"
 )
 
+// config holds the choices about how the assembly code is written,
+// which come from the command line flags.  The zero value is the
+// normal translation.  Each codeWriter gets its own copy, so nothing
+// is shared between the functions being translated at the same time.
+type config struct {
+
+	// compact replaces calls, returns, and comparisons with
+	// jumps into the shared routines.  See package shared.
+	compact bool
+
+	// cache keeps the top of the stack in the D register.
+	// See cache.go.
+	cache bool
+
+	// guard_limit is the highest address the stack pointer may reach
+	// before the program traps.  0 means the guard is off.  When
+	// guard_push is on, every push command is checked too, instead
+	// of only calls and functions.  See package guard.
+	guard_limit int
+	guard_push  bool
+}
+
+// codeWriter holds everything that changes while a single function is
+// being translated.  Each function gets its own codeWriter, so that
+// functions can be translated at the same time without sharing anything.
+//
+// Counters are used internally for branching within the assembly code
+// itself.  They are used sparingly, and are always called when wrapped
+// around a next(&counter) function.  The labels made from them start
+// with the namespace, which is the name of the function being
+// translated, so two functions can count from 1 without their labels
+// getting mixed up.
+//
+// filename is the file of the command being translated, which is the
+// file that its static variables belong to.
+type codeWriter struct {
+	config
+	namespace        string
+	filename         string
+	location_counter int
+	return_counter   int
+	current_function string
+
+	// tos_in_d is true when the top of the stack is cached in the D
+	// register.  See cache.go.
+	tos_in_d bool
+
+	// extended_used remembers which of the extended arithmetic
+	// commands were used, so that only their routines are written.
+	extended_used map[string]bool
+}
+
+// newCodeWriter returns a codeWriter whose labels start with the
+// namespace.  The namespace is also the file for static variables,
+// until a command with a file is translated.
+func newCodeWriter(namespace string, cfg config) *codeWriter {
+	return &codeWriter{
+		config:           cfg,
+		namespace:        namespace,
+		filename:         namespace,
+		current_function: default_current_function,
+		extended_used:    make(map[string]bool),
+	}
+}
+
 // WriteArithemtic accepts an arithemtic command and returns the
-// assembly instructions as a string.  These commands come from
-// the parser, which has already interprted the source code.
-// The string generated from this command can be written into the
-// output .asm file.
+// assembly instructions.  These commands come from the parser,
+// which has already interprted the source code.
 //
 // Location of Stuff in the Stack
 //
@@ -52,7 +114,7 @@ var (
 // Arithmetic is in the form of x _ y,
 // where _ is an operator (like +, -, <, >, =)
 //
-func WriteArithmetic(command string) string {
+func (cw *codeWriter) WriteArithmetic(command string) []asm.Instruction {
 	switch command {
 
 	// Basic arithemtic and bit-wise commands are straight forward,
@@ -73,14 +135,30 @@ func WriteArithmetic(command string) string {
 
 	// When comparing inequalities, we need to include jumps.
 	// in order to avoid conflicts of jumps, increment
-	// the location counter by 1 prior to return the string.
+	// the location counter by 1 prior to return the code.
 
 	case "eq":
-		return stack.JEQ(next(&location_counter))
+		if cw.compact {
+			return shared.Compare(shared.EQ, cw.location())
+		}
+		return stack.JEQ(cw.location())
 	case "gt":
-		return stack.JGT(next(&location_counter))
+		if cw.compact {
+			return shared.Compare(shared.GT, cw.location())
+		}
+		return stack.JGT(cw.location())
 	case "lt":
-		return stack.JLT(next(&location_counter))
+		if cw.compact {
+			return shared.Compare(shared.LT, cw.location())
+		}
+		return stack.JLT(cw.location())
+
+	// The extended commands jump into a routine that is written
+	// at the end of the program.
+
+	case "mul", "div", "mod", "shl", "shr":
+		cw.extended_used[command] = true
+		return extended.Jump(command, cw.location())
 	}
 
 	// If an invalid command has been given, then it is due to
@@ -90,7 +168,7 @@ func WriteArithmetic(command string) string {
 	panic("ERROR: INVALID ARITHMETIC COMMAND GIVEN.")
 }
 
-func (cmd *Command) WritePushPop() (string, error) {
+func (cw *codeWriter) WritePushPop(cmd *Command) ([]asm.Instruction, error) {
 
 	// Constant push commands don't need to go through the
 	// whole process
@@ -102,15 +180,15 @@ func (cmd *Command) WritePushPop() (string, error) {
 	// if it can't be found, then you've been given a bad segment.
 	segment, ok := segment_map[cmd.Arg1]
 	if !ok {
-		return "", fmt.Errorf("Push/Pop: Unknown argument: (%v).", cmd.Arg1)
+		return nil, fmt.Errorf("Push/Pop: Unknown argument: (%v).", cmd.Arg1)
 	}
 
 	// Decide between Push or Pop.
 	switch cmd.Kind {
 	case C_POP:
-		return pop(segment, cmd.Arg2)
+		return cw.pop(segment, cmd.Arg2)
 	case C_PUSH:
-		return push(segment, cmd.Arg2)
+		return cw.push(segment, cmd.Arg2)
 	default:
 		panic("Needs to be a Push or Pop command.")
 	}
@@ -118,29 +196,29 @@ func (cmd *Command) WritePushPop() (string, error) {
 }
 
 // push accepts a segment and index from a push command.
-// returns the string containing assembly instructions,
+// returns the assembly instructions,
 // A value will be copied from memory based on the given
 // segment and index.  That value is then pushed to the
 // global stack.
-func push(s string, n int) (string, error) {
+func (cw *codeWriter) push(s string, n int) ([]asm.Instruction, error) {
 	switch s {
 	case "TMP":
 		return temp.Push(n), nil
 	case "pointer":
 		return pointer.Push(n), nil
 	case "static":
-		return static.Push(current_filename, n), nil
+		return static.Push(cw.filename, n), nil
 	case "LCL", "ARG", "THIS", "THAT":
 		return pointer.PushThrough(s, n), nil
 	}
-	return "", fmt.Errorf("Push: Unknown first argument: (%v)", s)
+	return nil, fmt.Errorf("Push: Unknown first argument: (%v)", s)
 }
 
 // pop accepts the segment and index from a pop command.
-// returns string containing assembly instructions
+// returns the assembly instructions
 // that will pop a value from the stack, and place it
 // somewhere in memory based on the given segment and index.
-func pop(s string, n int) (string, error) {
+func (cw *codeWriter) pop(s string, n int) ([]asm.Instruction, error) {
 	switch s {
 	case "TMP":
 		return temp.Pop(n), nil
@@ -149,12 +227,12 @@ func pop(s string, n int) (string, error) {
 		return pointer.Pop(n), nil
 
 	case "static":
-		return static.Pop(current_filename, n), nil
+		return static.Pop(cw.filename, n), nil
 
 	case "LCL", "ARG", "THIS", "THAT":
 		return pointer.PopThrough(s, n), nil
 	}
-	return "", fmt.Errorf("Pop: Unknown first argument: (%v)", s)
+	return nil, fmt.Errorf("Pop: Unknown first argument: (%v)", s)
 }
 
 // The end of program is an infinite loop that will unconditionally
@@ -167,15 +245,21 @@ const s_end_program = ` // End of Program.
 `
 
 // The constant push is a simple integer value.
-const s_constant_push = `// push constant %d
-@%d
+// Holes:
+// {0} the value
+var s_constant_load = code.Parse(`@{0}
 D=A
-%v
-`
+`)
 
 // pushes a constant value to the stack.
-func constant_push(n int) string {
-	return fmt.Sprintf(s_constant_push, n, n, stack.PUSHD)
+func constant_push(n int) []asm.Instruction {
+	return code.Join(s_constant_load.Fill(n), stack.PUSHD)
+}
+
+// location returns the name of a new label used for branching within
+// the assembly code, like LOCATION.Main.fib.3.
+func (cw *codeWriter) location() string {
+	return "LOCATION." + cw.namespace + "." + strconv.Itoa(next(&cw.location_counter))
 }
 
 // next accepts a pointer to an integer, increments it,
@@ -186,45 +270,49 @@ func next(count *int) int {
 	return *count
 }
 
-func WriteInit() string {
-	return `// bootstrap code
-// ----------------------------------
 // set stack pointer to 256
-@256
+var s_bootstrap = code.Parse(`@256
 D=A
 @SP
 M=D
-` + WriteCall("sys.init", 0) + `
-// ----------------------------------
-`
+`)
+
+func WriteInit(cfg config) []asm.Instruction {
+	return code.Join(s_bootstrap, newCodeWriter(bootstrap_namespace, cfg).WriteCall("sys.init", 0))
 }
 
-func (cmd *Command) WriteProgramControl() (string, error) {
+func (cw *codeWriter) WriteProgramControl(cmd *Command) ([]asm.Instruction, error) {
 	switch cmd.Kind {
 	case C_LABEL:
-		return control.WriteLabel(current_function + "$" + cmd.Arg1), nil
+		return control.WriteLabel(cw.current_function + "$" + cmd.Arg1), nil
 
 	case C_IF:
-		return control.WriteIf(current_function + "$" + cmd.Arg1), nil
+		return control.WriteIf(cw.current_function + "$" + cmd.Arg1), nil
+
+	case C_IF_NOT:
+		return control.WriteIfNot(cw.current_function + "$" + cmd.Arg1), nil
 
 	case C_GOTO:
-		return control.WriteGoto(current_function + "$" + cmd.Arg1), nil
+		return control.WriteGoto(cw.current_function + "$" + cmd.Arg1), nil
 
 	case C_FUNCTION:
 		if cmd.Arg2 < 0 {
-			return "", fmt.Errorf("Can't have a function with %d local variables! That doesn't make sense!", cmd.Arg2)
+			return nil, fmt.Errorf("Can't have a function with %d local variables! That doesn't make sense!", cmd.Arg2)
 		}
-		current_function = cmd.Arg1
-		return WriteFunction(cmd.Arg1, cmd.Arg2), nil
+		cw.current_function = cmd.Arg1
+		return cw.WriteFunction(cmd.Arg1, cmd.Arg2), nil
 
 	case C_RETURN:
+		if cw.compact {
+			return shared.Return(), nil
+		}
 		return s_return, nil
 
 	case C_CALL:
 		if cmd.Arg2 < 0 {
-			return "", fmt.Errorf("Can't call a function with %d arguments! That doesn't make sense!", cmd.Arg2)
+			return nil, fmt.Errorf("Can't call a function with %d arguments! That doesn't make sense!", cmd.Arg2)
 		}
-		return WriteCall(cmd.Arg1, cmd.Arg2), nil
+		return cw.WriteCall(cmd.Arg1, cmd.Arg2), nil
 	}
 	panic("This command should not be writing a program control.")
 }
@@ -235,30 +323,26 @@ func errNotImplemented(s string) error {
 
 // at the beginning, create next unique id, and save it.
 // that will also be used to create the return label.
-// Format Args
-// - name
-// - nArgs
-// - return label
-// - nArgs + 5
-// - name
-// - return label
-const s_call = `// ===============  call %s %d ====================
-@RETURN.%s  // push return address.
+// Holes
+// {0} name
+// {1} return label
+// {2} nArgs + 5
+var s_call = code.Parse(`@RETURN.{1}  // push return address.
 D=A
-` + stack.PUSHD + `
+` + stack.PUSHD_TEXT + `
 @LCL   // push local
 D=M
-` + stack.PUSHD + `
+` + stack.PUSHD_TEXT + `
 @ARG   // push arg
 D=M
-` + stack.PUSHD + `
+` + stack.PUSHD_TEXT + `
 @THIS  // push this
 D=M
-` + stack.PUSHD + `
+` + stack.PUSHD_TEXT + `
 @THAT  // push that
 D=M
-` + stack.PUSHD + `
-@%d    // set D <- (SP - nArgs - 5)
+` + stack.PUSHD_TEXT + `
+@{2}    // set D <- (SP - nArgs - 5)
 D=A
 @SP
 D=M-D
@@ -268,38 +352,73 @@ M=D
 D=M
 @LCL
 M=D
-@FUNCTION.%s  // goto f
+@FUNCTION.{0}  // goto f
 0; JMP
-(RETURN.%s)
-`
+(RETURN.{1})
+`)
+
+func (cw *codeWriter) WriteCall(name string, nArgs int) []asm.Instruction {
+	id := next(&cw.return_counter)
+	ret := name + "." + cw.namespace + "." + strconv.Itoa(id)
+	if cw.compact {
+		return shared.Call(name, nArgs, ret)
+	}
+	return code.Join(cw.writeGuard(5, guard.CALL), s_call.Fill(name, ret, nArgs+5))
+}
+
+// WriteSharedRoutines returns the routines used by the compact mode.
+// They only need to be written once, at the end of the program.
+func WriteSharedRoutines(cfg config) []asm.Instruction {
+	return shared.Routines(s_return, cfg.writeGuard(5, guard.CALL))
+}
 
-func WriteCall(name string, nArgs int) string {
-	id := next(&return_counter)
-	ret := name + "." + strconv.Itoa(id)
-	return fmt.Sprintf(s_call, name, nArgs, ret, nArgs+5, name, ret)
+// WriteExtendedRoutines returns the routines for each of the
+// extended arithmetic commands that were used.
+func WriteExtendedRoutines(used map[string]bool) []asm.Instruction {
+	return extended.Routines(used)
 }
 
-func WriteFunction(name string, nLocal int) string {
-	many_push := ""
+// writePushGuard returns the check for a single push, if every
+// push is being checked.
+func (cfg config) writePushGuard() []asm.Instruction {
+	if !cfg.guard_push {
+		return nil
+	}
+	return cfg.writeGuard(1, guard.PUSH)
+}
+
+// writeGuard returns the check that the stack has room for n more
+// words, or nothing if the guard is off.
+func (cfg config) writeGuard(n int, entry string) []asm.Instruction {
+	if cfg.guard_limit <= 0 {
+		return nil
+	}
+	return guard.Check(n, cfg.guard_limit, entry)
+}
+
+func (cw *codeWriter) WriteFunction(name string, nLocal int) []asm.Instruction {
 	if nLocal < 0 {
-		return ""
+		return nil
 	}
-	for i := 0; i < nLocal; i++ {
-		many_push += s_push_0
+	label := s_function.Fill(name)
+	if nLocal == 0 {
+		return label
 	}
-	return fmt.Sprintf("(FUNCTION.%s)\n", name) + many_push
+	return code.Join(label, cw.writeGuard(nLocal, guard.FUNCTION), code.Repeat(s_push_0, nLocal))
 }
 
-const s_push_0 = `@SP
+var s_function = code.Parse(`(FUNCTION.{0})`)
+
+var s_push_0 = code.Parse(`@SP
 M=M+1
 A=M-1
 M=0
-`
+`)
 const s_POP_FRAME = `@R13
 AM=M-1
 D=M`
 
-const s_return = `// ==================== Return ============================
+var s_return = code.Parse(`// ==================== Return ============================
         // ~~~~~~~  create frame pointer ~~~~~~~~~    FRAME = LCL
 @LCL    
 D=M
@@ -312,7 +431,7 @@ D=M
 @R14    // <- using register 14 for return address.
 M=D
         // ~~~~~~~ reposition return value ~~~~~~~~~  *ARG = pop()
-` + stack.POPD + `
+` + stack.POPD_TEXT + `
 @ARG
 A=M
 M=D
@@ -337,7 +456,7 @@ M=D
 @R14
 A=M
 0; JMP  // jump to the return address.
-`
+`)
 
 /*
 @5     // set RET = *(FRAME - 5)
@@ -0,0 +1,105 @@
+/*
+package code turns the assembly templates of the codewriter into
+instructions.
+
+Each template is written as assembly code, since that is the easiest
+way to read it, but it is only split into instructions once, when the
+translator starts.  After that, translating a VM command just copies
+the instructions of its templates, and fills in the parts that change
+from one command to the next, like labels and indexes.  Nothing is
+parsed while translating.
+
+Holes
+
+A template can leave holes in the symbol of an A-instruction, or in
+the name of a label, written as {0}, {1}, and so on.  Fill replaces
+each hole with its argument.  When the symbol of an A-instruction
+turns into a number, the instruction loads that number instead, so
+"@{0}" can be used for constants and indexes.
+
+Comments
+
+Lines that are only a comment are dropped, since the codewriter
+writes its own comment above the code of each VM command.  A comment
+at the end of a line is kept with its instruction, and is written
+back out in the .asm file.
+*/
+package code
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+)
+
+// Template is the instructions of a piece of assembly code.  Templates
+// are shared by everything that uses them, so they must never be
+// changed.  Use Fill or Join to make a copy.
+type Template []asm.Instruction
+
+// Parse splits the assembly code of a template into instructions.
+// The templates are part of the translator, so a broken one is a bug
+// in the translator, and Parse panics.
+func Parse(src string) Template {
+	var t Template
+	for i, line := range strings.Split(src, "\n") {
+		in, ok, err := asm.ParseLine(line)
+		if err != nil {
+			panic(fmt.Sprintf("broken template, line %d: %v\n%s", i+1, err, src))
+		}
+		if ok {
+			t = append(t, in)
+		}
+	}
+
+	// The capacity is cut down to the length, so appending to a
+	// template always makes a copy.
+	return t[:len(t):len(t)]
+}
+
+// Fill returns a copy of the template, with each hole replaced by
+// its argument.  The arguments are written with fmt.Sprint.
+func (t Template) Fill(args ...interface{}) []asm.Instruction {
+	code := make([]asm.Instruction, len(t))
+	copy(code, t)
+	for i := range code {
+		in := &code[i]
+		if !strings.Contains(in.Symbol, "{") {
+			continue
+		}
+		for n, arg := range args {
+			in.Symbol = strings.Replace(in.Symbol, "{"+strconv.Itoa(n)+"}", fmt.Sprint(arg), -1)
+		}
+		if in.Kind == asm.A && in.Symbol != "" && in.Symbol[0] >= '0' && in.Symbol[0] <= '9' {
+			if n, err := strconv.Atoi(in.Symbol); err == nil {
+				in.Symbol = ""
+				in.Value = n
+			}
+		}
+	}
+	return code
+}
+
+// Join puts pieces of code together into a new slice.
+func Join(pieces ...[]asm.Instruction) []asm.Instruction {
+	n := 0
+	for _, p := range pieces {
+		n += len(p)
+	}
+	code := make([]asm.Instruction, 0, n)
+	for _, p := range pieces {
+		code = append(code, p...)
+	}
+	return code
+}
+
+// Repeat returns n copies of the code, one after the other.
+func Repeat(c []asm.Instruction, n int) []asm.Instruction {
+	code := make([]asm.Instruction, 0, n*len(c))
+	for i := 0; i < n; i++ {
+		code = append(code, c...)
+	}
+	return code
+}
@@ -1,40 +1,57 @@
 package control
 
 import (
-	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
 	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/stack"
 )
 
-// s_label args:
-// 1. label name
-const s_label = `(LABEL.%s)`
-
-// s_if args:
-// 1. label name
-// 2. pop stack
-// 3. label name
-const s_if = `// if-goto %s
-%v
-@LABEL.%s
+// s_label holes:
+// {0} label name
+var s_label = code.Parse(`(LABEL.{0})`)
+
+// s_if holes, after popping the stack:
+// {0} label name
+var s_if = code.Parse(`@LABEL.{0}
 D; JNE
-`
+`)
+
+// s_if_not holes, after popping the stack:
+// {0} label name
+var s_if_not = code.Parse(`@LABEL.{0}
+D; JEQ
+`)
 
-// s_goto args:
-// 1. label name
-// 2. label name
-const s_goto = `// goto %s
-@LABEL.%s
+// s_goto holes:
+// {0} label name
+var s_goto = code.Parse(`@LABEL.{0}
 0; JMP
-`
+`)
+
+func WriteLabel(label string) []asm.Instruction {
+	return s_label.Fill(label)
+}
+
+func WriteIf(label string) []asm.Instruction {
+	return code.Join(stack.POPD, s_if.Fill(label))
+}
+
+// WriteIfNot jumps when the top of the stack is false.  It replaces
+// the "not" and "if-goto" pair that the compiler writes for loops.
+func WriteIfNot(label string) []asm.Instruction {
+	return code.Join(stack.POPD, s_if_not.Fill(label))
+}
 
-func WriteLabel(label string) string {
-	return fmt.Sprintf(s_label, label)
+// WriteIfD is the same as WriteIf, but the value is already in D.
+func WriteIfD(label string) []asm.Instruction {
+	return s_if.Fill(label)
 }
 
-func WriteIf(label string) string {
-	return fmt.Sprintf(s_if, label, stack.POPD, label)
+// WriteIfNotD is the same as WriteIfNot, but the value is already in D.
+func WriteIfNotD(label string) []asm.Instruction {
+	return s_if_not.Fill(label)
 }
 
-func WriteGoto(label string) string {
-	return fmt.Sprintf(s_goto, label, label)
+func WriteGoto(label string) []asm.Instruction {
+	return s_goto.Fill(label)
 }
@@ -0,0 +1,430 @@
+/*
+package extended has the assembly for the extended arithmetic commands.
+
+The Hack VM from the course doesn't have multiplication or division, so
+the Jack compiler calls Math.multiply and Math.divide from the OS.  Each
+of those goes through the whole call and return routine, and the OS
+versions are written in Jack, so they are very slow.
+
+The extended commands are done in assembly instead.  Each one is a
+routine that is written once, at the end of the program, and each
+command jumps into it.  They all take x and y from the stack, and
+leave a single result in place of x, just like add or sub.
+
+	mul   x * y
+	div   x / y, rounded towards zero.  x / 0 is 0.
+	mod   the remainder of x / y, with the same sign as x.  x mod 0 is x.
+	shl   x shifted left by y bits.
+	shr   x shifted right by y bits, copying the sign bit.
+
+The routines don't call each other, so they share a few variables.
+The assembler places them next to the static variables.
+
+	EXTENDED.RET    the address to jump back to, given in D.
+	EXTENDED.*      everything else is scratch space.
+*/
+package extended
+
+import (
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
+)
+
+// Labels of the routines.
+const (
+	MUL    = "EXTENDED.MUL"
+	DIV    = "EXTENDED.DIV"
+	MOD    = "EXTENDED.MOD"
+	SHL    = "EXTENDED.SHL"
+	SHR    = "EXTENDED.SHR"
+	DIVMOD = "EXTENDED.DIVMOD"
+)
+
+// Commands maps each extended VM command to its routine.
+var Commands = map[string]string{
+	"mul": MUL,
+	"div": DIV,
+	"mod": MOD,
+	"shl": SHL,
+	"shr": SHR,
+}
+
+// s_jump holes:
+// {0} return label
+// {1} routine label
+var s_jump = code.Parse(`@{0}
+D=A
+@{1}
+0; JMP
+({0})
+`)
+
+// Jump jumps into the routine for an extended command, which jumps
+// back to ret when it is done.  ret must be a unique label.
+func Jump(command string, ret string) []asm.Instruction {
+	return s_jump.Fill(ret, Commands[command])
+}
+
+// Multiplication adds x to the result for each bit that is set in y,
+// doubling x each time.  The mask goes through all 16 bits, and it is
+// done when the mask overflows to 0.
+var s_mul = code.Parse(`// ============ mul routine ==================
+(` + MUL + `)
+@EXTENDED.RET
+M=D
+@SP
+AM=M-1
+D=M
+@EXTENDED.Y
+M=D      // Y = y
+@SP
+A=M-1
+D=M
+@EXTENDED.X
+M=D      // X = x
+@SP
+A=M-1
+M=0      // result = 0
+@EXTENDED.MASK
+M=1
+(EXTENDED.MUL.LOOP)
+@EXTENDED.MASK
+D=M
+@EXTENDED.Y
+D=D&M
+@EXTENDED.MUL.NEXT
+D; JEQ
+@EXTENDED.X
+D=M
+@SP
+A=M-1
+M=D+M    // result += X
+(EXTENDED.MUL.NEXT)
+@EXTENDED.X
+D=M
+M=D+M    // X = X * 2
+@EXTENDED.MASK
+D=M
+MD=D+M   // MASK = MASK * 2
+@EXTENDED.MUL.LOOP
+D; JNE
+@EXTENDED.RET
+A=M
+0; JMP
+`)
+
+// Division is long division, one bit at a time, using the absolute
+// values of x and y.  The signs are fixed at the end.
+//
+// The problem is that |-32768| doesn't fit into 16 bits.  So, the
+// divisor and the remainder are kept as negative numbers instead,
+// which have room for one more value:
+//
+//	X   the bits of |x|, shifted left once each step.
+//	Y   -|y|
+//	R   -(remainder)
+//	Q   the quotient, shifted left once each step.
+//
+// Each step, the remainder is doubled and the next bit of X is added.
+// If the remainder is at least 16384, doubling it might overflow, but
+// it's then also known to be bigger than |y|, so |y| is taken away in
+// the same step.
+var s_divmod = code.Parse(`// ============ div and mod routines ==================
+(` + DIV + `)
+@EXTENDED.RET
+M=D
+@EXTENDED.WANT_MOD
+M=0
+@` + DIVMOD + `
+0; JMP
+(` + MOD + `)
+@EXTENDED.RET
+M=D
+@EXTENDED.WANT_MOD
+M=-1
+(` + DIVMOD + `)
+@SP
+AM=M-1
+D=M
+@EXTENDED.Y
+M=D      // Y = y
+@SP
+A=M-1
+D=M
+@EXTENDED.X
+M=D      // X = x
+@EXTENDED.XNEG
+M=0
+@EXTENDED.DIV.XPOS
+D; JGE
+@EXTENDED.XNEG
+M=-1
+@EXTENDED.X
+M=-M     // X = |x|
+(EXTENDED.DIV.XPOS)
+@EXTENDED.XNEG
+D=M
+@EXTENDED.QNEG
+M=D      // the quotient is negative when only one of x and y is.
+@EXTENDED.Y
+D=M
+@EXTENDED.DIV.YNEG
+D; JLT
+@EXTENDED.Y
+M=-D     // Y = -|y|
+@EXTENDED.DIV.START
+0; JMP
+(EXTENDED.DIV.YNEG)
+@EXTENDED.QNEG
+M=!M
+(EXTENDED.DIV.START)
+@EXTENDED.Q
+M=0
+@EXTENDED.R
+M=0
+@EXTENDED.Y
+D=M
+@EXTENDED.DIV.ZERO
+D; JEQ
+@16
+D=A
+@EXTENDED.N
+M=D
+(EXTENDED.DIV.LOOP)
+@EXTENDED.B
+M=0
+@EXTENDED.X
+D=M
+M=D+M    // take the top bit of X
+@EXTENDED.DIV.BIT
+D; JGE
+@EXTENDED.B
+M=1
+(EXTENDED.DIV.BIT)
+@EXTENDED.Q
+D=M
+M=D+M    // Q = Q * 2
+@16384
+D=A
+@EXTENDED.R
+D=D+M
+@EXTENDED.DIV.BIG
+D; JLE
+@EXTENDED.R
+D=M
+M=D+M
+@EXTENDED.B
+D=M
+@EXTENDED.R
+M=M-D    // R = 2R - bit
+D=M
+@EXTENDED.Y
+D=M-D    // D = Y - R, which is >= 0 when the remainder >= |y|
+@EXTENDED.DIV.NEXT
+D; JLT
+@EXTENDED.R
+M=-D     // R = R - Y
+@EXTENDED.Q
+M=M+1
+@EXTENDED.DIV.NEXT
+0; JMP
+(EXTENDED.DIV.BIG)
+@EXTENDED.Y
+D=M
+@EXTENDED.R
+D=M-D
+M=D+M    // R = R + (R - Y)
+@EXTENDED.B
+D=M
+@EXTENDED.R
+M=M-D    // R = R + (R - Y) - bit
+@EXTENDED.Q
+M=M+1
+(EXTENDED.DIV.NEXT)
+@EXTENDED.N
+MD=M-1
+@EXTENDED.DIV.LOOP
+D; JGT
+@EXTENDED.DIV.SIGNS
+0; JMP
+(EXTENDED.DIV.ZERO)
+@EXTENDED.X
+D=-M
+@EXTENDED.R
+M=D      // dividing by 0 leaves all of x as the remainder.
+(EXTENDED.DIV.SIGNS)
+@EXTENDED.QNEG
+D=M
+@EXTENDED.DIV.QPOS
+D; JEQ
+@EXTENDED.Q
+M=-M
+(EXTENDED.DIV.QPOS)
+@EXTENDED.XNEG
+D=M
+@EXTENDED.DIV.RNEG
+D; JNE
+@EXTENDED.R
+M=-M     // the remainder has the sign of x.
+(EXTENDED.DIV.RNEG)
+@EXTENDED.WANT_MOD
+D=M
+@EXTENDED.DIV.QUOTIENT
+D; JEQ
+@EXTENDED.R
+D=M
+@EXTENDED.DIV.RESULT
+0; JMP
+(EXTENDED.DIV.QUOTIENT)
+@EXTENDED.Q
+D=M
+(EXTENDED.DIV.RESULT)
+@SP
+A=M-1
+M=D
+@EXTENDED.RET
+A=M
+0; JMP
+`)
+
+// Shifting left doubles x, y times.  After 16 times there is nothing
+// left, so y is never more than 16.
+var s_shl = code.Parse(`// ============ shl routine ==================
+(` + SHL + `)
+@EXTENDED.RET
+M=D
+@SP
+AM=M-1
+D=M
+@EXTENDED.N
+M=D      // N = y
+@16
+D=D-A
+@EXTENDED.SHL.LOOP
+D; JLE
+@16
+D=A
+@EXTENDED.N
+M=D
+(EXTENDED.SHL.LOOP)
+@EXTENDED.N
+D=M
+@EXTENDED.SHL.DONE
+D; JLE
+@EXTENDED.N
+M=D-1
+@SP
+A=M-1
+D=M
+M=D+M    // x = x * 2
+@EXTENDED.SHL.LOOP
+0; JMP
+(EXTENDED.SHL.DONE)
+@EXTENDED.RET
+A=M
+0; JMP
+`)
+
+// The Hack ALU can't shift right, so each bit is copied one at a time.
+// FROM starts at bit y of x, and TO starts at bit 0 of the result.
+// When FROM runs off the top, TO is at bit 16 - y, and every bit from
+// there up is a copy of the sign bit.
+var s_shr = code.Parse(`// ============ shr routine ==================
+(` + SHR + `)
+@EXTENDED.RET
+M=D
+@SP
+AM=M-1
+D=M
+@EXTENDED.N
+M=D      // N = y
+@16
+D=D-A
+@EXTENDED.SHR.FROM
+D; JLE
+@16
+D=A
+@EXTENDED.N
+M=D
+(EXTENDED.SHR.FROM)
+@EXTENDED.FROM
+M=1
+(EXTENDED.SHR.FIND)
+@EXTENDED.N
+D=M
+@EXTENDED.SHR.FOUND
+D; JLE
+@EXTENDED.N
+M=D-1
+@EXTENDED.FROM
+D=M
+M=D+M    // FROM = FROM * 2
+@EXTENDED.SHR.FIND
+0; JMP
+(EXTENDED.SHR.FOUND)
+@EXTENDED.TO
+M=1
+@EXTENDED.Q
+M=0      // the result
+(EXTENDED.SHR.LOOP)
+@EXTENDED.FROM
+D=M
+@EXTENDED.SHR.SIGN
+D; JEQ
+@SP
+A=M-1
+D=D&M
+@EXTENDED.SHR.NEXT
+D; JEQ
+@EXTENDED.TO
+D=M
+@EXTENDED.Q
+M=D|M
+(EXTENDED.SHR.NEXT)
+@EXTENDED.FROM
+D=M
+M=D+M
+@EXTENDED.TO
+D=M
+M=D+M
+@EXTENDED.SHR.LOOP
+0; JMP
+(EXTENDED.SHR.SIGN)
+@SP
+A=M-1
+D=M
+@EXTENDED.SHR.DONE
+D; JGE
+@EXTENDED.TO
+D=-M     // every bit from TO up.
+@EXTENDED.Q
+M=D|M
+(EXTENDED.SHR.DONE)
+@EXTENDED.Q
+D=M
+@SP
+A=M-1
+M=D
+@EXTENDED.RET
+A=M
+0; JMP
+`)
+
+// Routines returns the assembly for the routines of the commands that
+// were used.  div and mod share a single routine.
+func Routines(used map[string]bool) []asm.Instruction {
+	var routines []asm.Instruction
+	if used["mul"] {
+		routines = code.Join(routines, s_mul)
+	}
+	if used["div"] || used["mod"] {
+		routines = code.Join(routines, s_divmod)
+	}
+	if used["shl"] {
+		routines = code.Join(routines, s_shl)
+	}
+	if used["shr"] {
+		routines = code.Join(routines, s_shr)
+	}
+	return routines
+}
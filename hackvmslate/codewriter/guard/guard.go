@@ -0,0 +1,97 @@
+/*
+package guard has the assembly for the stack overflow guard.
+
+The stack starts at 256 and grows up, towards the heap at 2048.
+Nothing stops it from growing into the heap, and when it does, it
+quietly overwrites objects that are still being used.  The bugs that
+follow are very hard to track down.
+
+When the guard is on, the stack pointer is checked against a limit
+before the stack grows.  If the stack would grow past the limit, the
+program jumps to the trap routine, which writes an error code to R15
+and halts.  The stack pointer is left alone, so it can be looked at
+in the CPU emulator.
+
+Error Codes
+
+	1   a call would push its frame past the limit.
+	2   a function would push its locals past the limit.
+	3   a push command would go past the limit.
+*/
+package guard
+
+import (
+	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
+)
+
+// Entry points of the trap routine, one for each error code.
+const (
+	CALL     = "GUARD.CALL"
+	FUNCTION = "GUARD.FUNCTION"
+	PUSH     = "GUARD.PUSH"
+	TRAP     = "GUARD.TRAP"
+)
+
+// ERROR_ADDRESS is the register that the trap writes the error code to.
+const ERROR_ADDRESS = 15
+
+// s_check holes:
+// {0} limit - number of words
+// {1} trap entry
+var s_check = code.Parse(`@SP
+D=M
+@{0}
+D=D-A
+@{1}
+D; JGT
+`)
+
+// s_check_always is used when the words can never fit under the limit.
+// holes:
+// {0} trap entry
+var s_check_always = code.Parse(`@{0}
+0; JMP
+`)
+
+// Check returns the assembly that jumps to the trap entry if pushing
+// n more words would move the stack pointer past the limit.  The
+// check uses the D register.
+func Check(n int, limit int, entry string) []asm.Instruction {
+	if limit-n < 0 {
+		return s_check_always.Fill(entry)
+	}
+	return s_check.Fill(limit-n, entry)
+}
+
+// s_routines args:
+// 1. error address
+const s_routines = `(` + CALL + `)
+@1
+D=A
+@` + TRAP + `
+0; JMP
+(` + FUNCTION + `)
+@2
+D=A
+@` + TRAP + `
+0; JMP
+(` + PUSH + `)
+@3
+D=A
+(` + TRAP + `)
+@%d
+M=D
+(GUARD.HALT)
+@GUARD.HALT
+0; JMP
+`
+
+var routines = code.Parse(fmt.Sprintf(s_routines, ERROR_ADDRESS))
+
+// Routines returns the assembly for the trap routine.  It only needs
+// to be written once, at the end of the program.
+func Routines() []asm.Instruction {
+	return routines
+}
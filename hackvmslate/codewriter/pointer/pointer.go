@@ -10,91 +10,134 @@
 package pointer
 
 import (
-	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
 	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/stack"
 )
 
-func Pop(n int) string {
-	var x string
-	switch n {
-	case 0:
-		x = s_pop_pointer_0
-	case 1:
-		x = s_pop_pointer_1
+func Pop(n int) []asm.Instruction {
+	return code.Join(stack.POPD, Store(n))
+}
+
+func Push(n int) []asm.Instruction {
+	return code.Join(Load(n), stack.PUSHD)
+}
+
+// Load copies THIS or THAT into the D register, without pushing it.
+func Load(n int) []asm.Instruction {
+	if n == 0 {
+		return s_load_pointer_0
 	}
-	return fmt.Sprintf(x, stack.POPD)
+	return s_load_pointer_1
 }
 
-func Push(n int) string {
-	var x string
-	switch n {
-	case 0:
-		x = s_push_pointer_0
-	case 1:
-		x = s_push_pointer_1
+// Store sets THIS or THAT to the value in the D register.
+func Store(n int) []asm.Instruction {
+	if n == 0 {
+		return s_store_pointer_0
 	}
-	return fmt.Sprintf(x, stack.PUSHD)
+	return s_store_pointer_1
 }
 
-const s_push_pointer_0 = `//push pointer 1
-@THIS
+var s_load_pointer_0 = code.Parse(`@THIS
 D=M
-%v
-`
+`)
 
-const s_push_pointer_1 = `//push pointer 0
-@THAT
+var s_load_pointer_1 = code.Parse(`@THAT
 D=M
-%v
-`
+`)
 
-const s_pop_pointer_0 = `// pop pointer 0
-%v
-@THIS
+var s_store_pointer_0 = code.Parse(`@THIS
 M=D
-`
-const s_pop_pointer_1 = `// pop pointer 1
-%v
-@THAT
+`)
+
+var s_store_pointer_1 = code.Parse(`@THAT
 M=D
-`
+`)
 
 // PopThrough accepts a segment string and index int.
 // Returns assembly.
-func PopThrough(s string, n int) string {
-	return fmt.Sprintf(pop_thru_pointer, s, n, n, s, stack.POPD)
+func PopThrough(s string, n int) []asm.Instruction {
+	return code.Join(pop_thru_pointer.Fill(s, n), stack.POPD, pop_thru_pointer_end)
 }
 
 // PushThrough accepts a segment string and index int.
 // Returns assembly.
-func PushThrough(s string, n int) string {
-	return fmt.Sprintf(push_thru_pointer, s, n, n, s, stack.PUSHD)
+func PushThrough(s string, n int) []asm.Instruction {
+	return code.Join(LoadThrough(s, n), stack.PUSHD)
+}
+
+// LoadThrough copies the value at segment[index] into the D register,
+// without pushing it.
+func LoadThrough(s string, n int) []asm.Instruction {
+	return push_thru_pointer.Fill(s, n)
+}
+
+// StoreThrough copies the value in the D register to segment[index].
+// Small indexes are reached by adding 1 to the address a few times,
+// otherwise the value is saved in R13 while the address is found.
+func StoreThrough(s string, n int) []asm.Instruction {
+	if n <= 6 {
+		return code.Join(store_thru_pointer_small.Fill(s), code.Repeat(increment, n), store_d)
+	}
+	return store_thru_pointer.Fill(s, n)
 }
 
-// Special Memory Access Pop Command.
-// 		Variable Order:
-// 		(string, int, int, string)
-const pop_thru_pointer = `// pop %s %d
-@%d
+// Store through pointer with a small index, with A=A+1 repeated
+// index times after it, and then M=D.
+// 		Holes:
+// 		{0} segment
+var store_thru_pointer_small = code.Parse(`@{0}
+A=M
+`)
+
+var increment = code.Parse(`A=A+1`)
+
+var store_d = code.Parse(`M=D`)
+
+// Store through pointer with any index.
+// 		Holes:
+// 		{0} segment
+// 		{1} index
+var store_thru_pointer = code.Parse(`@R13
+M=D
+@{1}
 D=A
-@%s
+@{0}
 D=D+M
+@R14
+M=D
 @R13
+D=M
+@R14
+A=M
 M=D
-%v
+`)
+
+// Special Memory Access Pop Command, with POP d in between.
+// 		Holes:
+// 		{0} segment
+// 		{1} index
+var pop_thru_pointer = code.Parse(`@{1}
+D=A
+@{0}
+D=D+M
 @R13
+M=D
+`)
+
+var pop_thru_pointer_end = code.Parse(`@R13
 A=M
 M=D
-`
+`)
 
 // Special Push Example.
-// 		Variable Order:
-// 		(string, int, int, string)
-const push_thru_pointer = `// push %s %d
-@%d
+// 		Holes:
+// 		{0} segment
+// 		{1} index
+var push_thru_pointer = code.Parse(`@{1}
 D=A
-@%s
-A=M+D
+@{0}
+A=D+M
 D=M
-%v
-`
+`)
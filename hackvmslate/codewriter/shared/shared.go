@@ -0,0 +1,192 @@
+/*
+package shared has the assembly for the compact code generation mode.
+
+Normally, every call, return, and comparison is written out in full
+wherever it is used.  A program that has a lot of them will quickly
+fill up the 32K of ROM.  In the compact mode, the long parts of each
+command are written only once, as a shared routine, and each command
+becomes a short jump into that routine.
+
+Registers
+
+The routines are given their arguments in registers:
+
+	D     the address that the routine should jump back to.
+	R13   the number of arguments (call only).
+	R14   the address of the function being called (call only).
+	R15   the return address is saved here by the comparisons, and
+	      by the call routine while the stack guard is checked.
+
+The return routine does not need any arguments, because everything
+it needs is already saved in the frame of the current function.
+*/
+package shared
+
+import (
+	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/stack"
+)
+
+// Labels of the shared routines.
+const (
+	CALL   = "SHARED.CALL"
+	RETURN = "SHARED.RETURN"
+	EQ     = "SHARED.EQ"
+	GT     = "SHARED.GT"
+	LT     = "SHARED.LT"
+)
+
+// s_call holes:
+// {0} function name
+// {1} nArgs
+// {2} return label
+var s_call = code.Parse(`@{1}
+D=A
+@R13
+M=D
+@FUNCTION.{0}
+D=A
+@R14
+M=D
+@RETURN.{2}
+D=A
+@` + CALL + `
+0; JMP
+(RETURN.{2})
+`)
+
+// s_jump holes:
+// {0} return label
+// {1} routine label
+var s_jump = code.Parse(`@{0}
+D=A
+@{1}
+0; JMP
+({0})
+`)
+
+// Call jumps into the shared call routine.  The return label
+// must be unique, just like the one used by a normal call.
+func Call(name string, nArgs int, ret string) []asm.Instruction {
+	return s_call.Fill(name, nArgs, ret)
+}
+
+var s_return = code.Parse(`@` + RETURN + `
+0; JMP
+`)
+
+// Return jumps into the shared return routine.
+func Return() []asm.Instruction {
+	return s_return
+}
+
+// Compare jumps into one of the shared comparison routines.
+// The routine leaves the result on the stack and jumps back to ret.
+func Compare(routine string, ret string) []asm.Instruction {
+	return s_jump.Fill(ret, routine)
+}
+
+// s_call_routine pushes the frame of the caller, and then jumps to
+// the function.  It is the same as a normal call.  The stack guard
+// goes right after the label, and this is the rest of it.
+var s_call_routine = code.Parse(stack.PUSHD_TEXT + `
+@LCL   // push local
+D=M
+` + stack.PUSHD_TEXT + `
+@ARG   // push arg
+D=M
+` + stack.PUSHD_TEXT + `
+@THIS  // push this
+D=M
+` + stack.PUSHD_TEXT + `
+@THAT  // push that
+D=M
+` + stack.PUSHD_TEXT + `
+@R13   // set D <- (SP - nArgs - 5)
+D=M
+@5
+D=D+A
+@SP
+D=M-D
+@ARG   // set ARG <- D
+M=D
+@SP    // set LCL <- SP
+D=M
+@LCL
+M=D
+@R14   // goto f
+A=M
+0; JMP
+`)
+
+// s_compare_routine args:
+// 1. routine label (used for each of its own labels)
+// 2. jump
+const s_compare_routine = `(%[1]s)
+@R15
+M=D
+` + stack.POPD_TEXT + `
+A=A-1
+D=M-D
+M=-1
+@%[1]s.TRUE
+D; %[2]s
+@SP
+A=M-1
+M=0
+(%[1]s.TRUE)
+@R15
+A=M
+0; JMP
+`
+
+var eq_routine = code.Parse(fmt.Sprintf(s_compare_routine, EQ, "JEQ"))
+
+// The guard uses D, so the return address is saved in R15 while
+// it is checked.
+var save_d = code.Parse(`@R15   // the guard uses D, so save the return address.
+M=D
+`)
+
+var restore_d = code.Parse(`@R15
+D=M
+`)
+
+// The signed comparisons jump back the same way as the others.
+var jump_back = code.Parse(`@R15
+A=M
+0; JMP
+`)
+
+// signedCompare returns a routine for an inequality that is
+// correct even when x - y would overflow.
+func signedCompare(routine string, jump string) []asm.Instruction {
+	return code.Join(
+		[]asm.Instruction{{Kind: asm.L, Symbol: routine}},
+		save_d,
+		stack.SignedInequality(jump, routine),
+		jump_back,
+	)
+}
+
+// Routines returns the assembly for all of the shared routines.
+// The body of the return routine is given by the codewriter, so
+// that there is only a single copy of it.  The guard is checked
+// at the start of the call routine, unless it is empty.
+func Routines(return_body []asm.Instruction, guard []asm.Instruction) []asm.Instruction {
+	if len(guard) > 0 {
+		guard = code.Join(save_d, guard, restore_d)
+	}
+	return code.Join(
+		[]asm.Instruction{{Kind: asm.L, Symbol: CALL}},
+		guard,
+		s_call_routine,
+		[]asm.Instruction{{Kind: asm.L, Symbol: RETURN}},
+		return_body,
+		eq_routine,
+		signedCompare(GT, "JGT"),
+		signedCompare(LT, "JLT"),
+	)
+}
@@ -9,56 +9,65 @@ package stack
 
 import (
 	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
 )
 
 // Pushes the value in the D register onto the stack.
-// Common building block for other commands.
-const PUSHD = `@SP // push d
+// Common building block for other commands.  The text is kept too,
+// so that it can be written into the middle of other templates.
+const PUSHD_TEXT = `@SP // push d
 M=M+1
 A=M-1
-M=D`
+M=D
+`
+
+var PUSHD = code.Parse(PUSHD_TEXT)
 
 // Pops the top element from the stack and places it in register D.
 // Common building block for other commands.
-const POPD = `@SP // pop d
+const POPD_TEXT = `@SP // pop d
 AM=M-1
-D=M`
+D=M
+`
+
+var POPD = code.Parse(POPD_TEXT)
 
 // Bit-wise NOT on the top element on the stack.
 // Only affects one element.
 // Does not pop the stack.
-const NOT = `// bitwise NOT
+var NOT = code.Parse(`// bitwise NOT
 @SP
 A=M-1
 M=!M
-`
+`)
 
 // Negation of the top element on the stack.
 // Only affects one element.
 // Does not pop the stack.
-const NEG = `// negation
+var NEG = code.Parse(`// negation
 @SP
 A=M-1
 M=-M
-`
+`)
 
 var (
-	ADD = alu_arithmetic("// add", "M=M+D")
-	SUB = alu_arithmetic("// subtract", "M=M-D")
-	AND = alu_arithmetic("// AND", "M=M&D")
-	OR  = alu_arithmetic("// OR", "M=M|D")
+	ADD = alu_arithmetic("D+M")
+	SUB = alu_arithmetic("M-D")
+	AND = alu_arithmetic("D&M")
+	OR  = alu_arithmetic("D|M")
 )
 
-func JEQ(location int) string {
-	return inequality("// true if x = y, else false", "JEQ", location)
+func JEQ(label string) []asm.Instruction {
+	return ineq_jeq.Fill(label)
 }
 
-func JLT(location int) string {
-	return inequality("// true if x < y, else false", "JLT", location)
+func JLT(label string) []asm.Instruction {
+	return signed_ineq_jlt.Fill(label)
 }
 
-func JGT(location int) string {
-	return inequality("// true if x > y, else false", "JGT", location)
+func JGT(label string) []asm.Instruction {
+	return signed_ineq_jgt.Fill(label)
 }
 
 // ALU_arithemtic returns the assembly instructions for stack arithemtic.
@@ -69,7 +78,7 @@ func JGT(location int) string {
 // 		2. AM=M-1   move top of stack down by 1, then goto top of stack.
 // 		2. D=M 		Save the element at the top of the stack in register D.
 // 		4. A=A-1    Move down 1 element in the stack.
-// 		5. M=M_A	Evaluate arithemtic, replace "_" with an operator.
+// 		5. M=D_M	Evaluate arithemtic, replace "_" with an operator.
 // 					and save the result in the current register.
 //
 // This is only meaningful if you have 2 values in the stack.
@@ -82,42 +91,231 @@ func JGT(location int) string {
 // However, the 16-bit ALU we use in the HACK computer can only support
 // certain basic operations.
 //
-const alu_arith_string = `%s
-%s
+const alu_arith_string = `@SP
+AM=M-1
+D=M
 A=A-1
-%s
+M=%s
 `
 
-// arithmetic string that supports add, subtract, AND, OR.
-// Usage: (POPD, comment, assembly)
-func alu_arithmetic(comment string, assembly string) string {
-	return fmt.Sprintf(alu_arith_string, comment, POPD, assembly)
+// arithmetic that supports add, subtract, AND, OR.
+// The computation is written the way the Hack ALU spells it,
+// with D first, like D+M.
+func alu_arithmetic(comp string) code.Template {
+	return code.Parse(fmt.Sprintf(alu_arith_string, comp))
 }
 
 // INEQUALITY requires similar parameters to the alu_arithmetic,
-// but also requires a name for the "checkpoint" variable.  It does not
+// but also requires a name for the "checkpoint" label.  It does not
 // determine this on it's own, because it may cause conflicts with other
 // jump variables depending on the context.
 //
-// For the assembly parameter, write one of the following:
+// For the jump, write one of the following:
 //
 // 		JEQ   Jump if equal to
 // 		JLT   Jump if less than
 //      JGT   jump if greater than
 //
-const s_ineq = `%s
-%v 
+// Only JEQ still uses it, since x - y is 0 exactly when x = y, even when
+// the subtraction overflows.  JLT and JGT use SignedInequality instead.
+//
+//
+// s_ineq holes:
+// {0} label
+const s_ineq = `@SP
+AM=M-1
+D=M
 A=A-1
 D=M-D
 M=-1
-@LOCATION%d
+@{0}
 D; %s
 @SP
 A=M-1
 M=0
-(LOCATION%d)
+({0})
+`
+
+var ineq_jeq = code.Parse(fmt.Sprintf(s_ineq, "JEQ"))
+
+// Inequalities like x < y can't just check the sign of x - y, because
+// the subtraction overflows when x and y have different signs and are
+// far apart.  For example, 32767 - (-2) wraps around to -32767, which
+// would make 32767 > -2 false.
+//
+// So, the signs are checked first.  When they are different, the
+// answer is already known: the negative one is smaller.  D is set to
+// -1 or 1 to stand in for x - y.  When the signs are the same, x - y
+// can't overflow, so it is safe to subtract.
+//
+// s_signed_ineq holes:
+// {0} label, used as the start of each of its own labels
+//
+// and the jump is filled in by fmt.Sprintf.
+const s_signed_ineq = `@SP
+AM=M-1
+D=M
+@{0}.YNEG
+D; JLT
+@SP      // y >= 0
+A=M-1
+D=M
+@{0}.DIFF
+D; JGE
+D=-1     // x < 0 <= y
+@{0}.TEST
+0; JMP
+({0}.YNEG)
+@SP      // y < 0
+A=M-1
+D=M
+@{0}.DIFF
+D; JLT
+D=1      // y < 0 <= x
+@{0}.TEST
+0; JMP
+({0}.DIFF)
+@SP      // same signs, so x - y can't overflow
+A=M
+D=D-M
+({0}.TEST)
+@SP
+A=M-1
+M=-1
+@{0}.TRUE
+D; %s
+@SP
+A=M-1
+M=0
+({0}.TRUE)
+`
+
+var (
+	signed_ineq_jlt = code.Parse(fmt.Sprintf(s_signed_ineq, "JLT"))
+	signed_ineq_jgt = code.Parse(fmt.Sprintf(s_signed_ineq, "JGT"))
+)
+
+// SignedInequality returns the assembly for x < y or x > y that is
+// correct for every pair of 16-bit values.  The jump is either JLT or
+// JGT, and the label must be unique.
+func SignedInequality(jump string, label string) []asm.Instruction {
+	if jump == "JLT" {
+		return signed_ineq_jlt.Fill(label)
+	}
+	return signed_ineq_jgt.Fill(label)
+}
+
+// The "D" variants are used when the top of the stack is cached in the
+// D register.  They expect y to be in D instead of on the stack,
+// and they leave their result in D instead of pushing it.
+//
+//          | ... |
+//          |  x  |
+//          |     |  <- Stack Pointer (SP)
+//
+//          D = y
+//
+var (
+	ADD_D = d_arithmetic("D+M")
+	SUB_D = d_arithmetic("M-D")
+	AND_D = d_arithmetic("D&M")
+	OR_D  = d_arithmetic("D|M")
+)
+
+// Bit-wise NOT of the value in D.
+var NOT_D = code.Parse(`// bitwise NOT
+D=!D
+`)
+
+// Negation of the value in D.
+var NEG_D = code.Parse(`// negation
+D=-D
+`)
+
+const d_arith_string = `@SP
+AM=M-1
+D=%s
 `
 
-func inequality(comment string, assembly string, counter int) string {
-	return fmt.Sprintf(s_ineq, comment, POPD, counter, assembly, counter)
+func d_arithmetic(comp string) code.Template {
+	return code.Parse(fmt.Sprintf(d_arith_string, comp))
+}
+
+func JEQ_D(label string) []asm.Instruction {
+	return ineq_d_jeq.Fill(label)
+}
+
+func JLT_D(label string) []asm.Instruction {
+	return signed_ineq_d_jlt.Fill(label)
+}
+
+func JGT_D(label string) []asm.Instruction {
+	return signed_ineq_d_jgt.Fill(label)
 }
+
+// s_ineq_d holes:
+// {0} label
+//
+// and the jump is filled in by fmt.Sprintf.
+const s_ineq_d = `@SP
+AM=M-1
+D=M-D
+@{0}
+D; %s
+D=0
+@{0}.END
+0; JMP
+({0})
+D=-1
+({0}.END)
+`
+
+var ineq_d_jeq = code.Parse(fmt.Sprintf(s_ineq_d, "JEQ"))
+
+// s_signed_ineq_d is the same as s_signed_ineq, except that y starts
+// in D, and the result is left in D.  y is kept in R13 while the
+// signs are checked.
+//
+// s_signed_ineq_d holes:
+// {0} label, used as the start of each of its own labels
+//
+// and the jump is filled in by fmt.Sprintf.
+const s_signed_ineq_d = `@R13
+M=D
+@{0}.YNEG
+D; JLT
+@SP      // y >= 0
+AM=M-1
+D=M
+@{0}.DIFF
+D; JGE
+D=-1     // x < 0 <= y
+@{0}.TEST
+0; JMP
+({0}.YNEG)
+@SP      // y < 0
+AM=M-1
+D=M
+@{0}.DIFF
+D; JLT
+D=1      // y < 0 <= x
+@{0}.TEST
+0; JMP
+({0}.DIFF)
+@R13     // same signs, so x - y can't overflow
+D=D-M
+({0}.TEST)
+@{0}
+D; %s
+D=0
+@{0}.END
+0; JMP
+({0})
+D=-1
+({0}.END)
+`
+
+var (
+	signed_ineq_d_jlt = code.Parse(fmt.Sprintf(s_signed_ineq_d, "JLT"))
+	signed_ineq_d_jgt = code.Parse(fmt.Sprintf(s_signed_ineq_d, "JGT"))
+)
@@ -17,32 +17,43 @@ so the VM language need not be concerned with actual registers.
 package static
 
 import (
-	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
 	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/stack"
 )
 
-const s_push_static = `// push static %d
-@%s.%d
+// Holes:
+// {0} filename
+// {1} index
+var s_load_static = code.Parse(`@{0}.{1}
 D=M
-%v
-`
+`)
 
-const s_pop_static = `// pop static %d
-%v
-@%s.%d
+var s_store_static = code.Parse(`@{0}.{1}
 M=D
-`
+`)
 
-// Push returns a string of asssembly instructions to push
+// Push returns the asssembly instructions to push
 // the value at static[index] to the stack.
 // the symbol will be named @filename.index
-func Push(filename string, index int) string {
-	return fmt.Sprintf(s_push_static, index, filename, index, stack.PUSHD)
+func Push(filename string, index int) []asm.Instruction {
+	return code.Join(Load(filename, index), stack.PUSHD)
 }
 
-// Push returns a string of asssembly instructions to
+// Push returns the asssembly instructions to
 // pop the stack, and place the value into static[index].
 // the symbol will be named @filename.index
-func Pop(filename string, index int) string {
-	return fmt.Sprintf(s_pop_static, index, stack.POPD, filename, index)
+func Pop(filename string, index int) []asm.Instruction {
+	return code.Join(stack.POPD, Store(filename, index))
+}
+
+// Load copies the value at static[index] into the D register,
+// without pushing it.
+func Load(filename string, index int) []asm.Instruction {
+	return s_load_static.Fill(filename, index)
+}
+
+// Store copies the value in the D register into static[index].
+func Store(filename string, index int) []asm.Instruction {
+	return s_store_static.Fill(filename, index)
 }
@@ -1,38 +1,56 @@
 package temp
 
 import (
-	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
 	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/stack"
 )
 
-func Push(n int) string {
-	return fmt.Sprintf(s_push_temp, n, n, stack.PUSHD)
+func Push(n int) []asm.Instruction {
+	return code.Join(s_push_temp.Fill(n), stack.PUSHD)
 }
 
-const s_push_temp = `// push temp %d
-@%d
+// Holes:
+// {0} n
+var s_push_temp = code.Parse(`@{0}
 D=A
 @5
-A=A+D
+A=D+A
 D=M
-%v
-`
+`)
 
-func Pop(n int) string {
-	return fmt.Sprintf(s_pop_temp, n, n, stack.POPD)
+// Load copies temp[n] into the D register, without pushing it.
+func Load(n int) []asm.Instruction {
+	return s_push_temp.Fill(n)
 }
 
-// Usage:
-// (n, n, POP d, )
-const s_pop_temp = `// pop temp %d
-@%d
+// Store copies the value in the D register into temp[n].
+// The temp segment always starts at register 5.
+func Store(n int) []asm.Instruction {
+	return s_store_temp.Fill(5 + n)
+}
+
+// Holes:
+// {0} 5 + n
+var s_store_temp = code.Parse(`@{0}
+M=D
+`)
+
+func Pop(n int) []asm.Instruction {
+	return code.Join(s_pop_temp.Fill(n), stack.POPD, s_pop_temp_end)
+}
+
+// Usage, with POP d in between:
+// {0} n
+var s_pop_temp = code.Parse(`@{0}
 D=A
 @5
-D=A+D
+D=D+A
 @R13
 M=D
-%v
-@R13
+`)
+
+var s_pop_temp_end = code.Parse(`@R13
 A=M
 M=D
-`
+`)
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+// Values near the edges of the 16-bit range, where x - y overflows.
+var compare_test_values = []int16{-32768, -32767, -2, -1, 0, 1, 2, 32766, 32767}
+
+// compareReference is what eq, gt, and lt should give.
+func compareReference(op string, x, y int16) int16 {
+	var b bool
+	switch op {
+	case "eq":
+		b = x == y
+	case "gt":
+		b = x > y
+	case "lt":
+		b = x < y
+	}
+	if b {
+		return -1
+	}
+	return 0
+}
+
+// Every pair of values is compared with each operator, in each mode.
+func TestCompare(t *testing.T) {
+	var cases []binaryCase
+	for _, op := range []string{"eq", "gt", "lt"} {
+		for _, x := range compare_test_values {
+			for _, y := range compare_test_values {
+				cases = append(cases, binaryCase{op, x, y})
+			}
+		}
+	}
+	runBinary(t, cases, test_modes, 1000000, compareReference)
+
+	// The optimizer folds constant comparisons, so check it too.
+	for _, p := range cases {
+		want := compareReference(p.op, p.x, p.y)
+		if got := evalBinary(p.op, p.x, p.y); got != want {
+			t.Errorf("fold: %d %s %d: got:(%d), expected:(%d)", p.x, p.op, p.y, got, want)
+		}
+	}
+}
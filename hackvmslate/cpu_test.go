@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+)
+
+// cpu is a small Hack computer, used by the tests to run the assembly
+// code written by the translator.  The code is assembled by the
+// hackasm/asm package, and the cpu runs the machine code, so the tests
+// check the encoder too.
+type cpu struct {
+	rom     []uint16
+	ram     [32768]int16
+	symbols map[string]int
+	a, d    int16
+	pc      int
+	cycles  int
+}
+
+// newCPU assembles the instructions and returns a computer that is
+// ready to run.
+func newCPU(t *testing.T, a *Assembly) *cpu {
+	c := &cpu{}
+	var err error
+	if c.symbols, err = asm.Symbols(a.Code); err != nil {
+		t.Fatal(err)
+	}
+	if c.rom, _, err = a.MachineCode(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// compute is the ALU.  The bits of a C-instruction pick between A and
+// M, zero and negate the inputs, add or AND them, and negate the output.
+func (c *cpu) compute(word uint16) int16 {
+	bit := func(n uint) bool { return word&(1<<n) != 0 }
+	x, y := c.d, c.a
+	if bit(12) {
+		y = c.ram[uint16(c.a)&0x7fff]
+	}
+	if bit(11) {
+		x = 0
+	}
+	if bit(10) {
+		x = ^x
+	}
+	if bit(9) {
+		y = 0
+	}
+	if bit(8) {
+		y = ^y
+	}
+	out := x & y
+	if bit(7) {
+		out = x + y
+	}
+	if bit(6) {
+		out = ^out
+	}
+	return out
+}
+
+// run executes instructions until the program halts, or runs off the
+// end of the ROM.  A program halts when it jumps to an A-instruction
+// that loads its own address, which is an infinite loop.
+func (c *cpu) run(t *testing.T, max_cycles int) {
+	for c.pc >= 0 && c.pc < len(c.rom) {
+		if c.cycles >= max_cycles {
+			t.Fatalf("the program did not halt after %d cycles.", max_cycles)
+		}
+		c.cycles++
+		word := c.rom[c.pc]
+		if word&0x8000 == 0 {
+			c.a = int16(word)
+			c.pc++
+			continue
+		}
+		x := c.compute(word)
+		address := uint16(c.a) & 0x7fff
+		if word&0x08 != 0 {
+			c.ram[address] = x
+		}
+		if word&0x10 != 0 {
+			c.d = x
+		}
+		if word&0x20 != 0 {
+			c.a = x
+		}
+		jump := word&0x04 != 0 && x < 0 ||
+			word&0x02 != 0 && x == 0 ||
+			word&0x01 != 0 && x > 0
+		if !jump {
+			c.pc++
+			continue
+		}
+		target := int(address)
+		if target == c.pc-1 && c.rom[target] == uint16(target) {
+			return
+		}
+		c.pc = target
+	}
+}
+
+// static returns the value of a static variable in the given file.
+func (c *cpu) static(t *testing.T, filename string, index int) int16 {
+	address, ok := c.symbols[fmt.Sprintf("%s.%d", filename, index)]
+	if !ok {
+		t.Fatalf("the static variable %s.%d does not exist.", filename, index)
+	}
+	return c.ram[address]
+}
+
+// testMode is one of the ways that the tests translate a program.
+type testMode struct {
+	name   string
+	cfg    config
+	passes string // the optimizer passes, like "all".
+	inline int    // the -inline size, or 0 to leave the calls alone.
+}
+
+// test_modes are the ways of writing assembly that every program
+// should give the same results in.
+var test_modes = []testMode{
+	{name: "normal"},
+	{name: "cache", cfg: config{cache: true}},
+	{name: "compact", cfg: config{compact: true}},
+	{name: "cache+compact", cfg: config{cache: true, compact: true}},
+}
+
+// loadTest loads the VM code as the file Test.vm.
+func loadTest(t *testing.T, src string) Program {
+	p, err := LoadProgram(strings.NewReader(src), "Test.vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// translateTest translates the VM code into assembly in the given mode.
+func translateTest(t *testing.T, src string, mode testMode) *Assembly {
+	return translateProgram(t, loadTest(t, src), mode)
+}
+
+// translateProgram translates the program into assembly in the given
+// mode, after inlining and optimizing it.
+func translateProgram(t *testing.T, p Program, mode testMode) *Assembly {
+	p, _ = InlineFunctions(p, mode.inline)
+	opt, err := NewOptimizer(mode.passes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := WriteAssembly(ioutil.Discard, opt.Optimize(p), mode.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// runModes translates the VM code in each of the modes, runs it until
+// it halts, and then calls check to look at the results.
+func runModes(t *testing.T, src string, modes []testMode, max_cycles int, check func(mode testMode, a *Assembly, c *cpu)) {
+	for _, mode := range modes {
+		a := translateTest(t, src, mode)
+		c := newCPU(t, a)
+		c.run(t, max_cycles)
+		check(mode, a, c)
+	}
+}
+
+// binaryCase is a binary VM command, and the values it is given.
+type binaryCase struct {
+	op   string
+	x, y int16
+}
+
+// pushValue writes the VM code that pushes any 16-bit value, since
+// push constant only accepts 0 to 32767.
+func pushValue(n int16) string {
+	switch {
+	case n == -32768:
+		return "push constant 32767\nneg\npush constant 1\nsub\n"
+	case n < 0:
+		return fmt.Sprintf("push constant %d\nneg\n", -n)
+	}
+	return fmt.Sprintf("push constant %d\n", n)
+}
+
+// runBinary runs each of the cases in each of the modes, saving the
+// results starting at RAM[3000], and checks them against want.
+func runBinary(t *testing.T, cases []binaryCase, modes []testMode, max_cycles int, want func(op string, x, y int16) int16) {
+	var src strings.Builder
+	src.WriteString("function Sys.init 0\npush constant 3000\npop pointer 1\n")
+	for i, p := range cases {
+		src.WriteString(pushValue(p.x) + pushValue(p.y) + p.op + "\n")
+		fmt.Fprintf(&src, "pop that %d\n", i)
+	}
+	src.WriteString("label halt\ngoto halt\n")
+
+	runModes(t, src.String(), modes, max_cycles, func(mode testMode, a *Assembly, c *cpu) {
+		for i, p := range cases {
+			if got, want := c.ram[3000+i], want(p.op, p.x, p.y); got != want {
+				t.Errorf("%s: %d %s %d: got:(%d), expected:(%d)", mode.name, p.x, p.op, p.y, got, want)
+			}
+		}
+	})
+}
+
+// checkStatics checks the first static variables of the file against
+// want, such as test_program_results.
+func (c *cpu) checkStatics(t *testing.T, name, filename string, want []int16) {
+	for i, w := range want {
+		if got := c.static(t, filename, i); got != w {
+			t.Errorf("%s: static %d: got:(%d), expected:(%d)", name, i, got, w)
+		}
+	}
+}
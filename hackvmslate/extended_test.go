@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+// The folded results are the reference for the assembly routines,
+// so check a few of the odd cases by hand first.
+func TestEvalExtended(t *testing.T) {
+	table := []struct {
+		op   string
+		x, y int16
+		want int16
+	}{
+		{"mul", 300, 300, 24464}, // 90000 wraps around.
+		{"mul", -7, 6, -42},
+		{"div", -7, 2, -3},
+		{"div", 7, 0, 0},
+		{"div", -32768, -1, -32768},
+		{"mod", -7, 2, -1},
+		{"mod", 7, -2, 1},
+		{"mod", 7, 0, 7},
+		{"shl", 1, 15, -32768},
+		{"shl", 1, 16, 0},
+		{"shr", -32768, 15, -1},
+		{"shr", 16384, 14, 1},
+		{"shr", -8, 100, -1},
+	}
+	for _, tt := range table {
+		if got := evalBinary(tt.op, tt.x, tt.y); got != tt.want {
+			t.Errorf("%d %s %d: got:(%d), expected:(%d)", tt.x, tt.op, tt.y, got, tt.want)
+		}
+	}
+}
+
+// Every extended command is run on pairs of values near the edges.
+func TestExtended(t *testing.T) {
+	values := []int16{-32768, -32767, -300, -7, -2, -1, 0, 1, 2, 3, 7, 300, 32766, 32767}
+	shifts := []int16{-1, 0, 1, 2, 7, 14, 15, 16, 17}
+	var cases []binaryCase
+	for _, op := range []string{"mul", "div", "mod"} {
+		for _, x := range values {
+			for _, y := range values {
+				cases = append(cases, binaryCase{op, x, y})
+			}
+		}
+	}
+	for _, op := range []string{"shl", "shr"} {
+		for _, x := range values {
+			for _, y := range shifts {
+				cases = append(cases, binaryCase{op, x, y})
+			}
+		}
+	}
+	runBinary(t, cases, test_modes[:2], 10000000, evalBinary)
+}
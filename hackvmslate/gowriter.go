@@ -0,0 +1,481 @@
+// Go Backend
+//
+// Instead of assembly, the program can be translated into a Go package.
+// Running a game through the assembler and the CPU emulator is very
+// slow, which makes it hard to try out changes to its logic.  A Go
+// package can be built into a native program, or unit tested directly.
+//
+// The package has a Machine, with the same RAM as the Hack computer.
+// The stack, the segments, and the call frames are all kept in the RAM,
+// in the same places that the assembly would keep them, so the program
+// works the same way.  The difference is that each VM function becomes
+// a Go method, and Go keeps track of where to return to.
+//
+// Hooks are called when the program writes to the screen memory, or
+// reads from the keyboard.  Functions that aren't in the program, like
+// the OS functions, can be given to the Machine as Natives.
+//
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// go_runtime is written at the top of every Go package.  It is the
+// Go version of the bootstrap code, call, return, and the arithmetic.
+//
+// Args:
+// 1. package name
+const go_runtime = `// Code generated by hackvmslate from .vm files.  DO NOT EDIT.
+
+package %s
+
+import "fmt"
+
+// Addresses of the registers, and of the memory mapped devices.
+const (
+	SP     = 0
+	LCL    = 1
+	ARG    = 2
+	THIS   = 3
+	THAT   = 4
+	SCREEN = 16384
+	KBD    = 24576
+)
+
+// Machine is a Hack computer running the program.
+type Machine struct {
+	RAM [32768]int16
+
+	// Screen is called after each write to the screen memory.
+	Screen func(address int, value int16)
+
+	// Keyboard is called when the keyboard register is read.
+	Keyboard func() int16
+
+	// Natives are used for each function that isn't in the program,
+	// like the functions of the OS.  They are given the arguments,
+	// and return the return value.
+	Natives map[string]func(m *Machine, args []int16) int16
+
+	// Halted is true once the program has stopped.
+	Halted bool
+}
+
+// halt is used to unwind all of the calls when the program stops.
+type halt struct{}
+
+// NewMachine returns a Machine with the stack pointer set up.
+func NewMachine() *Machine {
+	m := &Machine{Natives: make(map[string]func(*Machine, []int16) int16)}
+	m.RAM[SP] = 256
+	return m
+}
+
+// Halt stops the program.  It can be called from the hooks and natives.
+func (m *Machine) Halt() {
+	panic(halt{})
+}
+
+// Run calls Sys.init, just like the bootstrap code, and returns once
+// the program halts.  The program halts when it reaches a label that
+// only jumps to itself, like the end of Sys.halt.
+func (m *Machine) Run() {
+	m.RAM[SP] = 256
+	m.Call("sys.init")
+}
+
+// Call calls any function in the program with the given arguments, and
+// returns what it returned.  The name is in lowercase, like "main.fib".
+func (m *Machine) Call(name string, args ...int16) (result int16) {
+	f, ok := functions[name]
+	if !ok {
+		f = native(name)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(halt); !ok {
+				panic(r)
+			}
+			m.Halted = true
+		}
+	}()
+	for _, x := range args {
+		m.push(x)
+	}
+	m.call(len(args), f)
+	return m.pop()
+}
+
+// Static returns the value of a static variable, like ("Main.vm", 0).
+func (m *Machine) Static(file string, index int) int16 {
+	address, ok := statics[fmt.Sprintf("%%s.%%d", file, index)]
+	if !ok {
+		return 0
+	}
+	return m.RAM[address]
+}
+
+func (m *Machine) push(x int16) {
+	m.RAM[m.RAM[SP]] = x
+	m.RAM[SP]++
+}
+
+func (m *Machine) pop() int16 {
+	m.RAM[SP]--
+	return m.RAM[m.RAM[SP]]
+}
+
+// load and store are used for the segments that can point anywhere,
+// so that they can call the hooks.  Like the Hack CPU, only the lower
+// 15 bits of the address are used.
+func (m *Machine) load(address int16) int16 {
+	i := int(address) & 0x7fff
+	if i == KBD && m.Keyboard != nil {
+		return m.Keyboard()
+	}
+	return m.RAM[i]
+}
+
+func (m *Machine) store(address int16, x int16) {
+	i := int(address) & 0x7fff
+	m.RAM[i] = x
+	if i >= SCREEN && i < KBD && m.Screen != nil {
+		m.Screen(i, x)
+	}
+}
+
+// call pushes the frame, just like the assembly does.  There is no
+// return address to push, so a 0 takes its place.
+func (m *Machine) call(nArgs int, f func(*Machine)) {
+	m.push(0)
+	m.push(m.RAM[LCL])
+	m.push(m.RAM[ARG])
+	m.push(m.RAM[THIS])
+	m.push(m.RAM[THAT])
+	m.RAM[ARG] = m.RAM[SP] - int16(nArgs) - 5
+	m.RAM[LCL] = m.RAM[SP]
+	f(m)
+}
+
+// enter pushes the locals of a function.
+func (m *Machine) enter(nLocals int) {
+	for i := 0; i < nLocals; i++ {
+		m.push(0)
+	}
+}
+
+// leave puts the return value in place of the arguments, and then
+// restores the frame of the caller.
+func (m *Machine) leave() {
+	frame := m.RAM[LCL]
+	m.RAM[m.RAM[ARG]] = m.pop()
+	m.RAM[SP] = m.RAM[ARG] + 1
+	m.RAM[THAT] = m.RAM[frame-1]
+	m.RAM[THIS] = m.RAM[frame-2]
+	m.RAM[ARG] = m.RAM[frame-3]
+	m.RAM[LCL] = m.RAM[frame-4]
+}
+
+// native returns a function that calls one of the Natives.
+func native(name string) func(*Machine) {
+	return func(m *Machine) {
+		f, ok := m.Natives[name]
+		if !ok {
+			panic("the function " + name + " isn't in the program, and there is no native for it.")
+		}
+		args := make([]int16, m.RAM[LCL]-m.RAM[ARG]-5)
+		copy(args, m.RAM[m.RAM[ARG]:])
+		m.push(f(m, args))
+		m.leave()
+	}
+}
+
+// true is -1 in the VM, because all of its bits are set.
+func boolean(b bool) int16 {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+func (m *Machine) add() { y := m.pop(); m.push(m.pop() + y) }
+func (m *Machine) sub() { y := m.pop(); m.push(m.pop() - y) }
+func (m *Machine) and() { y := m.pop(); m.push(m.pop() & y) }
+func (m *Machine) or()  { y := m.pop(); m.push(m.pop() | y) }
+func (m *Machine) neg() { m.push(-m.pop()) }
+func (m *Machine) not() { m.push(^m.pop()) }
+func (m *Machine) eq()  { y := m.pop(); m.push(boolean(m.pop() == y)) }
+func (m *Machine) gt()  { y := m.pop(); m.push(boolean(m.pop() > y)) }
+func (m *Machine) lt()  { y := m.pop(); m.push(boolean(m.pop() < y)) }
+func (m *Machine) mul() { y := m.pop(); m.push(m.pop() * y) }
+
+func (m *Machine) div() {
+	y, x := m.pop(), m.pop()
+	if y == 0 {
+		m.push(0)
+		return
+	}
+	m.push(x / y)
+}
+
+func (m *Machine) mod() {
+	y, x := m.pop(), m.pop()
+	if y == 0 {
+		m.push(x)
+		return
+	}
+	m.push(x %% y)
+}
+
+func (m *Machine) shl() {
+	y, x := m.pop(), m.pop()
+	switch {
+	case y <= 0:
+		m.push(x)
+	case y >= 16:
+		m.push(0)
+	default:
+		m.push(x << uint(y))
+	}
+}
+
+func (m *Machine) shr() {
+	y, x := m.pop(), m.pop()
+	switch {
+	case y <= 0:
+		m.push(x)
+	case y >= 16:
+		m.push(x >> 15)
+	default:
+		m.push(x >> uint(y))
+	}
+}
+`
+
+// goWriter holds what is needed while writing a single Go package.
+type goWriter struct {
+	buf       bytes.Buffer
+	functions map[string]string // VM name -> Go name.
+	statics   map[string]int    // "File.vm.n" -> address.
+}
+
+// WriteGo translates the whole program into a Go package.  Every
+// command has to be inside of a function.
+func WriteGo(w io.Writer, p Program, pkg string) error {
+	g := &goWriter{
+		functions: make(map[string]string),
+		statics:   make(map[string]int),
+	}
+	fmt.Fprintf(&g.buf, go_runtime, pkg)
+
+	// Name each of the functions first, so that calls can find them.
+	used := make(map[string]bool)
+	bodies := splitFunctions(p)
+	for _, body := range bodies {
+		if body[0].Kind != C_FUNCTION {
+			cmd := body[0]
+			return fmt.Errorf("%s:%d: the Go backend needs every command to be inside of a function.\n[TEXT]: %s", cmd.File, cmd.Line, cmd)
+		}
+		g.functions[body[0].Arg1] = goName("f_", body[0].Arg1, used)
+	}
+	for _, body := range bodies {
+		if err := g.writeFunction(body); err != nil {
+			return err
+		}
+	}
+
+	// The tables used by Call and Static.
+	names := make([]string, 0, len(g.functions))
+	for name := range g.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(&g.buf, "\nvar functions = map[string]func(*Machine){")
+	for _, name := range names {
+		fmt.Fprintf(&g.buf, "\t%q: (*Machine).%s,\n", name, g.functions[name])
+	}
+	fmt.Fprintln(&g.buf, "}")
+
+	names = names[:0]
+	for name := range g.statics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(&g.buf, "\nvar statics = map[string]int{")
+	for _, name := range names {
+		fmt.Fprintf(&g.buf, "\t%q: %d,\n", name, g.statics[name])
+	}
+	fmt.Fprintln(&g.buf, "}")
+
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("the Go code could not be formatted: %v", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// writeFunction writes a single VM function as a method of Machine.
+// Labels become Go labels, so the jumps can use goto.
+func (g *goWriter) writeFunction(body Program) error {
+	header := body[0]
+
+	// A label followed by a goto to itself is where the program halts.
+	halts := make(map[int]bool)
+	for i := 1; i+1 < len(body); i++ {
+		if body[i].Kind == C_LABEL && body[i+1].Kind == C_GOTO && body[i+1].Arg1 == body[i].Arg1 {
+			halts[i+1] = true
+		}
+	}
+
+	// Go won't compile a label that isn't used, so only the labels
+	// that are jumped to are written.
+	defined := make(map[string]bool)
+	for _, cmd := range body {
+		if cmd.Kind == C_LABEL {
+			defined[cmd.Arg1] = true
+		}
+	}
+	labels := make(map[string]string)
+	used := make(map[string]bool)
+	for i, cmd := range body {
+		switch cmd.Kind {
+		case C_GOTO, C_IF, C_IF_NOT:
+			if !defined[cmd.Arg1] {
+				return fmt.Errorf("%s:%d: there is no label %s in %s.\n[TEXT]: %s", cmd.File, cmd.Line, cmd.Arg1, header.Arg1, cmd)
+			}
+			if _, ok := labels[cmd.Arg1]; !ok && !halts[i] {
+				labels[cmd.Arg1] = goName("l_", cmd.Arg1, used)
+			}
+		}
+	}
+
+	fmt.Fprintf(&g.buf, "\n// %s %d, from %s:%d\n", header.Arg1, header.Arg2, header.File, header.Line)
+	fmt.Fprintf(&g.buf, "func (m *Machine) %s() {\n", g.functions[header.Arg1])
+	if header.Arg2 > 0 {
+		fmt.Fprintf(&g.buf, "m.enter(%d)\n", header.Arg2)
+	}
+	last := header
+	for i, cmd := range body[1:] {
+		if halts[i+1] {
+			fmt.Fprintln(&g.buf, "m.Halt()")
+			last = cmd
+			continue
+		}
+		s, err := g.translate(cmd, labels)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v\n[TEXT]: %s", cmd.File, cmd.Line, err, cmd)
+		}
+		fmt.Fprint(&g.buf, s)
+		last = cmd
+	}
+
+	// Running past the end of a function would run into whatever
+	// is next in the ROM, which can't be done in Go.
+	if last.Kind != C_RETURN && last.Kind != C_GOTO {
+		fmt.Fprintf(&g.buf, "panic(%q)\n", header.Arg1+" ran past its end.")
+	}
+	fmt.Fprintln(&g.buf, "}")
+	return nil
+}
+
+// translate returns the Go code for a single command.
+func (g *goWriter) translate(cmd *Command, labels map[string]string) (string, error) {
+	switch cmd.Kind {
+	case C_ARITHMETIC:
+		return "m." + cmd.Arg1 + "()\n", nil
+
+	case C_PUSH:
+		if cmd.Arg1 == "constant" {
+			return fmt.Sprintf("m.push(%d)\n", cmd.Arg2), nil
+		}
+		x, err := g.segment(cmd, "m.load(%s)", "m.RAM[%d]")
+		return fmt.Sprintf("m.push(%s)\n", x), err
+
+	case C_POP:
+		x, err := g.segment(cmd, "m.store(%s, m.pop())", "m.RAM[%d] = m.pop()")
+		return x + "\n", err
+
+	case C_LABEL:
+		if label, ok := labels[cmd.Arg1]; ok {
+			return label + ":\n", nil
+		}
+		return "", nil
+
+	case C_GOTO:
+		return "goto " + labels[cmd.Arg1] + "\n", nil
+
+	case C_IF:
+		return fmt.Sprintf("if m.pop() != 0 {\ngoto %s\n}\n", labels[cmd.Arg1]), nil
+
+	case C_IF_NOT:
+		return fmt.Sprintf("if m.pop() == 0 {\ngoto %s\n}\n", labels[cmd.Arg1]), nil
+
+	case C_CALL:
+		if name, ok := g.functions[cmd.Arg1]; ok {
+			return fmt.Sprintf("m.call(%d, (*Machine).%s)\n", cmd.Arg2, name), nil
+		}
+		return fmt.Sprintf("m.call(%d, native(%q))\n", cmd.Arg2, cmd.Arg1), nil
+
+	case C_RETURN:
+		return "m.leave()\nreturn\n", nil
+	}
+	return "", fmt.Errorf("the Go backend can't translate this command.")
+}
+
+// segment returns the Go code for the place named by a push or pop.
+// The pointer segments use the first format, with the address, and
+// the fixed segments use the second format, with the RAM index.
+func (g *goWriter) segment(cmd *Command, through, fixed string) (string, error) {
+	n := cmd.Arg2
+	switch cmd.Arg1 {
+	case "local", "argument", "this", "that":
+		address := fmt.Sprintf("m.RAM[%s]+%d", segment_map[cmd.Arg1], n)
+		return fmt.Sprintf(through, address), nil
+	case "pointer":
+		return fmt.Sprintf(fixed, 3+n), nil
+	case "temp":
+		return fmt.Sprintf(fixed, 5+n), nil
+	case "static":
+		return fmt.Sprintf(fixed, g.static(cmd.File, n)), nil
+	}
+	return "", fmt.Errorf("Unknown segment: (%v)", cmd.Arg1)
+}
+
+// static returns the address of a static variable.  The addresses
+// start at 16, in the order that they are first used, just like
+// the assembler gives them out.
+func (g *goWriter) static(file string, n int) int {
+	name := file + "." + strconv.Itoa(n)
+	address, ok := g.statics[name]
+	if !ok {
+		address = 16 + len(g.statics)
+		g.statics[name] = address
+	}
+	return address
+}
+
+// goName turns a VM name into a Go identifier, with a prefix so it
+// can't be a keyword.  If two VM names would end up the same, a number
+// is added to the end of the second one.
+func goName(prefix string, name string, used map[string]bool) string {
+	s := prefix + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	unique := s
+	for i := 2; used[unique]; i++ {
+		unique = s + "_" + strconv.Itoa(i)
+	}
+	used[unique] = true
+	return unique
+}
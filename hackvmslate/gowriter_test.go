@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The test program is translated into Go, and then built and run with
+// the go command, which prints each of the results.
+func TestWriteGo(t *testing.T) {
+	gocmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is needed to build the Go code.")
+	}
+	p, err := LoadProgram(strings.NewReader(test_program), "Test.vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := WriteGo(buf, p, "main"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "hackvmslate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner := fmt.Sprintf(`package main
+
+import "fmt"
+
+func main() {
+	m := NewMachine()
+	m.Run()
+	for i := 0; i < %d; i++ {
+		fmt.Println(m.Static("Test.vm", i))
+	}
+	fmt.Println(m.Halted, m.Call("main.fib", 12))
+}
+`, len(test_program_results))
+	files := map[string]string{"program.go": buf.String(), "main.go": runner}
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(gocmd, "run", "main.go", "program.go")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	want := ""
+	for _, r := range test_program_results {
+		want += fmt.Sprintln(r)
+	}
+	want += "true 144\n"
+	if string(out) != want {
+		t.Errorf("got:\n%s\nexpected:\n%s", out, want)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/guard"
+)
+
+// A function that calls itself forever, so the stack always overflows.
+const test_overflow_program = `
+function Sys.init 0
+	push constant 1
+	call Main.forever 1
+label halt
+	goto halt
+
+function Main.forever 3
+	push argument 0
+	push constant 1
+	add
+	call Main.forever 1
+	return
+`
+
+func TestGuard(t *testing.T) {
+	var modes []testMode
+	for _, mode := range test_modes[:3] {
+		mode.cfg.guard_limit = 1000
+		modes = append(modes, mode)
+		mode.name = "push+" + mode.name
+		mode.cfg.guard_push = true
+		modes = append(modes, mode)
+	}
+
+	// The overflow should be caught before the stack passes the limit.
+	runModes(t, test_overflow_program, modes, 1000000, func(mode testMode, a *Assembly, c *cpu) {
+		if c.pc-1 != c.symbols["GUARD.HALT"] {
+			t.Errorf("%s: the program did not trap", mode.name)
+		}
+		want := int16(1)
+		if mode.cfg.guard_push {
+			want = 3
+		}
+		if got := c.ram[guard.ERROR_ADDRESS]; got != want {
+			t.Errorf("%s: error code: got:(%d), expected:(%d)", mode.name, got, want)
+		}
+		if sp := int(c.ram[0]); sp > mode.cfg.guard_limit {
+			t.Errorf("%s: the stack pointer went past the limit: %d", mode.name, sp)
+		}
+	})
+
+	// Programs that don't overflow should run the same as before.
+	runModes(t, test_program, modes, 1000000, func(mode testMode, a *Assembly, c *cpu) {
+		if c.pc-1 == c.symbols["GUARD.HALT"] {
+			t.Errorf("%s: trapped with error code %d", mode.name, c.ram[guard.ERROR_ADDRESS])
+		}
+		c.checkStatics(t, mode.name, "Test.vm", test_program_results)
+	})
+}
@@ -0,0 +1,246 @@
+// Function Inlining
+//
+// Small functions, like the getters that the Jack compiler writes for
+// "return x;", pay for the whole call and return routine every time
+// they are called.  The inliner copies the body of a small function
+// into the function that calls it, instead of calling it.
+//
+// The arguments and locals of the callee don't have a frame of their
+// own anymore, so they become extra locals of the caller:
+//
+//		local n ... local n+nArgs-1           the callee's arguments
+//		local n+nArgs ... local n+nArgs+k-1   the callee's k locals
+//		the next 1 or 2 locals                saved THIS and THAT
+//
+// where n is the number of locals the caller already had.  A normal
+// call restores THIS and THAT when it returns, so if the callee changes
+// them, they are saved before the body and restored after it.
+//
+// Moving the arguments and clearing the locals isn't free either, so a
+// call is only inlined if that costs less than the call and return it
+// replaces.
+//
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// InlineReport describes a single call that was replaced by the
+// body of the function that it called.
+type InlineReport struct {
+	Caller, Callee string
+	Call           *Command
+}
+
+// inline_call_cost is about how many commands a call and its return are
+// worth.  Together they are around 85 instructions, and a pop into a
+// local is 12.
+const inline_call_cost = 8
+
+// InlineFunctions replaces calls to small functions with the body of
+// the function.  A function is small if it has at most max_size
+// commands.  Functions that are recursive, or whose stack might not
+// be balanced, are never inlined, and neither are calls that would
+// cost more to set up than the call itself.
+func InlineFunctions(p Program, max_size int) (Program, []InlineReport) {
+	if max_size <= 0 {
+		return p, nil
+	}
+
+	// Find all of the functions, and which functions they call.
+	bodies := make(map[string]Program)
+	calls := make(map[string][]string)
+	for _, body := range splitFunctions(p) {
+		if body[0].Kind != C_FUNCTION {
+			continue
+		}
+		name := body[0].Arg1
+		bodies[name] = body
+		for _, cmd := range body {
+			if cmd.Kind == C_CALL {
+				calls[name] = append(calls[name], cmd.Arg1)
+			}
+		}
+	}
+
+	// Decide which of the functions can be inlined.
+	inlinable := make(map[string]bool)
+	for name, body := range bodies {
+		inlinable[name] = name != entry_function &&
+			len(body)-1 <= max_size &&
+			!isRecursive(name, calls) &&
+			hasBalancedReturns(body)
+	}
+
+	var reports []InlineReport
+	out := make(Program, 0, len(p))
+	counter := 0
+	for _, body := range splitFunctions(p) {
+		if body[0].Kind != C_FUNCTION {
+			out = append(out, body...)
+			continue
+		}
+		caller := body[0]
+		base := caller.Arg2
+		extra := 0
+		var new_body Program
+		for _, cmd := range body[1:] {
+			callee, ok := bodies[cmd.Arg1]
+			if cmd.Kind != C_CALL || !ok || !inlinable[cmd.Arg1] || cmd.Arg1 == caller.Arg1 || !fitsArguments(callee, cmd.Arg2) || setupCost(callee, cmd.Arg2) >= inline_call_cost {
+				new_body = append(new_body, cmd)
+				continue
+			}
+			counter++
+			inlined, used := inlineCall(cmd, callee, base, counter)
+			new_body = append(new_body, inlined...)
+			if used > extra {
+				extra = used
+			}
+			reports = append(reports, InlineReport{caller.Arg1, cmd.Arg1, cmd})
+		}
+		header := *caller
+		header.Arg2 += extra
+		out = append(out, &header)
+		out = append(out, new_body...)
+	}
+	return out, reports
+}
+
+// inlineCall returns the commands that replace a single call.  The
+// callee's segments start at local[base], and the labels are made
+// unique using the counter.  It also returns how many extra locals
+// the commands use.
+func inlineCall(call *Command, callee Program, base int, counter int) (Program, int) {
+	nArgs := call.Arg2
+	nLocals := callee[0].Arg2
+	prefix := "inline." + strconv.Itoa(counter) + "."
+	end := prefix + "end"
+
+	// at_call creates a new command at the location of the call.
+	at_call := func(kind int, arg1 string, arg2 int) *Command {
+		return &Command{Kind: kind, Arg1: arg1, Arg2: arg2, File: call.File, Line: call.Line}
+	}
+
+	saved := savedPointers(callee)
+	save := base + nArgs + nLocals
+
+	var out Program
+	for i, n := range saved {
+		out = append(out, at_call(C_PUSH, "pointer", n), at_call(C_POP, "local", save+i))
+	}
+
+	// The arguments are on the stack, with the last one on top.
+	for i := nArgs - 1; i >= 0; i-- {
+		out = append(out, at_call(C_POP, "local", base+i))
+	}
+
+	// Locals always start at 0.
+	for i := 0; i < nLocals; i++ {
+		out = append(out, at_call(C_PUSH, "constant", 0), at_call(C_POP, "local", base+nArgs+i))
+	}
+
+	// Copy the body.  The commands keep their own file, so that
+	// static variables still belong to the callee's file.
+	for _, cmd := range callee[1:] {
+		c := *cmd
+		switch {
+		case (c.Kind == C_PUSH || c.Kind == C_POP) && c.Arg1 == "argument":
+			c.Arg1 = "local"
+			c.Arg2 += base
+		case (c.Kind == C_PUSH || c.Kind == C_POP) && c.Arg1 == "local":
+			c.Arg2 += base + nArgs
+		case c.Kind == C_LABEL || c.Kind == C_GOTO || c.Kind == C_IF || c.Kind == C_IF_NOT:
+			c.Arg1 = prefix + c.Arg1
+		case c.Kind == C_RETURN:
+			c = Command{Kind: C_GOTO, Arg1: end, File: c.File, Line: c.Line}
+		}
+		out = append(out, &c)
+	}
+	out = append(out, at_call(C_LABEL, end, 0))
+
+	// The return value is on top of the stack.
+	for i, n := range saved {
+		out = append(out, at_call(C_PUSH, "local", save+i), at_call(C_POP, "pointer", n))
+	}
+	return out, nArgs + nLocals + len(saved)
+}
+
+// savedPointers returns which of THIS (0) and THAT (1) the callee
+// changes, and so need to be saved around its body.
+func savedPointers(callee Program) []int {
+	var saved []int
+	for _, n := range []int{0, 1} {
+		for _, cmd := range callee {
+			if cmd.Kind == C_POP && cmd.Arg1 == "pointer" && cmd.Arg2 == n {
+				saved = append(saved, n)
+				break
+			}
+		}
+	}
+	return saved
+}
+
+// setupCost returns how many commands inlineCall adds around the body:
+// a pop for each argument, a push and pop to clear each local, and a
+// push and pop both ways for each saved pointer.
+func setupCost(callee Program, nArgs int) int {
+	return nArgs + 2*callee[0].Arg2 + 4*len(savedPointers(callee))
+}
+
+// isRecursive returns true if the function can end up calling itself.
+func isRecursive(name string, calls map[string][]string) bool {
+	visited := make(map[string]bool)
+	queue := append([]string{}, calls[name]...)
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if next == name {
+			return true
+		}
+		if visited[next] {
+			continue
+		}
+		visited[next] = true
+		queue = append(queue, calls[next]...)
+	}
+	return false
+}
+
+// hasBalancedReturns checks that the stack holds exactly one value
+// (the return value) at every return.  A real return throws away
+// anything else that is left on the stack, but an inlined one can't.
+func hasBalancedReturns(body Program) bool {
+	balanced := true
+	last := C_FUNCTION
+	consistent := walkStack(body, func(cmd *Command, depth int) {
+		if cmd.Kind == C_RETURN && depth != 1 {
+			balanced = false
+		}
+		last = cmd.Kind
+	})
+
+	// Falling off the end of a function is not a return.
+	return consistent && balanced && (last == C_RETURN || last == C_GOTO)
+}
+
+// fitsArguments checks that the callee doesn't use any more
+// arguments than the call gives it.
+func fitsArguments(callee Program, nArgs int) bool {
+	for _, cmd := range callee {
+		if (cmd.Kind == C_PUSH || cmd.Kind == C_POP) && cmd.Arg1 == "argument" && cmd.Arg2 >= nArgs {
+			return false
+		}
+	}
+	return true
+}
+
+// PrintInlined lists each of the calls that were inlined.
+func PrintInlined(w io.Writer, reports []InlineReport) {
+	fmt.Fprintf(w, "Inlined %d calls:\n", len(reports))
+	for _, r := range reports {
+		fmt.Fprintf(w, "  %-30s into %-30s %s:%d\n", r.Callee, r.Caller, r.Call.File, r.Call.Line)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+// Getters, like the ones that Jack methods compile to, called in a
+// loop.  Main.get changes THIS, so it has to be saved around the body.
+// Main.clear has too many locals to be worth inlining.
+const test_inline_program = `
+function Sys.init 1
+	push constant 3000
+	pop pointer 1
+	push constant 42
+	pop that 1
+	push constant 4000
+	pop pointer 0
+label loop
+	push local 0
+	push constant 10
+	lt
+	not
+	if-goto done
+	push static 0
+	push constant 3000
+	call Main.get 1
+	add
+	pop static 0
+	push local 0
+	push constant 1
+	add
+	pop local 0
+	goto loop
+label done
+	push pointer 0
+	pop static 1         // THIS is still 4000
+	push constant 7
+	call Main.clear 1
+	pop static 2
+label halt
+	goto halt
+
+function Main.get 0
+	push argument 0
+	pop pointer 0
+	push this 1
+	return
+
+function Main.clear 6
+	push local 5
+	push argument 0
+	add
+	return
+`
+
+var test_inline_results = []int16{420, 4000, 7}
+
+// Only the getter should be inlined, and the program should give the
+// same results in fewer cycles.
+func TestInline(t *testing.T) {
+	_, reports := InlineFunctions(loadTest(t, test_inline_program), 20)
+	if len(reports) != 1 || reports[0].Callee != "main.get" {
+		t.Errorf("expected only Main.get to be inlined, got: %v", reports)
+	}
+
+	modes := []testMode{{name: "normal"}, {name: "inline", inline: 20}}
+	cycles := make(map[string]int)
+	runModes(t, test_inline_program, modes, 1000000, func(mode testMode, a *Assembly, c *cpu) {
+		c.checkStatics(t, mode.name, "Test.vm", test_inline_results)
+		cycles[mode.name] = c.cycles
+	})
+	if cycles["inline"] >= cycles["normal"] {
+		t.Errorf("inlining took %d cycles, and the calls took %d", cycles["inline"], cycles["normal"])
+	}
+}
@@ -0,0 +1,95 @@
+// Link Check
+//
+// A call to a function that isn't defined in any of the .vm files is
+// translated into a jump to @FUNCTION.name, just like any other call.
+// The assembler doesn't know that it was meant to be a label, so it
+// makes it a variable in RAM, and the program jumps into garbage.
+//
+// After every file has been parsed, the link check looks at the whole
+// program, and reports:
+//
+//		- calls to functions that are never defined.
+//		- functions that are defined more than once.
+//		- a missing Sys.init, which the bootstrap code calls.
+//		- calls to the same function with a different number of
+//		  arguments.
+//
+// Every problem is found before any of them are reported, so they
+// can all be fixed at once.
+//
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// LinkError is a single problem found by the link check.  A missing
+// Sys.init doesn't have a file or line.
+type LinkError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e LinkError) Error() string {
+	if e.File == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// LinkCheck finds the calls and functions that don't fit together.
+// The problems are returned in the same order as the program.
+func LinkCheck(p Program) []LinkError {
+	var errs []LinkError
+	defined := make(map[string]*Command)
+	for _, cmd := range p {
+		if cmd.Kind != C_FUNCTION {
+			continue
+		}
+		if first, ok := defined[cmd.Arg1]; ok {
+			errs = append(errs, LinkError{cmd.File, cmd.Line, fmt.Sprintf(
+				"function %s is already defined at %s:%d", cmd.Arg1, first.File, first.Line)})
+			continue
+		}
+		defined[cmd.Arg1] = cmd
+	}
+
+	// The first call to each function decides how many arguments
+	// the others should have.
+	first_call := make(map[string]*Command)
+	for _, cmd := range p {
+		if cmd.Kind != C_CALL {
+			continue
+		}
+		if _, ok := defined[cmd.Arg1]; !ok {
+			errs = append(errs, LinkError{cmd.File, cmd.Line, fmt.Sprintf(
+				"call to undefined function %s", cmd.Arg1)})
+			continue
+		}
+		first, ok := first_call[cmd.Arg1]
+		if !ok {
+			first_call[cmd.Arg1] = cmd
+			continue
+		}
+		if cmd.Arg2 != first.Arg2 {
+			errs = append(errs, LinkError{cmd.File, cmd.Line, fmt.Sprintf(
+				"call %s with %d arguments, but %s:%d calls it with %d",
+				cmd.Arg1, cmd.Arg2, first.File, first.Line, first.Arg2)})
+		}
+	}
+
+	if _, ok := defined[entry_function]; !ok {
+		errs = append(errs, LinkError{Message: "there is no function Sys.init, which is where the program starts"})
+	}
+	return errs
+}
+
+// PrintLinkErrors lists each of the problems found by the link check.
+func PrintLinkErrors(w io.Writer, errs []LinkError) {
+	fmt.Fprintf(w, "Link check found %d problems:\n", len(errs))
+	for _, e := range errs {
+		fmt.Fprintln(w, "  "+e.Error())
+	}
+}
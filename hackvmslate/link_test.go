@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const test_link_program = `
+function Main.main 0
+	push constant 1
+	call Main.twice 1
+	push constant 1
+	push constant 2
+	call Main.twice 2
+	call Math.sqrt 1
+	return
+
+function Main.twice 0
+	push argument 0
+	push argument 0
+	add
+	return
+
+function Main.twice 0
+	push constant 0
+	return
+`
+
+func TestLinkCheck(t *testing.T) {
+	p, err := LoadProgram(strings.NewReader(test_link_program), "Main.vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Main.vm:17: function main.twice is already defined at Main.vm:11",
+		"Main.vm:7: call main.twice with 2 arguments, but Main.vm:4 calls it with 1",
+		"Main.vm:8: call to undefined function math.sqrt",
+		"there is no function Sys.init, which is where the program starts",
+	}
+	errs := LinkCheck(p)
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, expected %d: %v", len(errs), len(want), errs)
+	}
+	for i := range want {
+		if errs[i].Error() != want[i] {
+			t.Errorf("got:(%s), expected:(%s)", errs[i].Error(), want[i])
+		}
+	}
+
+	// The test program is complete, so there should be nothing to report.
+	p, err = LoadProgram(strings.NewReader(test_program), "Test.vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := LinkCheck(p); len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
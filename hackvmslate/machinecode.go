@@ -0,0 +1,91 @@
+// Machine Code
+//
+// The code writer doesn't write text.  Its templates are split into
+// instructions (the Instruction type of the hackasm/asm package) once,
+// when the translator starts, and translating a command only copies
+// those instructions and fills in their labels.  See package code.
+//
+// With -hack, the instructions are handed straight to the encoder of
+// the assembler, which makes the .hack file.  The .asm file is written
+// out from the same instructions, so the two always agree.
+//
+// If an instruction can't be encoded, the error points to the VM
+// command that it was written for, instead of turning into the wrong
+// machine code.
+//
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+)
+
+// Assembly is everything that WriteAssembly translated.  Code has the
+// instructions, with the lines of the .asm file that they were written
+// on.  Lines is how many lines the .asm file has, and the source map
+// connects those lines to the VM commands.
+type Assembly struct {
+	Code      []asm.Instruction
+	Lines     int
+	SourceMap []SourceMapEntry
+}
+
+// writeCode writes the instructions as assembly code, one on each
+// line, below the comment.  It returns a copy of the instructions with
+// the lines that they were written on, since the templates that they
+// came from are shared.
+func writeCode(lw *lineWriter, comment string, code []asm.Instruction) []asm.Instruction {
+	if comment != "" {
+		fmt.Fprintln(lw, "// "+comment)
+	}
+	written := make([]asm.Instruction, len(code))
+	for i, in := range code {
+		in.Line = lw.lines + 1
+		if in.Comment != "" {
+			fmt.Fprintf(lw, "%v  // %s\n", in, in.Comment)
+		} else {
+			fmt.Fprintln(lw, in)
+		}
+		written[i] = in
+	}
+	return written
+}
+
+// MachineCode turns the instructions into machine code.  It also
+// returns the ROM address of each line of the .asm file, which are
+// used to convert the source map.
+func (a *Assembly) MachineCode() ([]uint16, []int, error) {
+	words, err := asm.Assemble(a.Code)
+	if err == nil {
+		return words, asm.RomAddresses(a.Code, a.Lines), nil
+	}
+	if e, ok := err.(*asm.Error); ok {
+		if where := a.sourceOfLine(e.Line); where != "" {
+			return nil, nil, fmt.Errorf("%s: %v", where, e.Err)
+		}
+	}
+	return nil, nil, err
+}
+
+// sourceOfLine finds the VM command that a line of assembly was
+// written for.  The code that isn't written for any command, like the
+// bootstrap code and the shared routines, doesn't have a source.
+func (a *Assembly) sourceOfLine(line int) string {
+	for _, e := range a.SourceMap {
+		if line >= e.First && line <= e.Last {
+			return fmt.Sprintf("%s:%d (%s)", e.File, e.Line, e.Function)
+		}
+	}
+	return ""
+}
+
+// WriteHackSourceMap writes the source map with ROM addresses instead
+// of lines, in the same format that hackasm writes.
+func (a *Assembly) WriteHackSourceMap(w io.Writer, addresses []int) error {
+	lines := new(bytes.Buffer)
+	WriteSourceMap(lines, a.SourceMap)
+	return asm.ConvertSourceMap(lines, w, addresses)
+}
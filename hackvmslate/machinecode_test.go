@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+)
+
+func TestMachineCode(t *testing.T) {
+	p, err := LoadProgram(strings.NewReader(test_program), "Test.vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := new(bytes.Buffer)
+	a, err := WriteAssembly(src, p, config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	words, addresses, err := a.MachineCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := CountInstructions(a.Code); len(words) != n {
+		t.Errorf("got %d words, expected %d", len(words), n)
+	}
+	if end := addresses[len(addresses)-1]; end != len(words) {
+		t.Errorf("the last address is %d, expected %d", end, len(words))
+	}
+
+	// The .asm file is written from the same instructions, so the
+	// assembler should make the same machine code from it.
+	program, err := asm.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from_text, err := asm.Assemble(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(from_text) != len(words) {
+		t.Fatalf("the .asm file has %d words, expected %d", len(from_text), len(words))
+	}
+	for i := range words {
+		if from_text[i] != words[i] {
+			t.Fatalf("address %d: the .asm file has %016b, expected %016b", i, from_text[i], words[i])
+		}
+	}
+}
+
+// An instruction that can't be encoded is reported with the VM command
+// that it was written for.
+func TestMachineCodeBrokenInstruction(t *testing.T) {
+	a := translateTest(t, test_program, test_modes[0])
+	var entry SourceMapEntry
+	for _, entry = range a.SourceMap {
+		if entry.Line == 3 {
+			break
+		}
+	}
+	broken := func(change func(in *asm.Instruction)) *Assembly {
+		b := *a
+		b.Code = append([]asm.Instruction(nil), a.Code...)
+		for i := range b.Code {
+			if b.Code[i].Kind == asm.C && b.Code[i].Line >= entry.First && b.Code[i].Line <= entry.Last {
+				change(&b.Code[i])
+				break
+			}
+		}
+		return &b
+	}
+
+	// "push constant 10" with a computation that doesn't exist.
+	b := broken(func(in *asm.Instruction) { in.Comp = "X" })
+	if _, _, err := b.MachineCode(); err == nil || !strings.HasPrefix(err.Error(), "Test.vm:3 (sys.init): invalid computation") {
+		t.Errorf("got error: %v", err)
+	}
+
+	// The first label defined again in "push constant 10".
+	var label asm.Instruction
+	for _, label = range a.Code {
+		if label.Kind == asm.L {
+			break
+		}
+	}
+	b = broken(func(in *asm.Instruction) { *in = asm.Instruction{Kind: asm.L, Symbol: label.Symbol, Line: in.Line} })
+	if _, _, err := b.MachineCode(); err == nil || !strings.HasPrefix(err.Error(), "Test.vm:3 (sys.init)") {
+		t.Errorf("got error: %v", err)
+	}
+}
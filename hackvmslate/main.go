@@ -2,11 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
 )
 
 const help_message = `
@@ -18,9 +23,10 @@ INFO:
 
 USAGE:
 	hackvmslate [options]
+	hackvmslate analyze [-dot file] [-json file]
 
 	When no options are used, the Current Working Directory
-	will be examined for .vm files.  If there exist .vm files,
+	will be examined for .vm files (and .vmb bytecode files).  If there exist .vm files,
 	then each one will be parsed, and a single file .asm will
 	be output.
 
@@ -28,6 +34,11 @@ USAGE:
 	current working directory, followed by ".asm".  It will 
 	overwrite an existing file of the same name.
 
+	A source map is also written, with ".map" added to the
+	name of the .asm file.  It connects each line of assembly
+	to the VM file and line that it came from.  The assembler
+	will use it to find the ROM address of each VM command.
+
 OPTIONS:
 
 -h | --help
@@ -39,30 +50,166 @@ OPTIONS:
 	to store the output.  This can be useful if you want 
 	to only process a single file, or if you want to 
 	experiment by typing directly.
+
+-O passes
+	Runs the optimizer over the VM commands before they are
+	translated.  Passes is a comma separated list, or "all".
+	The passes are:
+		fold     constant folding and constant conditions.
+		pushpop  removes a push followed by a pop to the same place.
+		thread   jumps to a goto are sent straight to its target.
+		ifnot    fuses "not" and "if-goto" into a single jump, when
+		         the value is known to be a boolean.
+		dead     removes code after a goto or return.
+
+-stats
+	Prints statistics about the optimizer passes to stderr.
+
+-compact
+	Writes a single shared routine for call, return, and each
+	of the comparisons (eq, gt, lt), and jumps to them instead
+	of writing the whole routine every time.  This makes the
+	program much smaller, and a bit slower.  The size of the
+	ROM with and without this flag is printed to stdout.
+
+-cache
+	Keeps the value on top of the stack in the D register
+	between commands, whenever it can.  This avoids storing
+	a value only to load it again in the next command, so
+	the program runs faster and is usually smaller.
+
+-prune
+	Removes every function that can't be reached by following
+	the calls from Sys.init.  This is useful when translating
+	a program together with the whole OS, since most programs
+	only use a few of its functions.  Each of the functions
+	that were removed is printed to stdout.
+
+-inline size
+	Replaces each call to a small function with a copy of the
+	body of that function.  A function is small if it has at
+	most "size" commands.  Recursive functions are never
+	inlined, and neither are calls where copying the arguments
+	and clearing the locals would cost more than the call
+	itself.  Each of the calls that were inlined is printed
+	to stdout.  Works well together with -prune, which removes
+	the functions that are no longer called.
+
+-guard limit
+	Checks the stack pointer before each call and before each
+	function pushes its locals.  If the stack would grow past
+	the limit, the program jumps to a trap routine, which
+	writes an error code to R15 and halts.  Use 2048 to stop
+	the stack from growing into the heap.  The error codes are:
+		1   a call would push its frame past the limit.
+		2   a function would push its locals past the limit.
+		3   a push command would go past the limit.
+
+-guard-push
+	Also checks the stack pointer before every push command.
+	This catches the overflow exactly where it happens, but
+	makes the program much bigger and slower.  Uses a limit of
+	2048 unless -guard is also given.
+
+-bytecode file
+	Writes the program to the file as bytecode, instead of
+	writing assembly code.  Bytecode is much faster to load
+	than the text of the .vm files.  Files in the working
+	directory that end with ".vmb" are loaded as bytecode,
+	so the whole OS can be saved as a single .vmb file, and
+	copied next to the .vm files of a game.  Be careful not
+	to write the file into the directory being translated,
+	or it will be loaded again the next time.
+
+-nolink
+	Skips the link check.  Normally, the translator stops if a
+	function is called but never defined, if a function is
+	defined twice, if there is no Sys.init, or if a function is
+	called with different numbers of arguments.  Each problem
+	is listed with the file and line it came from.
+
+-j n
+	Translates up to n functions at the same time.  Each
+	function has its own labels, and the functions are always
+	written in the same order, so the output doesn't depend
+	on n.  The default is the number of CPUs.
+
+-hack
+	Writes machine code instead of assembly code, with ".hack"
+	instead of ".asm" at the end of the name, so hackasm
+	isn't needed.  The assembly code is assembled while it is
+	still in memory, and a source map with ROM addresses is
+	written next to the .hack file.
+
+-asm
+	Used with -hack.  Also writes the .asm file and its source
+	map, which is helpful for debugging.
+
+-go package
+	Writes a Go package instead of assembly code, with ".go"
+	instead of ".asm" at the end of the name.  Each VM
+	function becomes a method of a Machine, which has the
+	same RAM as the Hack computer.  The Machine has hooks
+	for the screen, the keyboard, and functions that aren't
+	in the program (like the OS), so a game can be built
+	into a native program, or unit tested at full speed.
+	The optimizer, -inline, and -prune still work with it.
+
+ANALYZE:
+
+hackvmslate analyze [-dot file] [-json file]
+	Reads the .vm files in the working directory, but doesn't
+	translate them.  Instead, it prints the call graph: which
+	functions are recursive, which functions are called but
+	never defined, and the most words each function can put
+	on the stack.  It warns if the stack can grow past 2048,
+	where the heap starts.
+
+	-dot file    writes the call graph for graphviz.
+	-json file   writes the whole analysis as JSON.
 `
 
 var (
 	working_directory = ""
 	interactive_mode  = false
-	current_filename  = ""
+	opt_passes        = ""
+	opt_stats         = false
+	prune_mode        = false
+	inline_size       = 0
+	go_package        = ""
+	bytecode_file     = ""
+	no_link           = false
+	hack_mode         = false
+	asm_mode          = false
+
+	// translate_config is set by -compact, -cache, -guard, and
+	// -guard-push.
+	translate_config config
 )
 
 func main() {
 
-	// Checks to see if there are any arguments given.
-	// If not, then exit with help message.
-	// if len(os.Args) < 2 {
-	// 	fmt.Fprintln(os.Stderr, help_message)
-	// 	os.Exit(1)
-	// }
-
-	// checks for the help message flag "-h" or "--help"
-	for _, v := range os.Args {
-		if v == "-h" || v == "--help" {
-			fmt.Fprintln(os.Stderr, help_message)
-			os.Exit(1)
-		}
+	// Handle the command line flags.  The help message is shown
+	// for "-h" and "--help", or if any of the flags are wrong.
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, help_message)
 	}
+	flag.BoolVar(&interactive_mode, "i", false, "")
+	flag.StringVar(&opt_passes, "O", "", "")
+	flag.BoolVar(&opt_stats, "stats", false, "")
+	flag.BoolVar(&translate_config.compact, "compact", false, "")
+	flag.BoolVar(&translate_config.cache, "cache", false, "")
+	flag.BoolVar(&prune_mode, "prune", false, "")
+	flag.IntVar(&inline_size, "inline", 0, "")
+	flag.IntVar(&translate_config.guard_limit, "guard", 0, "")
+	flag.BoolVar(&translate_config.guard_push, "guard-push", false, "")
+	flag.StringVar(&go_package, "go", "", "")
+	flag.StringVar(&bytecode_file, "bytecode", "", "")
+	flag.BoolVar(&no_link, "nolink", false, "")
+	flag.BoolVar(&hack_mode, "hack", false, "")
+	flag.IntVar(&translate_jobs, "j", translate_jobs, "")
+	flag.BoolVar(&asm_mode, "asm", false, "")
+	flag.Parse()
 
 	// initialize variables that will hold pointers to the
 	// source reader and target writer.
@@ -72,15 +219,112 @@ func main() {
 	// Check arguments for "-i", and enter Interactive mode.
 	// Set input and output to stdin and stdout.
 	// Enter parsing mode, and then exit the program.
-	if len(os.Args) >= 2 && os.Args[1] == "-i" {
-		interactive_mode = true
-		current_filename = "stdin"
+	if interactive_mode {
 		r = bufio.NewReader(os.Stdin)
 		w = bufio.NewWriter(os.Stdout)
 		parseFile(r, w)
 		os.Exit(0)
 	}
 
+	// "hackvmslate analyze" only looks at the program, and
+	// doesn't translate anything.
+	if flag.Arg(0) == "analyze" {
+		analyzeWorkingDirectory(flag.Args()[1:])
+		return
+	}
+
+	// Checking every push doesn't make sense without a limit,
+	// so use the start of the heap.
+	if translate_config.guard_push && translate_config.guard_limit <= 0 {
+		translate_config.guard_limit = heap_base
+	}
+
+	// Check the optimizer passes before doing any work.
+	opt, err := NewOptimizer(opt_passes)
+	if err != nil {
+		failrar(err)
+	}
+
+	program := loadWorkingDirectory()
+
+	// Check that the calls and the functions fit together.  Bytecode
+	// and Go packages can be missing functions, since they are filled
+	// in later, by other bytecode or by the Go program.
+	if !no_link && bytecode_file == "" && go_package == "" {
+		if errs := LinkCheck(program); len(errs) > 0 {
+			PrintLinkErrors(os.Stderr, errs)
+			os.Exit(1)
+		}
+	}
+
+	// Replace calls to small functions with their bodies.
+	if inline_size > 0 {
+		var reports []InlineReport
+		program, reports = InlineFunctions(program, inline_size)
+		PrintInlined(os.Stdout, reports)
+	}
+
+	// Remove the functions that are never called, and list them.
+	if prune_mode {
+		var removed []*Command
+		program, removed = PruneFunctions(program)
+		PrintPruned(os.Stdout, removed)
+	}
+
+	// Optimize the whole program before it gets translated.
+	program = opt.Optimize(program)
+	if opt_stats {
+		opt.PrintStats(os.Stderr)
+	}
+
+	// Bytecode is written instead of assembly.
+	if bytecode_file != "" {
+		writeBytecodeFile(program)
+		return
+	}
+
+	// The Go backend writes a Go package instead of assembly.
+	if go_package != "" {
+		writeGoPackage(program)
+		return
+	}
+
+	// Translate the whole program.  The assembly code is only kept
+	// when there will be a .asm file.  In compact mode, the program
+	// is also translated the normal way, so that the difference in
+	// size can be reported.
+	assembly := new(bytes.Buffer)
+	var asm_writer io.Writer = assembly
+	if hack_mode && !asm_mode {
+		asm_writer = ioutil.Discard
+	}
+	normal_size := 0
+	if translate_config.compact {
+		normal := translate_config
+		normal.compact = false
+		a, err := WriteAssembly(ioutil.Discard, program, normal)
+		if err != nil {
+			failrar(err)
+		}
+		normal_size = CountInstructions(a.Code)
+	}
+	a, err := WriteAssembly(asm_writer, program, translate_config)
+	if err != nil {
+		failrar(err)
+	}
+	if translate_config.compact {
+		fmt.Println("ROM Size: ", normal_size, "->", CountInstructions(a.Code), "words")
+	}
+
+	// Machine code is made from the instructions that were just
+	// translated, without reading the assembly code back in.
+	if hack_mode {
+		writeHackFile(a)
+		if !asm_mode {
+			return
+		}
+	}
+
 	// Creates an output file if we aren't in interactive mode.
 	output_file, err := os.Create(GetOutputFilename())
 	if err != nil {
@@ -89,9 +333,81 @@ func main() {
 	defer output_file.Close()
 	defer fmt.Println("Created File: ", output_file.Name())
 	w = bufio.NewWriter(output_file)
+	defer w.Flush()
+	assembly.WriteTo(w)
+
+	// Write the source map next to the .asm file.
+	map_file, err := os.Create(output_file.Name() + ".map")
+	if err != nil {
+		failrar(err)
+	}
+	defer map_file.Close()
+	WriteSourceMap(map_file, a.SourceMap)
+
+	// Write the final line of assembly code to end program.
+	// fmt.Fprintln(w, s_end_program)
+}
+
+// writeHackFile assembles the program, and writes the machine code
+// next to where the .asm file would go, but with ".hack" at the end.
+// The source map is converted to ROM addresses, just like hackasm
+// does with the .asm.map file.
+func writeHackFile(a *Assembly) {
+	words, addresses, err := a.MachineCode()
+	if err != nil {
+		failrar(err)
+	}
+	name := strings.TrimSuffix(GetOutputFilename(), ".asm") + ".hack"
+	hack := new(bytes.Buffer)
+	asm.WriteHack(hack, words)
+	if err := ioutil.WriteFile(name, hack.Bytes(), 0644); err != nil {
+		failrar(err)
+	}
+	source := new(bytes.Buffer)
+	if err := a.WriteHackSourceMap(source, addresses); err != nil {
+		failrar(err)
+	}
+	if err := ioutil.WriteFile(name+".map", source.Bytes(), 0644); err != nil {
+		failrar(err)
+	}
+	fmt.Println("Created File: ", name)
+}
+
+// writeGoPackage translates the program into Go, and writes it next
+// to where the .asm file would go, but with ".go" at the end.
+func writeGoPackage(program Program) {
+	src := new(bytes.Buffer)
+	if err := WriteGo(src, program, go_package); err != nil {
+		failrar(err)
+	}
+	name := strings.TrimSuffix(GetOutputFilename(), ".asm") + ".go"
+	if err := ioutil.WriteFile(name, src.Bytes(), 0644); err != nil {
+		failrar(err)
+	}
+	fmt.Println("Created File: ", name)
+}
+
+// writeBytecodeFile writes the program as bytecode.
+func writeBytecodeFile(program Program) {
+	f, err := os.Create(bytecode_file)
+	if err != nil {
+		failrar(err)
+	}
+	defer f.Close()
+	if err := WriteBytecode(f, program); err != nil {
+		failrar(err)
+	}
+	fmt.Println("Created File: ", f.Name())
+}
+
+// loadWorkingDirectory parses each of the .vm files in the current
+// working directory, and collects all of their commands into a
+// single program.
+func loadWorkingDirectory() Program {
+	var err error
 
 	// Get the working directory, and save it in the global variable for later.
-	working_directory, err := os.Getwd()
+	working_directory, err = os.Getwd()
 	if err != nil {
 		failrar(err)
 	}
@@ -103,17 +419,50 @@ func main() {
 
 	fmt.Println("List of .vm Files in this directory:", file_list)
 
-	// Before writing each of the files, write Sys.Init
-	fmt.Fprintln(w, WriteInit())
-
-	// Go through each file, parsing it's code, and writing to the .asm file.
+	var program Program
 	for _, filename := range file_list {
-		fmt.Fprintln(w, "// ~~~~ "+filename+" ~~~~")
-		HandleFile(r, w, filename)
+		p, err := LoadFile(filename)
+		if err != nil {
+			failrar(err)
+		}
+		program = append(program, p...)
 	}
+	return program
+}
 
-	// Write the final line of assembly code to end program.
-	// fmt.Fprintln(w, s_end_program)
+// analyzeWorkingDirectory builds the call graph of the .vm files in
+// the working directory, prints the report, and writes the DOT and
+// JSON files if they were asked for.
+func analyzeWorkingDirectory(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	fs.Usage = flag.Usage
+	dot_file := fs.String("dot", "", "")
+	json_file := fs.String("json", "", "")
+	fs.Parse(args)
+
+	g := Analyze(loadWorkingDirectory())
+	g.PrintReport(os.Stdout)
+
+	if *dot_file != "" {
+		f, err := os.Create(*dot_file)
+		if err != nil {
+			failrar(err)
+		}
+		defer f.Close()
+		g.WriteDOT(f)
+		fmt.Println("Created File: ", f.Name())
+	}
+	if *json_file != "" {
+		f, err := os.Create(*json_file)
+		if err != nil {
+			failrar(err)
+		}
+		defer f.Close()
+		if err := g.WriteJSON(f); err != nil {
+			failrar(err)
+		}
+		fmt.Println("Created File: ", f.Name())
+	}
 }
 
 // failrar prints to stderr and exits the program.
@@ -162,6 +511,11 @@ func parseFile(r *bufio.Reader, w *bufio.Writer) {
 	// Keep track of the numbers of lines we have scanned.
 	source_line_count := 0
 
+	// The commands typed into stdin are all translated by the same
+	// codeWriter, as if they were one file.
+	cw := newCodeWriter("stdin", translate_config)
+	lw := &lineWriter{w: w}
+
 	// Parses each line found by the scanner.
 	for scanner.Scan() {
 
@@ -170,20 +524,20 @@ func parseFile(r *bufio.Reader, w *bufio.Writer) {
 		source_line_count++
 
 		// Parse the current line of source code,
-		// the result will be a string of assembly code.
+		// the result will be the assembly instructions.
 		// Check for any errors and loudly report them.
-		s, err := ParseLine(scanner.Text())
+		cmd, code, err := cw.ParseLine(scanner.Text())
 		if err != nil {
 			failrar("Line", source_line_count, ":", err, "\n[TEXT]:", scanner.Text())
 		}
 
-		// Skip past empty strings.
-		if len(s) < 1 {
+		// Skip past blank lines and comments.
+		if cmd == nil || len(code) < 1 {
 			continue
 		}
 
-		// Print the parsed string to the buffered output.
-		fmt.Fprintln(w, s)
+		// Print the assembly code to the buffered output.
+		writeCode(lw, cmd.String(), code)
 
 		// Flush the buffer ONLY if in standard output mode.
 		// Otherwise, hold the output in a buffer, and wait
@@ -198,6 +552,9 @@ func parseFile(r *bufio.Reader, w *bufio.Writer) {
 		failrar(err)
 	}
 
+	// The last value might still be cached in the D register.
+	writeCode(lw, "", cw.flush())
+
 	// Flush out the buffer, writing all of the stored data to file.
 	w.Flush()
 }
@@ -218,8 +575,10 @@ func GetVmFilesFromDir(path string) []string {
 	// check each of the file names for the extention ".vm",
 	// if a .vm is found, then add it to the list of filenames,
 	// which will be returned at the end of the function.
+	// Bytecode files (.vmb) are loaded the same way.
 	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".vm" {
+		switch filepath.Ext(file.Name()) {
+		case ".vm", ".vmb":
 			filename_list = append(filename_list, file.Name())
 		}
 	}
@@ -238,22 +597,3 @@ func GetOutputFilename() string {
 	name += ".asm"
 	return name
 }
-
-func HandleFile(r *bufio.Reader, w *bufio.Writer, filename string) {
-	// Attempt to open the file for reading.
-	input_file, err := os.Open(filename)
-	if err != nil {
-		failrar(err)
-	}
-	defer input_file.Close()
-
-	// Sets the global variable containing current filename
-	// this is used by the translator when encounting
-	// static varibles
-	current_filename = filepath.Base(filename)
-
-	// Creates buffered i/o for the files.
-	r = bufio.NewReader(input_file)
-	parseFile(r, w)
-	defer w.Flush()
-}
@@ -0,0 +1,496 @@
+// Optimizer
+//
+// The optimizer rewrites the VM commands of a whole program before
+// they are translated into assembly.  Each pass is a small peephole
+// rewrite, and the passes are run over and over until none of them
+// can find anything left to change.
+//
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Names of the optimizer passes, used by the -O flag.
+const (
+	OPT_FOLD    = "fold"
+	OPT_PUSHPOP = "pushpop"
+	OPT_THREAD  = "thread"
+	OPT_IFNOT   = "ifnot"
+	OPT_DEAD    = "dead"
+)
+
+// The passes are always run in this order.
+var all_passes = []string{OPT_FOLD, OPT_PUSHPOP, OPT_THREAD, OPT_IFNOT, OPT_DEAD}
+
+// Optimizer remembers which passes are turned on, and how many
+// rewrites each of them has made.
+type Optimizer struct {
+	enabled  map[string]bool
+	rewrites map[string]int
+	before   int
+	after    int
+}
+
+// NewOptimizer accepts a comma separated list of pass names.
+// "all" turns on every pass, and an empty string turns them all off.
+func NewOptimizer(passes string) (*Optimizer, error) {
+	opt := &Optimizer{
+		enabled:  make(map[string]bool),
+		rewrites: make(map[string]int),
+	}
+	for _, name := range strings.Split(passes, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case "all":
+			for _, pass := range all_passes {
+				opt.enabled[pass] = true
+			}
+		case OPT_FOLD, OPT_PUSHPOP, OPT_THREAD, OPT_IFNOT, OPT_DEAD:
+			opt.enabled[name] = true
+		default:
+			return nil, fmt.Errorf("Unknown optimizer pass: (%v).", name)
+		}
+	}
+	return opt, nil
+}
+
+// Optimize runs the enabled passes until the program stops changing.
+func (opt *Optimizer) Optimize(p Program) Program {
+	opt.before += len(p)
+	for changed := true; changed; {
+		changed = false
+		for _, pass := range all_passes {
+			if !opt.enabled[pass] {
+				continue
+			}
+			var n int
+			switch pass {
+			case OPT_FOLD:
+				p, n = foldConstants(p)
+			case OPT_PUSHPOP:
+				p, n = removePushPop(p)
+			case OPT_THREAD:
+				p, n = threadJumps(p)
+			case OPT_IFNOT:
+				p, n = fuseIfNot(p)
+			case OPT_DEAD:
+				p, n = removeDeadCode(p)
+			}
+			opt.rewrites[pass] += n
+			if n > 0 {
+				changed = true
+			}
+		}
+	}
+	opt.after += len(p)
+	return p
+}
+
+// PrintStats writes the number of rewrites made by each pass,
+// and the number of commands before and after optimizing.
+func (opt *Optimizer) PrintStats(w io.Writer) {
+	fmt.Fprintln(w, "Optimizer Statistics:")
+	for _, pass := range all_passes {
+		if !opt.enabled[pass] {
+			fmt.Fprintf(w, "  %-9s off\n", pass)
+			continue
+		}
+		fmt.Fprintf(w, "  %-9s %d rewrites\n", pass, opt.rewrites[pass])
+	}
+	fmt.Fprintf(w, "  commands  %d -> %d\n", opt.before, opt.after)
+}
+
+// ------------------------------------------------------------------
+// Constant Folding
+// ------------------------------------------------------------------
+
+// foldConstants replaces arithmetic on constants with the result.
+// Only "push constant n" with n in 0..32767 exists in the VM language,
+// so negative numbers are recognized (and written) as a positive
+// constant followed by "neg" or "not".  Conditional jumps on a
+// constant either become a goto, or disappear completely.
+func foldConstants(p Program) (Program, int) {
+	out := make(Program, 0, len(p))
+	n := 0
+	for _, cmd := range p {
+		switch {
+		case cmd.Kind == C_ARITHMETIC && isUnary(cmd.Arg1):
+			x, nx, ok := constantTail(out)
+			if !ok {
+				break
+			}
+			folded := writeConstant(evalUnary(cmd.Arg1, x), cmd)
+			if len(folded) >= nx+1 {
+				break
+			}
+			out = append(out[:len(out)-nx], folded...)
+			n++
+			continue
+
+		case cmd.Kind == C_ARITHMETIC:
+			y, ny, ok := constantTail(out)
+			if !ok {
+				break
+			}
+			x, nx, ok := constantTail(out[:len(out)-ny])
+			if !ok {
+				break
+			}
+			folded := writeConstant(evalBinary(cmd.Arg1, x, y), cmd)
+			if len(folded) >= nx+ny+1 {
+				break
+			}
+			out = append(out[:len(out)-nx-ny], folded...)
+			n++
+			continue
+
+		case cmd.Kind == C_IF || cmd.Kind == C_IF_NOT:
+			x, nx, ok := constantTail(out)
+			if !ok {
+				break
+			}
+			out = out[:len(out)-nx]
+			if (x != 0) == (cmd.Kind == C_IF) {
+				out = append(out, &Command{Kind: C_GOTO, Arg1: cmd.Arg1, File: cmd.File, Line: cmd.Line})
+			}
+			n++
+			continue
+		}
+		out = append(out, cmd)
+	}
+	return out, n
+}
+
+// constantTail checks if the end of the program pushes a constant.
+// It returns the value, and how many commands were used to push it.
+func constantTail(p Program) (int16, int, bool) {
+	if len(p) >= 2 && isConstant(p[len(p)-2]) && p[len(p)-1].Kind == C_ARITHMETIC && isUnary(p[len(p)-1].Arg1) {
+		return evalUnary(p[len(p)-1].Arg1, int16(p[len(p)-2].Arg2)), 2, true
+	}
+	if len(p) >= 1 && isConstant(p[len(p)-1]) {
+		return int16(p[len(p)-1].Arg2), 1, true
+	}
+	return 0, 0, false
+}
+
+// writeConstant returns the shortest list of commands that pushes
+// the value x.  The commands borrow their source location from cmd.
+func writeConstant(x int16, cmd *Command) Program {
+	push := func(n int) *Command {
+		return &Command{Kind: C_PUSH, Arg1: "constant", Arg2: n, File: cmd.File, Line: cmd.Line}
+	}
+	op := func(s string) *Command {
+		return &Command{Kind: C_ARITHMETIC, Arg1: s, File: cmd.File, Line: cmd.Line}
+	}
+	switch {
+	case x >= 0:
+		return Program{push(int(x))}
+	case x == -32768:
+		return Program{push(32767), op("not")}
+	}
+	return Program{push(int(-x)), op("neg")}
+}
+
+func isConstant(cmd *Command) bool {
+	return cmd.Kind == C_PUSH && cmd.Arg1 == "constant" && cmd.Arg2 >= 0 && cmd.Arg2 <= 32767
+}
+
+func isUnary(op string) bool {
+	return op == "neg" || op == "not"
+}
+
+// evalUnary and evalBinary do the same arithmetic as the Hack ALU.
+// The int16 type gives the same 16-bit wraparound.
+func evalUnary(op string, x int16) int16 {
+	switch op {
+	case "neg":
+		return -x
+	case "not":
+		return ^x
+	}
+	panic("ERROR: INVALID UNARY COMMAND GIVEN.")
+}
+
+func evalBinary(op string, x, y int16) int16 {
+	switch op {
+	case "add":
+		return x + y
+	case "sub":
+		return x - y
+	case "and":
+		return x & y
+	case "or":
+		return x | y
+	case "eq":
+		return boolToInt16(x == y)
+	case "gt":
+		return boolToInt16(x > y)
+	case "lt":
+		return boolToInt16(x < y)
+
+	// The extended commands give the same answers as the
+	// routines in package extended, even for the odd cases.
+	case "mul":
+		return x * y
+	case "div":
+		if y == 0 {
+			return 0
+		}
+		return x / y
+	case "mod":
+		if y == 0 {
+			return x
+		}
+		return x % y
+	case "shl":
+		switch {
+		case y <= 0:
+			return x
+		case y >= 16:
+			return 0
+		}
+		return x << uint(y)
+	case "shr":
+		switch {
+		case y <= 0:
+			return x
+		case y >= 16:
+			return x >> 15
+		}
+		return x >> uint(y)
+	}
+	panic("ERROR: INVALID ARITHMETIC COMMAND GIVEN.")
+}
+
+// true is -1 in the VM, because all of its bits are set.
+func boolToInt16(b bool) int16 {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+// ------------------------------------------------------------------
+// Push/Pop Elimination
+// ------------------------------------------------------------------
+
+// removePushPop removes a push that is immediately popped back into
+// the same place, since it leaves both the stack and memory unchanged.
+func removePushPop(p Program) (Program, int) {
+	out := make(Program, 0, len(p))
+	n := 0
+	for _, cmd := range p {
+		if cmd.Kind == C_POP && len(out) > 0 {
+			last := out[len(out)-1]
+			if last.Kind == C_PUSH && last.Arg1 == cmd.Arg1 && last.Arg2 == cmd.Arg2 && last.File == cmd.File {
+				out = out[:len(out)-1]
+				n++
+				continue
+			}
+		}
+		out = append(out, cmd)
+	}
+	return out, n
+}
+
+// ------------------------------------------------------------------
+// Jump Threading
+// ------------------------------------------------------------------
+
+// threadJumps looks at where each jump lands.  If it lands on a goto,
+// then the jump can go straight to the target of that goto instead.
+// A goto that jumps to the very next command is removed.
+//
+// Labels are only visible inside of their function, so a jump is
+// never threaded into a different function.
+func threadJumps(p Program) (Program, int) {
+	n := 0
+	for _, body := range splitFunctions(p) {
+
+		// Find the position of each label in the function.
+		labels := make(map[string]int)
+		for i, cmd := range body {
+			if cmd.Kind == C_LABEL {
+				labels[cmd.Arg1] = i
+			}
+		}
+
+		// target follows a label through any number of gotos.
+		// A chain of gotos that loops back on itself is left alone.
+		target := func(label string) string {
+			start := label
+			visited := map[string]bool{label: true}
+			for {
+				i, ok := labels[label]
+				if !ok {
+					return label
+				}
+				for i < len(body) && body[i].Kind == C_LABEL {
+					i++
+				}
+				if i >= len(body) || body[i].Kind != C_GOTO {
+					return label
+				}
+				label = body[i].Arg1
+				if visited[label] {
+					return start
+				}
+				visited[label] = true
+			}
+		}
+
+		for i, cmd := range body {
+			switch cmd.Kind {
+			case C_GOTO, C_IF, C_IF_NOT:
+				if t := target(cmd.Arg1); t != cmd.Arg1 {
+					body[i] = &Command{Kind: cmd.Kind, Arg1: t, File: cmd.File, Line: cmd.Line}
+					n++
+				}
+			}
+		}
+	}
+
+	// Remove any goto that only jumps over labels.
+	out := make(Program, 0, len(p))
+	for i, cmd := range p {
+		if cmd.Kind == C_GOTO && jumpsToNext(p, i) {
+			n++
+			continue
+		}
+		out = append(out, cmd)
+	}
+	return out, n
+}
+
+// jumpsToNext is true if the jump at p[i] lands on one of the labels
+// that directly follow it.
+func jumpsToNext(p Program, i int) bool {
+	for j := i + 1; j < len(p) && p[j].Kind == C_LABEL; j++ {
+		if p[j].Arg1 == p[i].Arg1 {
+			return true
+		}
+	}
+	return false
+}
+
+// splitFunctions returns the commands of each function as a slice of
+// the program.  Changes made to the slices are made to the program.
+// Commands before the first function are returned as their own slice.
+func splitFunctions(p Program) []Program {
+	var list []Program
+	start := 0
+	for i, cmd := range p {
+		if cmd.Kind == C_FUNCTION && i > start {
+			list = append(list, p[start:i])
+			start = i
+		}
+	}
+	if start < len(p) {
+		list = append(list, p[start:])
+	}
+	return list
+}
+
+// ------------------------------------------------------------------
+// Not and If-Goto Fusion
+// ------------------------------------------------------------------
+
+// fuseIfNot replaces "not" followed by "if-goto" with a single
+// if-not-goto, which jumps when the value is false.  The compiler
+// writes this pair for every "if" and "while" statement.
+//
+// The two only do the same thing when the value is a boolean, 0 or -1.
+// For 5, "not" gives -6, which makes if-goto jump, but if-not-goto
+// doesn't jump, since 5 isn't 0.  So the pair is only fused when the
+// value is known to be a boolean.
+func fuseIfNot(p Program) (Program, int) {
+	out := make(Program, 0, len(p))
+	n := 0
+	for _, cmd := range p {
+		if cmd.Kind == C_IF && len(out) > 1 {
+			last := out[len(out)-1]
+			if isNot(last) && isBoolean(out, len(out)-2) {
+				out[len(out)-1] = &Command{Kind: C_IF_NOT, Arg1: cmd.Arg1, File: cmd.File, Line: cmd.Line}
+				n++
+				continue
+			}
+		}
+		out = append(out, cmd)
+	}
+	return out, n
+}
+
+func isNot(cmd *Command) bool {
+	return cmd.Kind == C_ARITHMETIC && cmd.Arg1 == "not"
+}
+
+// isBoolean is true if the command at p[i] always leaves 0 or -1 on
+// the stack: a comparison, the constant 0 or -1, or "not" of another
+// boolean.  Anything else, like a variable, might be any number.  It
+// doesn't look through "and" and "or", which would mean finding where
+// both of their values came from.
+func isBoolean(p Program, i int) bool {
+	if i < 0 {
+		return false
+	}
+	cmd := p[i]
+	switch {
+	case cmd.Kind == C_ARITHMETIC && (cmd.Arg1 == "eq" || cmd.Arg1 == "lt" || cmd.Arg1 == "gt"):
+		return true
+	case isNot(cmd):
+		return isBoolean(p, i-1)
+	case cmd.Kind == C_PUSH && cmd.Arg1 == "constant" && cmd.Arg2 == 0:
+		return true
+	case cmd.Kind == C_ARITHMETIC && cmd.Arg1 == "neg" && i > 0:
+		// push constant 1, neg is how -1 is written.
+		prev := p[i-1]
+		return prev.Kind == C_PUSH && prev.Arg1 == "constant" && prev.Arg2 == 1
+	}
+	return false
+}
+
+// ------------------------------------------------------------------
+// Dead Code Removal
+// ------------------------------------------------------------------
+
+// removeDeadCode removes the commands after a goto or return.
+// Nothing can reach them until the next label that is the target of
+// a jump, or the next function.  Labels that are never the target
+// of a jump are removed as well.
+func removeDeadCode(p Program) (Program, int) {
+	out := make(Program, 0, len(p))
+	n := 0
+	for _, body := range splitFunctions(p) {
+		targets := make(map[string]bool)
+		for _, cmd := range body {
+			switch cmd.Kind {
+			case C_GOTO, C_IF, C_IF_NOT:
+				targets[cmd.Arg1] = true
+			}
+		}
+		dead := false
+		for _, cmd := range body {
+			if cmd.Kind == C_LABEL {
+				if !targets[cmd.Arg1] {
+					n++
+					continue
+				}
+				dead = false
+			}
+			if dead {
+				n++
+				continue
+			}
+			out = append(out, cmd)
+			switch cmd.Kind {
+			case C_GOTO, C_RETURN:
+				dead = true
+			}
+		}
+	}
+	return out, n
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// optimizeString parses the VM code, runs the given passes, and
+// returns the optimized VM code with one command per line.
+func optimizeString(t *testing.T, passes, src string) string {
+	p, err := LoadProgram(strings.NewReader(src), "Test.vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt, err := NewOptimizer(passes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, cmd := range opt.Optimize(p) {
+		lines = append(lines, cmd.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The parser converts everything to lowercase, so the tests do too.
+var optimizer_tests = []struct {
+	name, passes, src, want string
+}{
+	{
+		"fold add", "fold",
+		"push constant 2\npush constant 3\nadd",
+		"push constant 5",
+	},
+	{
+		"fold negative result", "fold",
+		"push constant 2\npush constant 3\nsub",
+		"push constant 1\nneg",
+	},
+	{
+		"fold wraparound", "fold",
+		"push constant 32767\npush constant 1\nadd",
+		"push constant 32767\nnot",
+	},
+	{
+		"fold comparison", "fold",
+		"push constant 2\npush constant 3\nlt\npush constant 0\nand",
+		"push constant 0",
+	},
+	{
+		"fold keeps true", "fold",
+		"push constant 0\nnot\npop local 0",
+		"push constant 0\nnot\npop local 0",
+	},
+	{
+		"fold constant condition", "fold",
+		"push constant 0\nnot\nif-goto a\npush constant 0\nif-goto b",
+		"goto a",
+	},
+	{
+		"pushpop", "pushpop",
+		"push local 0\npop local 0\npush local 0\npop local 1",
+		"push local 0\npop local 1",
+	},
+	{
+		"thread", "thread",
+		"function f 0\ngoto a\nlabel b\nreturn\nlabel a\ngoto b",
+		"function f 0\nlabel b\nreturn\nlabel a\ngoto b",
+	},
+	{
+		"thread loop", "thread",
+		"function f 0\nlabel a\ngoto b\nlabel b\ngoto a",
+		"function f 0\nlabel a\nlabel b\ngoto a",
+	},
+	{
+		"ifnot", "ifnot",
+		"push local 0\npush local 1\nlt\nnot\nif-goto end",
+		"push local 0\npush local 1\nlt\nif-not-goto end",
+	},
+	{
+		"ifnot boolean not", "ifnot",
+		"push local 0\npush local 1\neq\nnot\nnot\nif-goto end",
+		"push local 0\npush local 1\neq\nnot\nif-not-goto end",
+	},
+	{
+		// x might be 5, which "not" makes -6, and if-goto jumps.
+		"ifnot unknown value", "ifnot",
+		"push local 0\nnot\nif-goto end",
+		"push local 0\nnot\nif-goto end",
+	},
+	{
+		"dead", "dead",
+		"goto a\npush local 0\nlabel a\nreturn\npop local 0\nlabel b\nfunction g 0",
+		"goto a\nlabel a\nreturn\nfunction g 0",
+	},
+	{
+		"while true", "all",
+		"function f 0\nlabel l_while0\npush constant 1\nneg\nnot\nif-goto l_endwhile0\ncall g 0\npop temp 0\ngoto l_while0\nlabel l_endwhile0\npush constant 0\nreturn",
+		"function f 0\nlabel l_while0\ncall g 0\npop temp 0\ngoto l_while0",
+	},
+}
+
+func TestOptimizer(t *testing.T) {
+	for _, test := range optimizer_tests {
+		got := optimizeString(t, test.passes, test.src)
+		if got != test.want {
+			t.Errorf("%s:\n\tgot:\n%s\n\texpected:\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOptimizerUnknownPass(t *testing.T) {
+	if _, err := NewOptimizer("fold,bogus"); err == nil {
+		t.Error("expected an error for an unknown pass.")
+	}
+}
@@ -4,6 +4,8 @@ package main
 
 import (
 	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/code"
 	"strconv"
 	"strings"
 )
@@ -39,24 +41,38 @@ const (
 	C_FUNCTION = iota
 	C_RETURN   = iota
 	C_CALL     = iota
+
+	// Internal commands that have no spelling in the VM language.
+	// They are only created by the optimizer.
+	C_IF_NOT = iota // jumps when the popped value is false.
 )
 
+// Command is a single parsed line of VM code.  File and Line remember
+// where the command came from, so that later passes can report errors
+// and the codewriter knows which file owns the static segment.
 type Command struct {
 	Kind, Arg2 int
 	Arg1       string
+	File       string
+	Line       int
 }
 
-func ParseLine(line string) (string, error) {
+// ParseLine translates a single line of VM code that was typed into
+// stdin.  Blank lines and comments return a nil command.
+func (cw *codeWriter) ParseLine(line string) (*Command, []asm.Instruction, error) {
 
 	// Parse the line received from the file scanner
-	x, err := getCommandFromLine(line)
-	if len(x) < 1 {
-		return "", err
+	cmd, err := ParseCommand(line)
+	if cmd == nil || err != nil {
+		return nil, nil, err
 	}
-	return x, err
+	c, err := cw.Translate(cmd)
+	return cmd, c, err
 }
 
-func getCommandFromLine(line string) (string, error) {
+// ParseCommand converts a single line of VM code into a Command.
+// Blank lines and comments return a nil command and no error.
+func ParseCommand(line string) (*Command, error) {
 
 	// Remove Comments
 	// Looks for the first occurence of the comment: //
@@ -76,39 +92,50 @@ func getCommandFromLine(line string) (string, error) {
 	// If the fields are empty, then it is most likely a comment
 	// or a blank line.  This is normal, so it's not an error.
 	if len(fields) < 1 {
-		return "", nil
+		return nil, nil
 	}
 
 	// If there are more than 3 fields, then this is not a
 	// valid command for the hack VM.  Report the error and exit.
 	if len(fields) > 3 {
-		return "", fmt.Errorf("Too Many Arguments: %v", fields)
+		return nil, fmt.Errorf("Too Many Arguments: %v", fields)
 	}
 
 	// Create an command using the fields.
 	cmd, err := getCommandFromFields(fields)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return cmd, nil
+}
 
-	// Converts commands to assembly code based on their Kind.
-	// Invokes Codewriter.go
+// Translate converts the command to assembly instructions based on its Kind.
+// Invokes Codewriter.go
+func (cw *codeWriter) Translate(cmd *Command) ([]asm.Instruction, error) {
+	// commands typed into stdin don't have a file.
+	if cmd.File != "" {
+		cw.filename = cmd.File
+	}
+	if cw.cache {
+		return cw.translateCached(cmd)
+	}
 	switch cmd.Kind {
 
 	case C_ARITHMETIC:
-		return WriteArithmetic(cmd.Arg1), nil
+		return cw.WriteArithmetic(cmd.Arg1), nil
 
-	case C_POP, C_PUSH:
-		return cmd.WritePushPop()
+	case C_POP:
+		return cw.WritePushPop(cmd)
 
-	case C_LABEL, C_IF, C_GOTO, C_FUNCTION, C_RETURN, C_CALL:
-		return cmd.WriteProgramControl()
-	}
+	case C_PUSH:
+		c, err := cw.WritePushPop(cmd)
+		return code.Join(cw.writePushGuard(), c), err
 
-	// Convert into a string.
-	s := fmt.Sprintln(*cmd)
+	case C_LABEL, C_IF, C_IF_NOT, C_GOTO, C_FUNCTION, C_RETURN, C_CALL:
+		return cw.WriteProgramControl(cmd)
+	}
 
-	return s, nil
+	return nil, fmt.Errorf("There is no assembly for the command: %v", cmd)
 }
 
 // getCommandFromFields takes an array of strings that has already
@@ -127,6 +154,12 @@ func getCommandFromFields(fields []string) (*Command, error) {
 		cmd.Kind = C_ARITHMETIC
 		cmd.Arg1 = fields[0]
 
+	// The extended arithmetic commands aren't part of the
+	// standard VM.  See package extended.
+	case "mul", "div", "mod", "shl", "shr":
+		cmd.Kind = C_ARITHMETIC
+		cmd.Arg1 = fields[0]
+
 	case "label":
 		cmd.Kind = C_LABEL
 		cmd.Arg1 = fields[1]
@@ -210,6 +243,34 @@ func (cmd *Command) addPushPopArgs(fields []string) error {
 	return nil
 }
 
+// String converts the command back into a line of VM code.
+// The internal commands are spelled as if they were VM commands.
+func (cmd *Command) String() string {
+	switch cmd.Kind {
+	case C_ARITHMETIC:
+		return cmd.Arg1
+	case C_PUSH:
+		return fmt.Sprintf("push %s %d", cmd.Arg1, cmd.Arg2)
+	case C_POP:
+		return fmt.Sprintf("pop %s %d", cmd.Arg1, cmd.Arg2)
+	case C_LABEL:
+		return "label " + cmd.Arg1
+	case C_GOTO:
+		return "goto " + cmd.Arg1
+	case C_IF:
+		return "if-goto " + cmd.Arg1
+	case C_IF_NOT:
+		return "if-not-goto " + cmd.Arg1
+	case C_FUNCTION:
+		return fmt.Sprintf("function %s %d", cmd.Arg1, cmd.Arg2)
+	case C_CALL:
+		return fmt.Sprintf("call %s %d", cmd.Arg1, cmd.Arg2)
+	case C_RETURN:
+		return "return"
+	}
+	return fmt.Sprintf("%#v", *cmd)
+}
+
 func errWrongArguments(name string, expects, got int) error {
 	return fmt.Errorf("Invalid number of arguments for %s command. Expects:(%d), Got:(%d).", name, expects, got)
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fractalbach/nandGo2tetris/hackasm/asm"
+	"github.com/fractalbach/nandGo2tetris/hackvmslate/codewriter/guard"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// Program holds the commands from every .vm file being translated,
+// in the same order that they will be written to the .asm file.
+// Keeping the whole program in memory allows passes like the
+// optimizer to look at more than one line at a time.
+type Program []*Command
+
+// LoadFile parses every line of a .vm file into a Program.
+// Each command remembers the file and line number it came from.
+// A .vmb file is loaded as bytecode instead.
+func LoadFile(filename string) (Program, error) {
+	input_file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer input_file.Close()
+	if filepath.Ext(filename) == ".vmb" {
+		p, err := LoadBytecode(bufio.NewReader(input_file))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		return p, nil
+	}
+	return LoadProgram(input_file, filepath.Base(filename))
+}
+
+// LoadProgram parses VM code from a reader.  The name is used as
+// the File of each command, which also names the static segment.
+func LoadProgram(r io.Reader, name string) (Program, error) {
+	var p Program
+	scanner := bufio.NewScanner(r)
+	source_line_count := 0
+	for scanner.Scan() {
+		source_line_count++
+		cmd, err := ParseCommand(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v\n[TEXT]: %s", name, source_line_count, err, scanner.Text())
+		}
+		if cmd == nil {
+			continue
+		}
+		cmd.File = name
+		cmd.Line = source_line_count
+		p = append(p, cmd)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// translate_jobs is the most functions that are translated at the same
+// time.  The output is the same no matter what it is set to.
+var translate_jobs = runtime.NumCPU()
+
+// translatedFile is the assembly code written for a single function.
+type translatedFile struct {
+	cw     *codeWriter
+	blocks []block
+	err    error
+}
+
+// block is the code written for a single VM command.  function is the
+// function that the command was in, for the source map.
+type block struct {
+	cmd      *Command
+	function string
+	code     []asm.Instruction
+}
+
+// WriteProgram translates each command in the program, adds the
+// instructions to the assembly, and writes them to lw.  A header
+// comment is written at the start of each file.  It returns the
+// extended arithmetic commands that were used, so that their routines
+// can be written afterwards.
+//
+// Each function is translated by its own codeWriter, so the functions
+// are translated at the same time.  They are written in the same order
+// as the functions in the program, which makes the output exactly the
+// same as translating them one by one.  Every codeWriter gets the
+// same config.
+func (a *Assembly) WriteProgram(lw *lineWriter, p Program, cfg config) (map[string]bool, error) {
+	files := splitFunctions(p)
+	results := make([]translatedFile, len(files))
+
+	workers := translate_jobs
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j] = translateFunction(files[j], cfg)
+			}
+		}()
+	}
+	for j := range files {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+
+	used := make(map[string]bool)
+	for i, f := range results {
+		if f.err != nil {
+			return nil, f.err
+		}
+		if file := files[i][0].File; i == 0 || file != files[i-1][0].File {
+			fmt.Fprintln(lw, "// ~~~~ "+file+" ~~~~")
+		}
+		for _, b := range f.blocks {
+			a.writeCommand(lw, b)
+		}
+		for command := range f.cw.extended_used {
+			used[command] = true
+		}
+	}
+	return used, nil
+}
+
+// translateFunction translates the commands of a single function.
+//
+// A function can have commands from more than one file in it, after
+// other functions have been inlined into it.  Those commands still use
+// the static segment of their own file, but they are part of this
+// function, so its labels, and the labels made up by its codeWriter,
+// are all named after the function.
+func translateFunction(p Program, cfg config) translatedFile {
+	namespace := p[0].File
+	if p[0].Kind == C_FUNCTION {
+		namespace = p[0].Arg1
+	}
+	f := translatedFile{cw: newCodeWriter(namespace, cfg)}
+	for _, cmd := range p {
+		c, err := f.cw.Translate(cmd)
+		if err != nil {
+			f.err = fmt.Errorf("%s:%d: %v\n[TEXT]: %s", cmd.File, cmd.Line, err, cmd)
+			return f
+		}
+		if len(c) < 1 {
+			continue
+		}
+		f.blocks = append(f.blocks, block{cmd: cmd, function: f.cw.current_function, code: c})
+	}
+
+	// The last value might still be cached in the D register.
+	if c := f.cw.flush(); len(c) > 0 {
+		f.blocks = append(f.blocks, block{code: c})
+	}
+	return f
+}
+
+// writeCommand writes the code of a single command, below the command
+// itself as a comment, and adds it to the source map.  The code that
+// doesn't belong to any command is written without a comment.
+func (a *Assembly) writeCommand(lw *lineWriter, b block) {
+	if b.cmd == nil {
+		a.Code = append(a.Code, writeCode(lw, "", b.code)...)
+		return
+	}
+	first := lw.lines + 1
+	a.Code = append(a.Code, writeCode(lw, b.cmd.String(), b.code)...)
+	a.SourceMap = append(a.SourceMap, SourceMapEntry{
+		First:    first,
+		Last:     lw.lines,
+		File:     b.cmd.File,
+		Line:     b.cmd.Line,
+		Function: b.function,
+	})
+}
+
+// walkStack follows the depth of the working stack through the body of
+// a function, and calls visit with the depth before each command that
+// can be reached.  The depth starts at 0 after the function command.
+//
+// Commands after a goto or return can only be reached by jumping to a
+// label, so the depth at each label is remembered from the jumps to it.
+// walkStack returns false if a label is reached with different depths,
+// if a label's depth can't be known, or if the depth is ever negative.
+// In those cases, it keeps going using its best guess.
+func walkStack(body Program, visit func(cmd *Command, depth int)) bool {
+	depth := 0
+	known := true
+	consistent := true
+	at_label := make(map[string]int)
+
+	// jump records the depth of the stack when jumping to a label.
+	jump := func(label string) {
+		if d, ok := at_label[label]; ok {
+			if d != depth {
+				consistent = false
+			}
+			return
+		}
+		at_label[label] = depth
+	}
+
+	for _, cmd := range body[1:] {
+		if cmd.Kind == C_LABEL && !known {
+			d, ok := at_label[cmd.Arg1]
+			if ok {
+				depth = d
+			} else {
+				consistent = false
+			}
+			known = true
+		}
+		if !known {
+			continue
+		}
+		visit(cmd, depth)
+		switch cmd.Kind {
+		case C_LABEL:
+			jump(cmd.Arg1)
+		case C_PUSH:
+			depth++
+		case C_POP:
+			depth--
+		case C_ARITHMETIC:
+			if !isUnary(cmd.Arg1) {
+				depth--
+			}
+		case C_IF, C_IF_NOT:
+			depth--
+			jump(cmd.Arg1)
+		case C_GOTO:
+			jump(cmd.Arg1)
+			known = false
+		case C_CALL:
+			depth += 1 - cmd.Arg2
+		case C_RETURN:
+			known = false
+		}
+		if depth < 0 {
+			consistent = false
+			depth = 0
+		}
+	}
+	return consistent
+}
+
+// WriteAssembly writes the complete .asm file for a program:
+// the bootstrap code, the program itself, the shared routines
+// when using the compact mode, the routines for the extended
+// arithmetic commands, and the trap routine when the stack
+// guard is on.  Which of those are written depends on the config.
+//
+// The assembly code is written to w, and the instructions and the
+// source map are returned, for the -hack mode.
+func WriteAssembly(w io.Writer, p Program, cfg config) (*Assembly, error) {
+	a := new(Assembly)
+	lw := &lineWriter{w: w}
+	a.Code = append(a.Code, writeCode(lw, "bootstrap code", WriteInit(cfg))...)
+	extended_used, err := a.WriteProgram(lw, p, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.compact {
+		a.Code = append(a.Code, writeCode(lw, "shared routines", WriteSharedRoutines(cfg))...)
+	}
+	if c := WriteExtendedRoutines(extended_used); len(c) > 0 {
+		a.Code = append(a.Code, writeCode(lw, "extended arithmetic routines", c)...)
+	}
+	if cfg.guard_limit > 0 {
+		a.Code = append(a.Code, writeCode(lw, "stack guard trap", guard.Routines())...)
+	}
+	a.Lines = lw.lines
+	return a, nil
+}
+
+// CountInstructions returns the number of words of ROM that the
+// instructions will use.  Labels do not take up any space in the ROM.
+func CountInstructions(code []asm.Instruction) int {
+	n := 0
+	for _, in := range code {
+		if in.Kind != asm.L {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// loadFiles loads the test program as two files, so that both of them
+// count their labels from 1.
+func loadFiles(t *testing.T) Program {
+	i := strings.Index(test_program, "function Main.fib")
+	var p Program
+	for _, file := range []struct{ name, src string }{
+		{"Sys.vm", test_program[:i]},
+		{"Main.vm", test_program[i:]},
+	} {
+		f, err := LoadProgram(strings.NewReader(file.src), file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p = append(p, f...)
+	}
+	return p
+}
+
+// Translating the files at the same time should give exactly the same
+// output as translating them one by one.
+func TestParallel(t *testing.T) {
+	defer func(jobs int) {
+		translate_jobs = jobs
+	}(translate_jobs)
+	for _, mode := range test_modes[:3] {
+		var outputs []string
+		var last *Assembly
+		for _, jobs := range []int{1, 4} {
+			translate_jobs = jobs
+			buf := new(bytes.Buffer)
+			a, err := WriteAssembly(buf, loadFiles(t), mode.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, buf.String())
+			last = a
+		}
+		if outputs[0] != outputs[1] {
+			t.Errorf("%s: the output changed when translating at the same time", mode.name)
+		}
+
+		// The labels of each function shouldn't collide.
+		if _, _, err := last.MachineCode(); err != nil {
+			t.Errorf("%s: %v", mode.name, err)
+		}
+		c := newCPU(t, last)
+		c.run(t, 1000000)
+		c.checkStatics(t, mode.name, "Sys.vm", test_program_results)
+	}
+}
+
+// After inlining, a function can have commands from another file in
+// it.  The labels of the inlined commands must still match the rest of
+// the function, and their static variables must stay in their own file.
+func TestInlineAcrossFiles(t *testing.T) {
+	files := []struct{ name, src string }{
+		{"Sys.vm", `function Sys.init 0
+push constant 3
+call Main.get 1
+pop static 0
+push constant 4
+call Main.get 1
+pop static 1
+label halt
+goto halt
+`},
+		{"Main.vm", `function Main.get 0
+push argument 0
+pop static 0
+push argument 0
+push constant 3
+eq
+if-goto yes
+push constant 2
+neg
+return
+label yes
+push constant 1
+return
+`},
+	}
+	var p Program
+	for _, file := range files {
+		f, err := LoadProgram(strings.NewReader(file.src), file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p = append(p, f...)
+	}
+	p, reports := InlineFunctions(p, 20)
+	if len(reports) != 2 {
+		t.Fatalf("expected both calls to be inlined, got: %v", reports)
+	}
+	a, err := WriteAssembly(ioutil.Discard, p, config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCPU(t, a)
+	c.run(t, 100000)
+	want := []struct {
+		file        string
+		index, want int16
+	}{
+		{"Sys.vm", 0, 1},
+		{"Sys.vm", 1, -2},
+		{"Main.vm", 0, 4},
+	}
+	for _, w := range want {
+		if got := c.static(t, w.file, int(w.index)); got != w.want {
+			t.Errorf("static %s.%d: got:(%d), expected:(%d)", w.file, w.index, got, w.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Dead Function Elimination
+//
+// A program is usually translated together with the whole OS, but a
+// game only calls a few of the OS functions.  Every function that can't
+// be reached by following calls from Sys.init is removed, which frees
+// up a lot of space in the ROM.
+//
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// entry_function is called by the bootstrap code.  See WriteInit.
+const entry_function = "sys.init"
+
+// PruneFunctions removes the functions that can never be called.
+// It returns the smaller program, and the functions that were removed.
+// If the program has no entry function, nothing is removed, since
+// there's no way of knowing what will be called.
+func PruneFunctions(p Program) (Program, []*Command) {
+	bodies := make(map[string]Program)
+	for _, body := range splitFunctions(p) {
+		if body[0].Kind == C_FUNCTION {
+			bodies[body[0].Arg1] = body
+		}
+	}
+	if _, ok := bodies[entry_function]; !ok {
+		return p, nil
+	}
+
+	// Follow the calls from the entry function, marking each
+	// function that gets visited along the way.
+	reachable := map[string]bool{entry_function: true}
+	queue := []string{entry_function}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, cmd := range bodies[name] {
+			if cmd.Kind == C_CALL && !reachable[cmd.Arg1] {
+				reachable[cmd.Arg1] = true
+				queue = append(queue, cmd.Arg1)
+			}
+		}
+	}
+
+	// Keep the reachable functions in their original order.
+	// Commands that aren't inside of any function are always kept.
+	out := make(Program, 0, len(p))
+	var removed []*Command
+	for _, body := range splitFunctions(p) {
+		if body[0].Kind == C_FUNCTION && !reachable[body[0].Arg1] {
+			removed = append(removed, body[0])
+			continue
+		}
+		out = append(out, body...)
+	}
+	return out, removed
+}
+
+// PrintPruned lists each of the functions that were removed,
+// and the file that they came from.
+func PrintPruned(w io.Writer, removed []*Command) {
+	fmt.Fprintf(w, "Removed %d unreachable functions:\n", len(removed))
+	for _, cmd := range removed {
+		fmt.Fprintf(w, "  %-30s %s:%d\n", cmd.Arg1, cmd.File, cmd.Line)
+	}
+}
@@ -0,0 +1,53 @@
+// Source Maps
+//
+// The comments that the translator writes, like "// push local 2", are
+// thrown away by the assembler.  A source map is written next to the
+// .asm file, so that each line of assembly can be traced back to the
+// VM command that it came from.
+//
+// The source map is a text file, with one VM command on each line:
+//
+//		first last file:line function
+//
+// where first and last are the range of lines (counting from 1) in the
+// .asm file that were written for the command.  The assembler reads
+// this file, and converts the lines into ROM addresses.
+//
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// SourceMapEntry connects a range of lines in the .asm file to the
+// VM command that they were translated from.
+type SourceMapEntry struct {
+	First, Last int
+	File        string
+	Line        int
+	Function    string
+}
+
+// WriteSourceMap writes each of the entries in the source map.
+func WriteSourceMap(w io.Writer, entries []SourceMapEntry) {
+	fmt.Fprintln(w, "// hackvmslate source map: first last file:line function")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%d %d %s:%d %s\n", e.First, e.Last, e.File, e.Line, e.Function)
+	}
+}
+
+// lineWriter counts the number of lines that have been written.
+type lineWriter struct {
+	w     io.Writer
+	lines int
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' {
+			lw.lines++
+		}
+	}
+	return lw.w.Write(p)
+}